@@ -4,9 +4,16 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
@@ -14,31 +21,442 @@ import (
 	"github.com/vmware/crd-migration-tool/internal"
 )
 
+// Exit codes, so that automation can tell how a command ended.
+const (
+	// exitFailure means that some items or resources couldn't be migrated,
+	// or that the command failed while it was running.
+	exitFailure = 1
+	// exitPreflight means that the command didn't start, because of its
+	// options or the state of the clusters.
+	exitPreflight = 2
+	// exitInterrupted means that the command was stopped by a signal.
+	exitInterrupted = 3
+)
+
+// commands are run instead of a migration when named by the first
+// argument.
+var commands = map[string]func(options internal.Options, flags *pflag.FlagSet, args []string){
+	"plan":     runPlan,
+	"apply":    runApply,
+	"convert":  runConvert,
+	"snapshot": runSnapshot,
+	"restore":  runRestore,
+	"cleanup":  runCleanup,
+	"rollback": runRollback,
+	"verify":   runVerify,
+}
+
 func main() {
 	options := internal.Options{
-		LogLevel: logrus.InfoLevel.String(),
-		QPS:      float32(50.0),
-		Burst:    100,
-	}
-
-	pflag.StringVar(&options.LogLevel, "log-level", options.LogLevel, "log level")
-	pflag.StringVar(&options.Kubeconfig, "kubeconfig", options.Kubeconfig, "path to kubeconfig file")
-	pflag.StringVar(&options.Context, "context", options.Context, "specific context to use in the kubeconfig file")
-	pflag.StringVar(&options.OldGroupVersion, "from", options.OldGroupVersion, "the old groupVersion")
-	pflag.StringVar(&options.NewGroupVersion, "to", options.NewGroupVersion, "the new groupVersion")
-	pflag.Float32Var(&options.QPS, "qps", options.QPS, "client requests per second")
-	pflag.IntVar(&options.Burst, "burst", options.Burst, "client burst")
-	pflag.StringSliceVar(&options.NamespaceMappings, "namespace-mappings", options.NamespaceMappings, "specify from:to changes for item namespaces")
-	pflag.StringSliceVar(&options.LabelMappings, "label-mappings", options.LabelMappings, "specify from:to changes for label keys (e.g. example.com:example.io changes all label key occurrences of example.com to example.io)")
-	pflag.StringSliceVar(&options.AnnotationMappings, "annotation-mappings", options.AnnotationMappings, "specify from:to changes for annotations keys (e.g. example.com:example.io changes all label key occurrences of example.com to example.io)")
-	pflag.StringSliceVar(&options.UpdateOwnerRefMappings, "update-owner-refs", options.UpdateOwnerRefMappings, "specify parent:child ownerRef relationships that need to be updated (e.g. parent:child updates all child resources' ownerRefs to point to the new parent resources)")
-	pflag.Parse()
-
-	if len(os.Args) == 1 {
-		fmt.Fprintf(os.Stdout, "Usage of %s:\n", os.Args[0])
-		pflag.PrintDefaults()
+		LogLevel:         logrus.InfoLevel.String(),
+		QPS:              float32(50.0),
+		Burst:            100,
+		Output:           "yaml",
+		PageSize:         500,
+		Workers:          1,
+		JournalDir:       "crd-migrator-runs",
+		CRDTimeout:       2 * time.Minute,
+		OptOutAnnotation: "crd-migrator.vmware.com/skip",
+		OnConflict:       "skip",
+	}
+
+	args := os.Args[1:]
+	if len(args) > 0 {
+		if run, ok := commands[args[0]]; ok {
+			run(options, pflag.NewFlagSet(args[0], pflag.ExitOnError), args[1:])
+			return
+		}
+	}
+
+	runMigrate(options, pflag.NewFlagSet(os.Args[0], pflag.ExitOnError), args)
+}
+
+func runMigrate(options internal.Options, flags *pflag.FlagSet, args []string) {
+	addConfigFlag(flags, &options, args)
+	addClientFlags(flags, &options)
+	addMigrationFlags(flags, &options)
+	flags.StringSliceVar(&options.GroupVersionMappings, "group-versions", options.GroupVersionMappings, "more old:new groupVersion pairs to migrate in the same run as --from and --to (e.g. b.example.com/v1:b.example.io/v1); --update-owner-refs then names resources with their old group (e.g. bars.a.example.com:foos.b.example.com)")
+	flags.StringSliceVar(&options.VersionMappings, "version-mappings", options.VersionMappings, "specify from:to changes for the versions of groups given without a version to --from and --to (e.g. v1alpha1:v1,v1beta1:v1); unmapped versions are kept")
+	addSelectionFlags(flags, &options)
+	flags.BoolVar(&options.DryRun, "dry-run", options.DryRun, "print the items that would be created instead of creating them")
+	flags.StringVarP(&options.Output, "output", "o", options.Output, "output format for --dry-run (yaml or json)")
+	flags.StringVar(&options.Checkpoint, "checkpoint", options.Checkpoint, "path of a file to record migration progress in")
+	flags.BoolVar(&options.Resume, "resume", options.Resume, "resume the migration recorded in --checkpoint")
+	flags.IntVar(&options.Workers, "workers", options.Workers, "number of items of a resource to migrate in parallel")
+	flags.BoolVar(&options.ReportNewItems, "report-new-items", options.ReportNewItems, "list each resource again once it's migrated and warn about items created since it was listed")
+	flags.StringVar(&options.OnConflict, "on-conflict", options.OnConflict, "what to do with items that already exist in the new groupVersion (skip, overwrite, merge, fail or report)")
+	addJournalFlags(flags, &options)
+	flags.BoolVar(&options.MigrateCRDs, "migrate-crds", options.MigrateCRDs, "create or update the CRDs in the new groupVersion from the CRDs in the old groupVersion before migrating items")
+	flags.DurationVar(&options.CRDTimeout, "crd-timeout", options.CRDTimeout, "how long to wait for each CRD migrated with --migrate-crds to be established")
+	flags.StringSliceVar(&options.CRDShortNameMappings, "crd-short-name-mappings", options.CRDShortNameMappings, "specify from:to changes for the shortNames of CRDs migrated with --migrate-crds")
+	flags.StringSliceVar(&options.CRDCategoryMappings, "crd-category-mappings", options.CRDCategoryMappings, "specify from:to changes for the categories of CRDs migrated with --migrate-crds")
+	flags.StringVar(&options.ReportFile, "report-file", options.ReportFile, "path of a file to write a report of the run to")
+	flags.StringVar(&options.ReportFormat, "report-format", options.ReportFormat, "format of --report-file (json, yaml or junit), by default guessed from its extension")
+	parseFlags(flags, args)
+
+	if len(args) == 0 {
+		var names []string
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		fmt.Fprintf(os.Stdout, "Usage of %s [%s]:\n", os.Args[0], strings.Join(names, "|"))
+		flags.PrintDefaults()
 		os.Exit(0)
 	}
 
-	internal.NewMigrator(options).MigrateAllResources()
+	migrator := newMigrator(options)
+	stopOnSignal(migrator)
+	if _, err := migrator.MigrateAllResources(); err != nil {
+		exit(exitCode(err), err, "Error migrating resources")
+	}
+}
+
+func runPlan(options internal.Options, flags *pflag.FlagSet, args []string) {
+	planFile := "migration-plan.yaml"
+	addConfigFlag(flags, &options, args)
+	addClientFlags(flags, &options)
+	addMigrationFlags(flags, &options)
+	addSelectionFlags(flags, &options)
+	flags.StringVar(&planFile, "plan", planFile, "path of the plan file to write")
+	parseFlags(flags, args)
+	requireOneGroupVersion(options)
+
+	options.OneVersion = true
+	plan, err := newMigrator(options).Plan()
+	if err != nil {
+		exit(exitCode(err), err, "Error creating plan")
+	}
+	if err := internal.WritePlan(planFile, plan); err != nil {
+		exit(exitFailure, err, "Error writing plan")
+	}
+}
+
+func runApply(options internal.Options, flags *pflag.FlagSet, args []string) {
+	planFile := "migration-plan.yaml"
+	addClientFlags(flags, &options)
+	flags.StringVar(&planFile, "plan", planFile, "path of the plan file to apply")
+	flags.IntVar(&options.Workers, "workers", options.Workers, "number of items of a resource to migrate in parallel")
+	flags.BoolVar(&options.ReportNewItems, "report-new-items", options.ReportNewItems, "list each resource again once it's migrated and warn about items created since it was listed")
+	flags.StringVar(&options.OnConflict, "on-conflict", options.OnConflict, "what to do with items that already exist in the new groupVersion (skip, overwrite, merge, fail or report)")
+	addJournalFlags(flags, &options)
+	flags.StringVar(&options.ReportFile, "report-file", options.ReportFile, "path of a file to write a report of the run to")
+	flags.StringVar(&options.ReportFormat, "report-format", options.ReportFormat, "format of --report-file (json, yaml or junit), by default guessed from its extension")
+	parseFlags(flags, args)
+
+	plan, err := internal.ReadPlan(planFile)
+	if err != nil {
+		exit(exitPreflight, err, "Error reading plan")
+	}
+
+	migrator := newMigrator(plan.MigratorOptions(options))
+	stopOnSignal(migrator)
+	if _, err := migrator.ApplyPlan(plan); err != nil {
+		exit(exitCode(err), err, "Error applying plan")
+	}
+}
+
+func runConvert(options internal.Options, flags *pflag.FlagSet, args []string) {
+	var (
+		filenames []string
+		outputDir string
+	)
+	addConfigFlag(flags, &options, args)
+	flags.StringVar(&options.LogLevel, "log-level", options.LogLevel, "log level")
+	addMigrationFlags(flags, &options)
+	flags.StringSliceVarP(&filenames, "filename", "f", filenames, "manifest files or directories to convert, or - for stdin")
+	flags.StringVar(&outputDir, "output-dir", outputDir, "directory to write converted files to, instead of stdout")
+	flags.StringVarP(&options.Output, "output", "o", options.Output, "output format (yaml or json)")
+	parseFlags(flags, args)
+	requireOneGroupVersion(options)
+
+	if len(filenames) == 0 {
+		exit(exitPreflight, nil, "--filename is required")
+	}
+
+	migrator, err := internal.NewOfflineMigrator(options)
+	if err != nil {
+		exit(exitPreflight, err, "Error configuring conversion")
+	}
+	if err := migrator.ConvertManifests(filenames, outputDir, options.Output, os.Stdout); err != nil {
+		exit(exitFailure, err, "Error converting manifests")
+	}
+}
+
+func runSnapshot(options internal.Options, flags *pflag.FlagSet, args []string) {
+	archive := "snapshot.tar.gz"
+	addClientFlags(flags, &options)
+	flags.StringVar(&options.OldGroupVersion, "from", options.OldGroupVersion, "the groupVersion to snapshot, or a group to snapshot at one of its versions")
+	flags.StringVar(&archive, "archive", archive, "path of the snapshot archive to write")
+	parseFlags(flags, args)
+
+	options.OneVersion = true
+	migrator := newMigrator(options)
+	stopOnSignal(migrator)
+	if err := migrator.Snapshot(archive); err != nil {
+		exit(exitCode(err), err, "Error creating snapshot")
+	}
+}
+
+func runRestore(options internal.Options, flags *pflag.FlagSet, args []string) {
+	archive := "snapshot.tar.gz"
+	addClientFlags(flags, &options)
+	flags.StringVar(&options.NewGroupVersion, "to", options.NewGroupVersion, "the groupVersion to restore into")
+	addMappingFlags(flags, &options)
+	flags.StringVar(&archive, "archive", archive, "path of the snapshot archive to restore")
+	flags.IntVar(&options.Workers, "workers", options.Workers, "number of items of a resource to migrate in parallel")
+	flags.StringVar(&options.OnConflict, "on-conflict", options.OnConflict, "what to do with items that already exist in the new groupVersion (skip, overwrite, merge, fail or report)")
+	addJournalFlags(flags, &options)
+	parseFlags(flags, args)
+
+	snapshot, err := internal.OpenSnapshot(archive)
+	if err != nil {
+		exit(exitPreflight, err, "Error opening snapshot")
+	}
+	defer snapshot.Close()
+
+	options.OldGroupVersion = snapshot.Manifest.GroupVersion
+	options.Restore = true
+	migrator := newMigrator(options)
+	stopOnSignal(migrator)
+	if err := migrator.RestoreSnapshot(snapshot); err != nil {
+		snapshot.Close()
+		exit(exitCode(err), err, "Error restoring snapshot")
+	}
+}
+
+func runCleanup(options internal.Options, flags *pflag.FlagSet, args []string) {
+	var (
+		stripFinalizers []string
+		yes             bool
+	)
+	addConfigFlag(flags, &options, args)
+	addClientFlags(flags, &options)
+	addMigrationFlags(flags, &options)
+	addSelectionFlags(flags, &options)
+	flags.StringSliceVar(&stripFinalizers, "strip-finalizers", stripFinalizers, "finalizers to remove from items before deleting them, because their controllers are no longer running (e.g. example.com/cleanup); other finalizers are kept")
+	flags.BoolVar(&yes, "yes", yes, "delete without asking for confirmation")
+	parseFlags(flags, args)
+	requireOneGroupVersion(options)
+
+	options.OneVersion = true
+	migrator := newMigrator(options)
+	plan, err := migrator.PlanCleanup()
+	if err != nil {
+		exit(exitCode(err), err, "Error checking items to clean up")
+	}
+
+	if err := plan.PrintSummary(os.Stdout); err != nil {
+		exit(exitFailure, err, "Error printing summary")
+	}
+
+	if plan.DeleteCount() == 0 {
+		fmt.Fprintln(os.Stdout, "Nothing to delete")
+		return
+	}
+
+	if !yes && !confirm(fmt.Sprintf("Delete %d item(s) from %s?", plan.DeleteCount(), options.OldGroupVersion)) {
+		fmt.Fprintln(os.Stdout, "Aborted")
+		return
+	}
+
+	stopOnSignal(migrator)
+	if err := migrator.Cleanup(plan, stripFinalizers); err != nil {
+		exit(exitCode(err), err, "Error cleaning up")
+	}
+}
+
+func runVerify(options internal.Options, flags *pflag.FlagSet, args []string) {
+	addConfigFlag(flags, &options, args)
+	addClientFlags(flags, &options)
+	addMigrationFlags(flags, &options)
+	addSelectionFlags(flags, &options)
+	parseFlags(flags, args)
+	requireOneGroupVersion(options)
+
+	options.OneVersion = true
+	report, err := newMigrator(options).Verify()
+	if err != nil {
+		exit(exitCode(err), err, "Error verifying migration")
+	}
+
+	if err := report.PrintSummary(os.Stdout); err != nil {
+		exit(exitFailure, err, "Error printing summary")
+	}
+
+	if count := report.MismatchCount(); count > 0 {
+		exit(exitFailure, nil, fmt.Sprintf("%d item(s) are missing, different or extra in the new groupVersion", count))
+	}
+}
+
+func runRollback(options internal.Options, flags *pflag.FlagSet, args []string) {
+	var runID string
+	addClientFlags(flags, &options)
+	flags.StringVar(&options.JournalDir, "journal-dir", options.JournalDir, "directory the run journals are in")
+	flags.StringVar(&runID, "run", runID, "ID of the migration run to roll back")
+	parseFlags(flags, args)
+
+	if runID == "" {
+		exit(exitPreflight, nil, "--run is required")
+	}
+
+	migrator := newMigrator(options)
+	stopOnSignal(migrator)
+	if err := migrator.Rollback(runID); err != nil {
+		exit(exitCode(err), err, "Error rolling back")
+	}
+}
+
+// confirm asks a yes/no question on stdout and reads the answer from
+// stdin. Anything other than y or yes is a no.
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stdout, "%s [y/N] ", question)
+
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
+
+// stopOnSignal stops the migrator on SIGINT or SIGTERM, letting in-flight
+// items complete. A second signal exits immediately.
+func stopOnSignal(migrator *internal.Migrator) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		logrus.WithField("signal", sig).Warn("Stopping once in-flight items complete, signal again to exit immediately")
+		migrator.Stop()
+
+		<-signals
+		os.Exit(exitInterrupted)
+	}()
+}
+
+// newMigrator returns a migrator for options, or exits if they are
+// invalid.
+func newMigrator(options internal.Options) *internal.Migrator {
+	migrator, err := internal.NewMigrator(options)
+	if err != nil {
+		exit(exitPreflight, err, "Error configuring migration")
+	}
+	return migrator
+}
+
+// exit logs message, with err if it's set, and exits with code.
+func exit(code int, err error, message string) {
+	log := logrus.NewEntry(logrus.StandardLogger())
+	if err != nil {
+		log = log.WithError(err)
+	}
+	log.Error(message)
+	os.Exit(code)
+}
+
+// exitCode returns the exit code for an error returned by a command.
+func exitCode(err error) int {
+	switch {
+	case errors.Cause(err) == internal.ErrInterrupted:
+		return exitInterrupted
+	case internal.IsPreflightError(err):
+		return exitPreflight
+	default:
+		return exitFailure
+	}
+}
+
+func parseFlags(flags *pflag.FlagSet, args []string) {
+	// errors are handled by pflag.ExitOnError
+	_ = flags.Parse(args)
+}
+
+// addConfigFlag adds --config and applies the config file it names in
+// args, if any, to options. It has to be called before the flags the
+// config file covers are added, so that the settings of the file become
+// their defaults and flags given on the command line override them.
+func addConfigFlag(flags *pflag.FlagSet, options *internal.Options, args []string) {
+	var filename string
+	flags.StringVar(&filename, "config", filename, "path of a migration config file, whose settings are overridden by flags")
+
+	// the flags haven't been parsed yet
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if arg == "--config" && i+1 < len(args) {
+			filename = args[i+1]
+		} else if strings.HasPrefix(arg, "--config=") {
+			filename = strings.TrimPrefix(arg, "--config=")
+		}
+	}
+	if filename == "" {
+		return
+	}
+
+	config, err := internal.LoadConfig(filename)
+	if err != nil {
+		exit(exitPreflight, err, "Error loading config")
+	}
+	*options = config.Apply(*options)
+}
+
+// requireOneGroupVersion exits if a config file sets groupVersions for a
+// command that works with one group/version at a time.
+func requireOneGroupVersion(options internal.Options) {
+	if len(options.GroupVersionMappings) > 0 {
+		exit(exitPreflight, nil, "groupVersions in the config file are only supported by migrate")
+	}
+}
+
+// addClientFlags adds the flags shared by all commands that connect to a
+// cluster.
+func addClientFlags(flags *pflag.FlagSet, options *internal.Options) {
+	flags.StringVar(&options.LogLevel, "log-level", options.LogLevel, "log level")
+	flags.StringVar(&options.Kubeconfig, "kubeconfig", options.Kubeconfig, "path to kubeconfig file")
+	flags.StringVar(&options.Context, "context", options.Context, "specific context to use in the kubeconfig file")
+	flags.StringVar(&options.SourceKubeconfig, "source-kubeconfig", options.SourceKubeconfig, "path to kubeconfig file for the cluster to read items from (defaults to --kubeconfig)")
+	flags.StringVar(&options.SourceContext, "source-context", options.SourceContext, "context to use for the cluster to read items from (defaults to --context)")
+	flags.StringVar(&options.DestKubeconfig, "dest-kubeconfig", options.DestKubeconfig, "path to kubeconfig file for the cluster to create items in (defaults to --kubeconfig)")
+	flags.StringVar(&options.DestContext, "dest-context", options.DestContext, "context to use for the cluster to create items in (defaults to --context)")
+	flags.Float32Var(&options.QPS, "qps", options.QPS, "client requests per second")
+	flags.IntVar(&options.Burst, "burst", options.Burst, "client burst")
+	flags.Int64Var(&options.PageSize, "page-size", options.PageSize, "maximum number of items to request per list call (0 lists all items at once)")
+}
+
+// addJournalFlags adds the flags of commands that create items.
+func addJournalFlags(flags *pflag.FlagSet, options *internal.Options) {
+	flags.StringVar(&options.JournalDir, "journal-dir", options.JournalDir, "directory to record created items in, so that they can be deleted with rollback, and the bases of --on-conflict=merge (empty disables recording)")
+}
+
+// addMigrationFlags adds the flags that describe what to migrate and how.
+func addMigrationFlags(flags *pflag.FlagSet, options *internal.Options) {
+	flags.StringVar(&options.OldGroupVersion, "from", options.OldGroupVersion, "the old groupVersion, or a group to migrate the resources of all its versions")
+	flags.StringVar(&options.NewGroupVersion, "to", options.NewGroupVersion, "the new groupVersion, or a group if --from is one")
+	addMappingFlags(flags, options)
+}
+
+// addSelectionFlags adds the flags that select which resources and items
+// of the old group/version are migrated.
+func addSelectionFlags(flags *pflag.FlagSet, options *internal.Options) {
+	flags.StringSliceVar(&options.Resources, "resources", options.Resources, "only migrate resources matching these glob patterns (e.g. foos,bar*)")
+	flags.StringSliceVar(&options.ExcludeResources, "exclude-resources", options.ExcludeResources, "don't migrate resources matching these glob patterns")
+	flags.StringVarP(&options.Selector, "selector", "l", options.Selector, "only migrate items matching this label selector")
+	flags.StringVar(&options.FieldSelector, "field-selector", options.FieldSelector, "only migrate items matching this field selector")
+	flags.StringSliceVar(&options.Namespaces, "namespaces", options.Namespaces, "only migrate namespaced items in these namespaces")
+	flags.StringSliceVar(&options.ExcludeNamespaces, "exclude-namespaces", options.ExcludeNamespaces, "don't migrate items in these namespaces")
+	flags.StringVar(&options.OptOutAnnotation, "opt-out-annotation", options.OptOutAnnotation, "don't migrate items that have this annotation set to \"true\" (empty disables opting out)")
+}
+
+// addMappingFlags adds the flags that describe how items are changed when
+// they are migrated.
+func addMappingFlags(flags *pflag.FlagSet, options *internal.Options) {
+	flags.StringSliceVar(&options.NamespaceMappings, "namespace-mappings", options.NamespaceMappings, "specify from:to changes for item namespaces")
+	flags.StringSliceVar(&options.LabelMappings, "label-mappings", options.LabelMappings, "specify from:to changes for label keys (e.g. example.com:example.io changes all label key occurrences of example.com to example.io)")
+	flags.StringSliceVar(&options.AnnotationMappings, "annotation-mappings", options.AnnotationMappings, "specify from:to changes for annotations keys (e.g. example.com:example.io changes all label key occurrences of example.com to example.io)")
+	flags.StringSliceVar(&options.UpdateOwnerRefMappings, "update-owner-refs", options.UpdateOwnerRefMappings, "specify parent:child ownerRef relationships that need to be updated (e.g. parent:child updates all child resources' ownerRefs to point to the new parent resources)")
 }
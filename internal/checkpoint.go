@@ -0,0 +1,241 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const checkpointVersion = "v1"
+
+// checkpoint records the progress of a migration so that it can be
+// resumed after it was interrupted. A nil *checkpoint records nothing.
+// It is safe for concurrent use.
+type checkpoint struct {
+	mu   sync.Mutex
+	path string
+
+	Version         string                         `json:"version"`
+	OldGroupVersion string                         `json:"oldGroupVersion"`
+	NewGroupVersion string                         `json:"newGroupVersion"`
+	Resources       map[string]*resourceCheckpoint `json:"resources"`
+	// TrackedItems are the UIDs of the migrated ownerRef parents, by kind
+	// and name, so that children can still be updated after resuming. Kinds
+	// are qualified with their new group/version as kind.version.group.
+	TrackedItems map[string]map[string]types.UID `json:"trackedItems,omitempty"`
+}
+
+type resourceCheckpoint struct {
+	Completed bool `json:"completed,omitempty"`
+	// Continue is the list continue token to resume listing from. All
+	// items listed before it have been processed.
+	Continue string `json:"continue,omitempty"`
+	// CompletedItems are the items listed at or after Continue that have
+	// been migrated.
+	CompletedItems []string `json:"completedItems,omitempty"`
+
+	completedItems stringSet
+	// failed is set if an item listed at or after Continue failed, which
+	// keeps Continue from moving past it.
+	failed bool
+}
+
+func newCheckpoint(path, oldGroupVersion, newGroupVersion string) *checkpoint {
+	return &checkpoint{
+		path:            path,
+		Version:         checkpointVersion,
+		OldGroupVersion: oldGroupVersion,
+		NewGroupVersion: newGroupVersion,
+		Resources:       make(map[string]*resourceCheckpoint),
+	}
+}
+
+// loadCheckpoint reads the checkpoint at path, which must have been
+// written by a migration between the same group versions.
+func loadCheckpoint(path, oldGroupVersion, newGroupVersion string) (*checkpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	c := newCheckpoint(path, oldGroupVersion, newGroupVersion)
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, errors.Wrapf(err, "error parsing checkpoint file %s", path)
+	}
+
+	if c.Version != checkpointVersion {
+		return nil, errors.Errorf("unsupported checkpoint version %q in %s, expected %q", c.Version, path, checkpointVersion)
+	}
+	if c.OldGroupVersion != oldGroupVersion || c.NewGroupVersion != newGroupVersion {
+		return nil, errors.Errorf("checkpoint %s is for %s -> %s, not %s -> %s",
+			path, c.OldGroupVersion, c.NewGroupVersion, oldGroupVersion, newGroupVersion)
+	}
+
+	if c.Resources == nil {
+		c.Resources = make(map[string]*resourceCheckpoint)
+	}
+	for _, rc := range c.Resources {
+		rc.completedItems = make(stringSet)
+		for _, id := range rc.CompletedItems {
+			rc.completedItems.add(id)
+		}
+	}
+
+	return c, nil
+}
+
+// save writes the checkpoint, along with the items tracked by tracker,
+// to a temporary file and renames it over the checkpoint file so that the
+// checkpoint is never left half-written.
+func (c *checkpoint) save(tracker *createdItemsTracker) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.TrackedItems = tracker.trackedItems()
+
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.WithStack(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(os.Rename(tmp.Name(), c.path))
+}
+
+// resource returns the checkpoint of a resource. c.mu must be held.
+func (c *checkpoint) resource(name string) *resourceCheckpoint {
+	rc, ok := c.Resources[name]
+	if !ok {
+		rc = &resourceCheckpoint{completedItems: make(stringSet)}
+		c.Resources[name] = rc
+	}
+	return rc
+}
+
+func (c *checkpoint) isResourceCompleted(name string) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rc, ok := c.Resources[name]
+	return ok && rc.Completed
+}
+
+func (c *checkpoint) continueToken(name string) string {
+	if c == nil {
+		return ""
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if rc, ok := c.Resources[name]; ok {
+		return rc.Continue
+	}
+	return ""
+}
+
+// restartResource forgets the continue token of a resource, e.g. because
+// it has expired, so that listing starts over from the beginning.
+func (c *checkpoint) restartResource(name string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rc := c.resource(name)
+	rc.Continue = ""
+}
+
+func (c *checkpoint) isItemCompleted(name, id string) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rc, ok := c.Resources[name]
+	return ok && rc.completedItems.has(id)
+}
+
+func (c *checkpoint) completeItem(name, id string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rc := c.resource(name)
+	if !rc.completedItems.has(id) {
+		rc.completedItems.add(id)
+		rc.CompletedItems = append(rc.CompletedItems, id)
+	}
+}
+
+func (c *checkpoint) failItem(name string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.resource(name).failed = true
+}
+
+// completePage records that all items of a page have been processed.
+// next is the continue token of the following page, or empty if this was
+// the last page.
+func (c *checkpoint) completePage(name, next string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rc := c.resource(name)
+	if rc.failed {
+		// keep resuming from the page with the failed item so that it's retried
+		return
+	}
+
+	if next == "" {
+		rc.Completed = true
+	}
+	rc.Continue = next
+	rc.CompletedItems = nil
+	rc.completedItems = make(stringSet)
+}
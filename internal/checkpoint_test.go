@@ -0,0 +1,126 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "checkpoint.json")
+
+	tracker := newCreatedItemsTracker(discardLogger(), "old/v1", "new/v1")
+	tracker.registerResource("new/v1", metav1.APIResource{Name: "bars", Kind: "Bar"})
+	tracker.registerCreatedItem(objectBuilder("new/v1", "Bar", "bar-1").UID("uid-1").Build())
+
+	c := newCheckpoint(path, "old/v1", "new/v1")
+	c.completeItem("bars", "ns/bar-1")
+	c.completePage("bars", "")
+	c.completeItem("foos", "ns/foo-1")
+	c.completePage("foos", "next-page")
+	c.completeItem("foos", "ns/foo-2")
+	require.NoError(t, c.save(tracker))
+
+	loaded, err := loadCheckpoint(path, "old/v1", "new/v1")
+	require.NoError(t, err)
+
+	assert.True(t, loaded.isResourceCompleted("bars"))
+	assert.False(t, loaded.isResourceCompleted("foos"))
+	assert.Equal(t, "next-page", loaded.continueToken("foos"))
+	assert.False(t, loaded.isItemCompleted("foos", "ns/foo-1"))
+	assert.True(t, loaded.isItemCompleted("foos", "ns/foo-2"))
+	assert.Equal(t, map[string]map[string]types.UID{"Bar.v1.new": {"bar-1": "uid-1"}}, loaded.TrackedItems)
+
+	_, err = loadCheckpoint(path, "old/v1", "other/v1")
+	assert.Error(t, err)
+}
+
+func TestCheckpointFailedItemKeepsPage(t *testing.T) {
+	c := newCheckpoint("", "old/v1", "new/v1")
+
+	c.completeItem("foos", "foo-1")
+	c.failItem("foos")
+	c.completePage("foos", "next-page")
+	c.completePage("foos", "")
+
+	assert.False(t, c.isResourceCompleted("foos"))
+	assert.Empty(t, c.continueToken("foos"))
+	assert.True(t, c.isItemCompleted("foos", "foo-1"))
+}
+
+func TestMigrateResumesFromCheckpoint(t *testing.T) {
+	oldGV := schema.GroupVersion{Group: "old", Version: "v1"}
+	newGV := schema.GroupVersion{Group: "new", Version: "v1"}
+
+	dir, err := ioutil.TempDir("", "checkpoint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	h := newHarness(t, oldGV, newGV, nil, nil, nil, map[string]string{"bar": "foo"})
+
+	h.RegisterCRD(oldGV.WithResource("bar"))
+	h.AddResources(oldGV.WithResource("bar"), objectBuilder("old/v1", "Bar", "obj-1").Build())
+	h.RegisterCRD(oldGV.WithResource("foo"))
+	h.AddResources(oldGV.WithResource("foo"),
+		objectBuilder("old/v1", "Foo", "obj-1").OwnerRef("old/v1", "Bar", "obj-1").Build(),
+		objectBuilder("old/v1", "Foo", "obj-2").Build(),
+	)
+	h.RegisterCRD(newGV.WithResource("bar"))
+	h.RegisterCRD(newGV.WithResource("foo"))
+
+	// bar was completed and foo/obj-2 was migrated by an earlier run
+	c := newCheckpoint(filepath.Join(dir, "checkpoint.json"), oldGV.String(), newGV.String())
+	c.completePage("bar", "")
+	c.completeItem("foo", "obj-2")
+	h.migrator.checkpoint = c
+	h.migrator.createdItemsTracker.restoreTrackedItems(newGV.String(), map[string]map[string]types.UID{"Bar": {"obj-1": "bar-uid"}})
+
+	h.migrator.MigrateAllResources()
+
+	bars, err := h.dynamicClient.Resource(newGV.WithResource("bar")).List(metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, bars.Items)
+
+	foos, err := h.dynamicClient.Resource(newGV.WithResource("foo")).List(metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, foos.Items, 1)
+	assert.Equal(t, "obj-1", foos.Items[0].GetName())
+	require.Len(t, foos.Items[0].GetOwnerReferences(), 1)
+	assert.Equal(t, types.UID("bar-uid"), foos.Items[0].GetOwnerReferences()[0].UID)
+
+	loaded, err := loadCheckpoint(c.path, oldGV.String(), newGV.String())
+	require.NoError(t, err)
+	assert.True(t, loaded.isResourceCompleted("foo"))
+}
+
+func TestMigrateStopped(t *testing.T) {
+	oldGV := schema.GroupVersion{Group: "old", Version: "v1"}
+	newGV := schema.GroupVersion{Group: "new", Version: "v1"}
+
+	h := newHarness(t, oldGV, newGV, nil, nil, nil, nil)
+	h.RegisterCRD(oldGV.WithResource("foo"))
+	h.AddResources(oldGV.WithResource("foo"), objectBuilder("old/v1", "Foo", "obj-1").Build())
+	h.RegisterCRD(newGV.WithResource("foo"))
+
+	h.migrator.stop = make(chan struct{})
+	h.migrator.Stop()
+	h.migrator.MigrateAllResources()
+
+	foos, err := h.dynamicClient.Resource(newGV.WithResource("foo")).List(metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, foos.Items)
+}
@@ -0,0 +1,228 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+)
+
+// CleanupPlan is the result of checking every item in the old
+// group/version for a counterpart in the new group/version. It is
+// produced by Migrator.PlanCleanup and executed by Migrator.Cleanup.
+type CleanupPlan struct {
+	// Resources are listed in the order they will be cleaned up.
+	Resources []*CleanupResource
+}
+
+// CleanupResource sorts the items of a resource by whether they will be
+// deleted.
+type CleanupResource struct {
+	Name string
+	// Delete are the items that have a verified counterpart and will be
+	// deleted.
+	Delete []string
+	// Missing are the items that have no counterpart and will be kept.
+	Missing []string
+	// Different are the items whose counterpart has different contents and
+	// will be kept.
+	Different []string
+	// Finalizers are the items that will be deleted and have finalizers.
+	Finalizers []string
+
+	resource metav1.APIResource
+	items    []unstructured.Unstructured
+}
+
+// DeleteCount returns the number of items that will be deleted.
+func (p *CleanupPlan) DeleteCount() int {
+	count := 0
+	for _, resource := range p.Resources {
+		count += len(resource.Delete)
+	}
+	return count
+}
+
+// PrintSummary writes a table of what will be deleted and kept per
+// resource to out.
+func (p *CleanupPlan) PrintSummary(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "RESOURCE\tDELETE\tWITH FINALIZERS\tKEEP (MISSING)\tKEEP (DIFFERENT)")
+	for _, resource := range p.Resources {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n",
+			resource.Name, len(resource.Delete), len(resource.Finalizers), len(resource.Missing), len(resource.Different))
+	}
+	return errors.WithStack(w.Flush())
+}
+
+// PlanCleanup lists every item in the old group/version and checks that
+// it has been migrated, i.e. that its counterpart in the new group/version
+// is what migrating it would create, like Verify does. Nothing is
+// deleted.
+func (m *Migrator) PlanCleanup() (*CleanupPlan, error) {
+	if err := m.checkDestination(); err != nil {
+		return nil, err
+	}
+
+	resources, _, err := m.discoverResources()
+	if err != nil {
+		return nil, err
+	}
+
+	plan := new(CleanupPlan)
+
+	// parents are checked first, so that the expected ownerRefs of their
+	// children point to their counterparts, but children are deleted
+	// before their parents
+	for _, resource := range resources {
+		log := m.log.WithField("resource", resource.Name)
+		log.Info("Checking items for counterparts in new API group")
+
+		compared, err := m.compareItems(log, resource)
+		if err != nil {
+			return nil, err
+		}
+
+		cleanup := &CleanupResource{
+			Name:      resource.Name,
+			Missing:   compared.missing,
+			Different: compared.different,
+			resource:  resource,
+			items:     compared.matching,
+		}
+		for i := range compared.matching {
+			item := &compared.matching[i]
+			id := itemID(item.GetNamespace(), item.GetName())
+			cleanup.Delete = append(cleanup.Delete, id)
+			if len(item.GetFinalizers()) > 0 {
+				cleanup.Finalizers = append(cleanup.Finalizers, id)
+			}
+		}
+
+		plan.Resources = append([]*CleanupResource{cleanup}, plan.Resources...)
+	}
+
+	return plan, nil
+}
+
+// Cleanup deletes the items in plan that have a verified counterpart.
+// Items are deleted with the orphan propagation policy, so that the
+// garbage collector doesn't delete children that are kept. The finalizers
+// in stripFinalizers, whose controllers are no longer running, are
+// removed from each item before it is deleted. Items with other
+// finalizers remain until whatever added the finalizers removes them.
+// Items that can't be deleted don't stop the cleanup; they are logged,
+// and returned together in a *PartialFailureError.
+func (m *Migrator) Cleanup(plan *CleanupPlan, stripFinalizers []string) error {
+	orphan := metav1.DeletePropagationOrphan
+	var errs []error
+
+	strip := make(stringSet)
+	for _, finalizer := range stripFinalizers {
+		strip.add(finalizer)
+	}
+
+	for _, cleanup := range plan.Resources {
+		log := m.log.WithField("resource", cleanup.Name)
+		log.Info("Starting resource cleanup")
+
+		oldGVR := m.oldGroupVersion.WithResource(cleanup.resource.Name)
+		deleted := 0
+		for i := range cleanup.items {
+			if m.stopped() {
+				return ErrInterrupted
+			}
+
+			item := &cleanup.items[i]
+			client := clientForItem(m.sourceDynamicClient.Resource(oldGVR), item.GetNamespace())
+			id := itemID(item.GetNamespace(), item.GetName())
+			itemLog := log.WithField("id", id)
+
+			if stripped, kept := splitFinalizers(item.GetFinalizers(), strip); len(stripped) > 0 {
+				itemLog.WithField("finalizers", stripped).Info("Removing finalizers")
+				if err := removeFinalizers(client, item, kept); err != nil {
+					itemLog.WithError(err).Error("Unable to remove finalizers")
+					errs = append(errs, errors.Wrapf(err, "%s %s: error removing finalizers", cleanup.Name, id))
+					continue
+				}
+				item.SetFinalizers(kept)
+			}
+
+			itemLog.Info("Deleting item")
+			uid := item.GetUID()
+			err := client.Delete(item.GetName(), &metav1.DeleteOptions{
+				// never delete an item that was recreated since it was checked
+				Preconditions:     &metav1.Preconditions{UID: &uid},
+				PropagationPolicy: &orphan,
+			})
+			if err != nil && !apierrors.IsNotFound(err) {
+				itemLog.WithError(err).Error("Unable to delete item")
+				errs = append(errs, errors.Wrapf(err, "%s %s: error deleting item", cleanup.Name, id))
+				continue
+			}
+			deleted++
+
+			if len(item.GetFinalizers()) > 0 {
+				itemLog.WithField("finalizers", item.GetFinalizers()).Warn("Item has finalizers and is only removed once they are")
+			}
+		}
+
+		log.WithField("count", deleted).Info("Completed resource cleanup")
+	}
+
+	if len(errs) > 0 {
+		return &PartialFailureError{Errors: errs}
+	}
+
+	return nil
+}
+
+// splitFinalizers splits finalizers into those in strip and the others.
+func splitFinalizers(finalizers []string, strip stringSet) ([]string, []string) {
+	var stripped, kept []string
+	for _, finalizer := range finalizers {
+		if strip.has(finalizer) {
+			stripped = append(stripped, finalizer)
+		} else {
+			kept = append(kept, finalizer)
+		}
+	}
+	return stripped, kept
+}
+
+// removeFinalizers sets the finalizers of item to kept. The patch fails if
+// item changed since it was listed, so that finalizers added since then,
+// e.g. by a controller that is still running, are never removed.
+func removeFinalizers(client dynamic.ResourceInterface, item *unstructured.Unstructured, kept []string) error {
+	type operation struct {
+		Op    string      `json:"op"`
+		Path  string      `json:"path"`
+		Value interface{} `json:"value"`
+	}
+	if kept == nil {
+		kept = []string{}
+	}
+	var patch []operation
+	if resourceVersion := item.GetResourceVersion(); resourceVersion != "" {
+		patch = append(patch, operation{Op: "test", Path: "/metadata/resourceVersion", Value: resourceVersion})
+	}
+	patch = append(patch, operation{Op: "replace", Path: "/metadata/finalizers", Value: kept})
+
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = client.Patch(item.GetName(), types.JSONPatchType, data, metav1.UpdateOptions{})
+	return errors.WithStack(err)
+}
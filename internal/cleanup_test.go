@@ -0,0 +1,113 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestCleanup(t *testing.T) {
+	oldGV := schema.GroupVersion{Group: "old", Version: "v1"}
+	newGV := schema.GroupVersion{Group: "new", Version: "v1"}
+
+	withSpec := func(obj *unstructured.Unstructured, replicas int64) *unstructured.Unstructured {
+		require.NoError(t, unstructured.SetNestedField(obj.Object, replicas, "spec", "replicas"))
+		return obj
+	}
+
+	h := newHarness(t, oldGV, newGV, map[string]string{"ns-1": "ns-2"}, nil, nil, nil)
+	h.RegisterCRD(oldGV.WithResource("foo"))
+	h.AddResources(oldGV.WithResource("foo"),
+		withSpec(objectBuilder("old/v1", "Foo", "migrated").Namespace("ns-1").Build(), 1),
+		withSpec(objectBuilder("old/v1", "Foo", "missing").Namespace("ns-1").Build(), 1),
+		withSpec(objectBuilder("old/v1", "Foo", "different").Namespace("ns-1").Build(), 1),
+		withSpec(objectBuilder("old/v1", "Foo", "relabeled").Namespace("ns-1").Build(), 1),
+		withSpec(objectBuilder("old/v1", "Foo", "finalized").Namespace("ns-1").ResourceVersion("5").Build(), 1),
+		withSpec(objectBuilder("old/v1", "Foo", "changed").Namespace("ns-1").ResourceVersion("7").Build(), 1),
+	)
+	oldClient := h.dynamicClient.Resource(oldGV.WithResource("foo")).Namespace("ns-1")
+	for _, name := range []string{"finalized", "changed"} {
+		item, err := oldClient.Get(name, metav1.GetOptions{})
+		require.NoError(t, err)
+		item.SetFinalizers([]string{"example.com/finalizer", "example.com/live"})
+		_, err = oldClient.Update(item, metav1.UpdateOptions{})
+		require.NoError(t, err)
+	}
+
+	h.RegisterCRD(newGV.WithResource("foo"))
+	h.AddResources(newGV.WithResource("foo"),
+		withSpec(objectBuilder("new/v1", "Foo", "migrated").Namespace("ns-2").Build(), 1),
+		withSpec(objectBuilder("new/v1", "Foo", "different").Namespace("ns-2").Build(), 2),
+		withSpec(objectBuilder("new/v1", "Foo", "relabeled").Namespace("ns-2").Labels(map[string]string{"a": "b"}).Build(), 1),
+		withSpec(objectBuilder("new/v1", "Foo", "finalized").Namespace("ns-2").Build(), 1),
+		withSpec(objectBuilder("new/v1", "Foo", "changed").Namespace("ns-2").Build(), 1),
+	)
+
+	plan, err := h.migrator.PlanCleanup()
+	require.NoError(t, err)
+	require.Len(t, plan.Resources, 1)
+	assert.ElementsMatch(t, []string{"ns-1/migrated", "ns-1/finalized", "ns-1/changed"}, plan.Resources[0].Delete)
+	assert.Equal(t, []string{"ns-1/missing"}, plan.Resources[0].Missing)
+	assert.ElementsMatch(t, []string{"ns-1/different", "ns-1/relabeled"}, plan.Resources[0].Different)
+	assert.ElementsMatch(t, []string{"ns-1/finalized", "ns-1/changed"}, plan.Resources[0].Finalizers)
+	assert.Equal(t, 3, plan.DeleteCount())
+
+	summary := new(bytes.Buffer)
+	require.NoError(t, plan.PrintSummary(summary))
+	assert.Equal(t, `RESOURCE  DELETE  WITH FINALIZERS  KEEP (MISSING)  KEEP (DIFFERENT)
+foo       3       2                1               2
+`, summary.String())
+
+	// changed since it was checked, so its finalizers are kept
+	changed, err := oldClient.Get("changed", metav1.GetOptions{})
+	require.NoError(t, err)
+	changed.SetResourceVersion("8")
+	_, err = oldClient.Update(changed, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	err = h.migrator.Cleanup(plan, []string{"example.com/finalizer"})
+	require.IsType(t, &PartialFailureError{}, err)
+	assert.Len(t, err.(*PartialFailureError).Errors, 1)
+
+	// only the finalizer whose controller is gone was removed, and only if
+	// the item didn't change
+	var patches [][]map[string]interface{}
+	for _, action := range h.dynamicClient.Actions() {
+		if patch, ok := action.(k8stesting.PatchAction); ok && patch.GetName() == "finalized" {
+			var decoded []map[string]interface{}
+			require.NoError(t, json.Unmarshal(patch.GetPatch(), &decoded))
+			patches = append(patches, decoded)
+		}
+	}
+	require.Len(t, patches, 1)
+	assert.Equal(t, []map[string]interface{}{
+		{"op": "test", "path": "/metadata/resourceVersion", "value": "5"},
+		{"op": "replace", "path": "/metadata/finalizers", "value": []interface{}{"example.com/live"}},
+	}, patches[0])
+
+	remaining, err := h.dynamicClient.Resource(oldGV.WithResource("foo")).List(metav1.ListOptions{})
+	require.NoError(t, err)
+	var names []string
+	for _, item := range remaining.Items {
+		names = append(names, item.GetName())
+		if item.GetName() == "changed" {
+			assert.Equal(t, []string{"example.com/finalizer", "example.com/live"}, item.GetFinalizers())
+		}
+	}
+	assert.ElementsMatch(t, []string{"missing", "different", "relabeled", "changed"}, names)
+
+	// nothing in the new API group was touched
+	migrated, err := h.dynamicClient.Resource(newGV.WithResource("foo")).List(metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Len(t, migrated.Items, 5)
+}
@@ -0,0 +1,387 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	configAPIVersion = "crd-migrator.vmware.com/v1alpha1"
+	configKind       = "MigrationConfig"
+)
+
+// Config is a migration defined in a file, so that it can be reviewed and
+// versioned like any other manifest. It covers what is migrated and how;
+// the clusters and how the run is recorded are still set with flags.
+type Config struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+	// GroupVersions are more group/versions migrated in the same run as
+	// From and To, like --group-versions.
+	GroupVersions []ConfigGroupVersion `json:"groupVersions"`
+
+	Resources ConfigResources `json:"resources"`
+	Items     ConfigItems     `json:"items"`
+	// OwnerRefs are the parent/child relationships whose ownerRefs are
+	// updated, like --update-owner-refs.
+	OwnerRefs []ConfigOwnerRef `json:"ownerRefs"`
+	Mappings  ConfigMappings   `json:"mappings"`
+	// Transforms change the items of some resources as they are migrated,
+	// beyond what the mappings do.
+	Transforms []ConfigTransform `json:"transforms"`
+	CRDs       ConfigCRDs        `json:"crds"`
+
+	OnConflict string `json:"onConflict"`
+	Workers    int    `json:"workers"`
+	PageSize   *int64 `json:"pageSize"`
+}
+
+// ConfigGroupVersion is an old group/version and the new one it's migrated
+// to.
+type ConfigGroupVersion struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// ConfigResources select the resources that are migrated.
+type ConfigResources struct {
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+	// Settings override options for some of the resources.
+	Settings []ConfigResourceSettings `json:"settings"`
+}
+
+// ConfigResourceSettings override options for the resources matching
+// Name, which is a glob pattern. The first matching settings apply.
+type ConfigResourceSettings struct {
+	Name       string `json:"name"`
+	OnConflict string `json:"onConflict"`
+}
+
+// ConfigItems select the items of the selected resources that are
+// migrated.
+type ConfigItems struct {
+	Selector          string   `json:"selector"`
+	FieldSelector     string   `json:"fieldSelector"`
+	Namespaces        []string `json:"namespaces"`
+	ExcludeNamespaces []string `json:"excludeNamespaces"`
+	// OptOutAnnotation is a pointer so that it can be set to "" to disable
+	// opting out.
+	OptOutAnnotation *string `json:"optOutAnnotation"`
+}
+
+// ConfigOwnerRef is a parent/child relationship between two resources.
+type ConfigOwnerRef struct {
+	Parent string `json:"parent"`
+	Child  string `json:"child"`
+}
+
+// ConfigMappings change items as they are migrated. Each maps from the old
+// value to the new one.
+type ConfigMappings struct {
+	Namespaces  map[string]string `json:"namespaces"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	// Versions map the versions of From to those of To, when they are
+	// groups without a version, like --version-mappings.
+	Versions map[string]string `json:"versions"`
+}
+
+// ConfigTransform is a JSON patch (RFC 6902) applied to the items of the
+// resources matching Resources, a glob pattern, once they have been
+// mapped. Transforms are applied in order, and can't change the name or
+// namespace of an item.
+type ConfigTransform struct {
+	Resources string          `json:"resources"`
+	Patch     json.RawMessage `json:"patch"`
+}
+
+// ConfigCRDs control the migration of the CRDs themselves.
+type ConfigCRDs struct {
+	Migrate    bool              `json:"migrate"`
+	ShortNames map[string]string `json:"shortNames"`
+	Categories map[string]string `json:"categories"`
+}
+
+// LoadConfig reads and validates a config file. Errors name the line, the
+// unknown field, or the path of the field they were found at.
+func LoadConfig(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	config, err := parseConfig(data)
+	return config, errors.Wrapf(err, "invalid config file %s", filename)
+}
+
+func parseConfig(data []byte) (*Config, error) {
+	config := new(Config)
+	// unknown and duplicate fields are errors, so that typos aren't ignored
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		message := err.Error()
+		for _, prefix := range []string{"error converting YAML to JSON: ", "error unmarshaling JSON: ", "while decoding JSON: ", "yaml: ", "json: "} {
+			message = strings.TrimPrefix(message, prefix)
+		}
+		return nil, errors.New(message)
+	}
+
+	if errs := config.validate(); len(errs) > 0 {
+		messages := make([]string, 0, len(errs))
+		for _, err := range errs {
+			messages = append(messages, err.Error())
+		}
+		return nil, errors.Errorf("%d error(s):\n  %s", len(errs), strings.Join(messages, "\n  "))
+	}
+
+	return config, nil
+}
+
+// validate checks every field of c and returns all errors, with the path
+// of the field each was found at.
+func (c *Config) validate() field.ErrorList {
+	var errs field.ErrorList
+
+	if c.APIVersion != configAPIVersion {
+		errs = append(errs, field.NotSupported(field.NewPath("apiVersion"), c.APIVersion, []string{configAPIVersion}))
+	}
+	if c.Kind != configKind {
+		errs = append(errs, field.NotSupported(field.NewPath("kind"), c.Kind, []string{configKind}))
+	}
+
+	errs = append(errs, validateConfigGroupVersion(field.NewPath("from"), c.From)...)
+	errs = append(errs, validateConfigGroupVersion(field.NewPath("to"), c.To)...)
+	for i, groupVersion := range c.GroupVersions {
+		groupVersionPath := field.NewPath("groupVersions").Index(i)
+		errs = append(errs, validateConfigGroupVersion(groupVersionPath.Child("from"), groupVersion.From)...)
+		errs = append(errs, validateConfigGroupVersion(groupVersionPath.Child("to"), groupVersion.To)...)
+	}
+
+	resourcesPath := field.NewPath("resources")
+	errs = append(errs, validateConfigPatterns(resourcesPath.Child("include"), c.Resources.Include)...)
+	errs = append(errs, validateConfigPatterns(resourcesPath.Child("exclude"), c.Resources.Exclude)...)
+	for i, settings := range c.Resources.Settings {
+		settingsPath := resourcesPath.Child("settings").Index(i)
+		if _, err := path.Match(settings.Name, ""); settings.Name == "" || err != nil {
+			errs = append(errs, field.Invalid(settingsPath.Child("name"), settings.Name, "must be a resource name or glob pattern"))
+		}
+		errs = append(errs, validateConflictStrategy(settingsPath.Child("onConflict"), settings.OnConflict)...)
+	}
+
+	itemsPath := field.NewPath("items")
+	if _, err := labels.Parse(c.Items.Selector); err != nil {
+		errs = append(errs, field.Invalid(itemsPath.Child("selector"), c.Items.Selector, err.Error()))
+	}
+	if _, err := fields.ParseSelector(c.Items.FieldSelector); err != nil {
+		errs = append(errs, field.Invalid(itemsPath.Child("fieldSelector"), c.Items.FieldSelector, err.Error()))
+	}
+
+	ownerRefsPath := field.NewPath("ownerRefs")
+	children := make(map[string]string)
+	for i, ownerRef := range c.OwnerRefs {
+		ownerRefPath := ownerRefsPath.Index(i)
+		if ownerRef.Parent == "" {
+			errs = append(errs, field.Required(ownerRefPath.Child("parent"), "must be a resource name"))
+		}
+		if ownerRef.Child == "" {
+			errs = append(errs, field.Required(ownerRefPath.Child("child"), "must be a resource name"))
+		}
+		if _, found := children[ownerRef.Parent]; found {
+			// --update-owner-refs maps every parent to one child
+			errs = append(errs, field.Duplicate(ownerRefPath.Child("parent"), ownerRef.Parent))
+		}
+		if ownerRef.Parent != "" && ownerRef.Child != "" {
+			children[ownerRef.Parent] = ownerRef.Child
+		}
+	}
+	if _, err := calculateResourcePriorities(children); err != nil {
+		errs = append(errs, field.Forbidden(ownerRefsPath, "parents and children must not form a cycle"))
+	}
+
+	mappingsPath := field.NewPath("mappings")
+	errs = append(errs, validateConfigMappings(mappingsPath.Child("namespaces"), c.Mappings.Namespaces)...)
+	errs = append(errs, validateConfigMappings(mappingsPath.Child("labels"), c.Mappings.Labels)...)
+	errs = append(errs, validateConfigMappings(mappingsPath.Child("annotations"), c.Mappings.Annotations)...)
+	errs = append(errs, validateConfigMappings(mappingsPath.Child("versions"), c.Mappings.Versions)...)
+
+	transformsPath := field.NewPath("transforms")
+	for i, transform := range c.Transforms {
+		transformPath := transformsPath.Index(i)
+		if _, err := path.Match(transform.Resources, ""); transform.Resources == "" || err != nil {
+			errs = append(errs, field.Invalid(transformPath.Child("resources"), transform.Resources, "must be a resource name or glob pattern"))
+		}
+		errs = append(errs, validateTransformPatch(transformPath.Child("patch"), transform.Patch)...)
+	}
+
+	crdsPath := field.NewPath("crds")
+	errs = append(errs, validateConfigMappings(crdsPath.Child("shortNames"), c.CRDs.ShortNames)...)
+	errs = append(errs, validateConfigMappings(crdsPath.Child("categories"), c.CRDs.Categories)...)
+
+	errs = append(errs, validateConflictStrategy(field.NewPath("onConflict"), c.OnConflict)...)
+	if c.Workers < 0 {
+		errs = append(errs, field.Invalid(field.NewPath("workers"), c.Workers, "must be at least 1, or 0 to use --workers"))
+	}
+	if c.PageSize != nil && *c.PageSize < 0 {
+		errs = append(errs, field.Invalid(field.NewPath("pageSize"), *c.PageSize, "must be 0, to list all items at once, or more"))
+	}
+
+	return errs
+}
+
+func validateConfigGroupVersion(fldPath *field.Path, groupVersion string) field.ErrorList {
+	const detail = "must be a group or groupVersion, e.g. example.com or example.com/v1"
+	if groupVersion == "" {
+		return field.ErrorList{field.Required(fldPath, detail)}
+	}
+	if isGroup(groupVersion) {
+		return nil
+	}
+	if gv, err := schema.ParseGroupVersion(groupVersion); err != nil || gv.Group == "" || gv.Version == "" {
+		return field.ErrorList{field.Invalid(fldPath, groupVersion, detail)}
+	}
+	return nil
+}
+
+func validateConfigPatterns(fldPath *field.Path, patterns []string) field.ErrorList {
+	var errs field.ErrorList
+	for i, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, field.Invalid(fldPath.Index(i), pattern, "must be a resource name or glob pattern"))
+		}
+	}
+	return errs
+}
+
+func validateConflictStrategy(fldPath *field.Path, strategy string) field.ErrorList {
+	if strategy == "" {
+		return nil
+	}
+	if _, err := parseConflictStrategy(strategy); err != nil {
+		return field.ErrorList{field.NotSupported(fldPath, strategy, []string{
+			string(conflictSkip), string(conflictOverwrite), string(conflictMerge), string(conflictFail), string(conflictReport),
+		})}
+	}
+	return nil
+}
+
+func validateConfigMappings(fldPath *field.Path, mappings map[string]string) field.ErrorList {
+	var errs field.ErrorList
+	for _, from := range sortedKeys(mappings) {
+		// mappings are passed on as from:to
+		switch to := mappings[from]; {
+		case from == "" || strings.Contains(from, ":"):
+			errs = append(errs, field.Invalid(fldPath.Key(from), from, "must map from a value without colons"))
+		case to == "" || strings.Contains(to, ":"):
+			errs = append(errs, field.Invalid(fldPath.Key(from), to, "must map to a value without colons"))
+		}
+	}
+	return errs
+}
+
+// Apply returns options with the settings of the config file, which
+// replace those in options.
+func (c *Config) Apply(options Options) Options {
+	options.OldGroupVersion = c.From
+	options.NewGroupVersion = c.To
+	for _, groupVersion := range c.GroupVersions {
+		options.GroupVersionMappings = append(options.GroupVersionMappings, groupVersion.From+":"+groupVersion.To)
+	}
+
+	if len(c.Resources.Include) > 0 {
+		options.Resources = c.Resources.Include
+	}
+	if len(c.Resources.Exclude) > 0 {
+		options.ExcludeResources = c.Resources.Exclude
+	}
+	for _, settings := range c.Resources.Settings {
+		options.ResourceSettings = append(options.ResourceSettings, ResourceSettings{
+			Resources:  settings.Name,
+			OnConflict: settings.OnConflict,
+		})
+	}
+
+	if c.Items.Selector != "" {
+		options.Selector = c.Items.Selector
+	}
+	if c.Items.FieldSelector != "" {
+		options.FieldSelector = c.Items.FieldSelector
+	}
+	if len(c.Items.Namespaces) > 0 {
+		options.Namespaces = c.Items.Namespaces
+	}
+	if len(c.Items.ExcludeNamespaces) > 0 {
+		options.ExcludeNamespaces = c.Items.ExcludeNamespaces
+	}
+	if c.Items.OptOutAnnotation != nil {
+		options.OptOutAnnotation = *c.Items.OptOutAnnotation
+	}
+
+	if len(c.OwnerRefs) > 0 {
+		options.UpdateOwnerRefMappings = nil
+		for _, ownerRef := range c.OwnerRefs {
+			options.UpdateOwnerRefMappings = append(options.UpdateOwnerRefMappings, ownerRef.Parent+":"+ownerRef.Child)
+		}
+	}
+
+	for _, transform := range c.Transforms {
+		options.Transforms = append(options.Transforms, Transform{
+			Resources: transform.Resources,
+			Patch:     []byte(transform.Patch),
+		})
+	}
+
+	for _, mappings := range []struct {
+		from map[string]string
+		to   *[]string
+	}{
+		{c.Mappings.Namespaces, &options.NamespaceMappings},
+		{c.Mappings.Labels, &options.LabelMappings},
+		{c.Mappings.Annotations, &options.AnnotationMappings},
+		{c.Mappings.Versions, &options.VersionMappings},
+		{c.CRDs.ShortNames, &options.CRDShortNameMappings},
+		{c.CRDs.Categories, &options.CRDCategoryMappings},
+	} {
+		if len(mappings.from) > 0 {
+			*mappings.to = formatMappings(mappings.from)
+		}
+	}
+
+	if c.CRDs.Migrate {
+		options.MigrateCRDs = true
+	}
+	if c.OnConflict != "" {
+		options.OnConflict = c.OnConflict
+	}
+	if c.Workers > 0 {
+		options.Workers = c.Workers
+	}
+	if c.PageSize != nil {
+		options.PageSize = *c.PageSize
+	}
+
+	return options
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
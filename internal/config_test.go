@@ -0,0 +1,133 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfig(t *testing.T) {
+	config, err := parseConfig([]byte(`
+apiVersion: crd-migrator.vmware.com/v1alpha1
+kind: MigrationConfig
+from: my.example.com
+to: someapp.io
+groupVersions:
+- from: legacy.example.com/v1
+  to: legacy.someapp.io/v1
+resources:
+  exclude: [bazs]
+  settings:
+  - name: "foo*"
+    onConflict: overwrite
+items:
+  selector: app=foo
+  optOutAnnotation: ""
+ownerRefs:
+- parent: bars
+  child: foos
+mappings:
+  namespaces:
+    my-example: someapp
+  labels:
+    my.example.com: someapp.io
+    legacy.example.com: someapp.io
+  versions:
+    v1alpha1: v1
+    v1beta1: v1
+transforms:
+- resources: foos
+  patch:
+  - op: remove
+    path: /spec/legacy
+onConflict: merge
+workers: 4
+pageSize: 0
+`))
+	require.NoError(t, err)
+
+	options := config.Apply(Options{
+		OptOutAnnotation: "crd-migrator.vmware.com/skip",
+		OnConflict:       "skip",
+		PageSize:         500,
+		Workers:          1,
+		ExcludeResources: []string{"quxs"},
+	})
+
+	assert.Equal(t, Options{
+		OldGroupVersion:        "my.example.com",
+		NewGroupVersion:        "someapp.io",
+		GroupVersionMappings:   []string{"legacy.example.com/v1:legacy.someapp.io/v1"},
+		ExcludeResources:       []string{"bazs"},
+		ResourceSettings:       []ResourceSettings{{Resources: "foo*", OnConflict: "overwrite"}},
+		Selector:               "app=foo",
+		OptOutAnnotation:       "",
+		UpdateOwnerRefMappings: []string{"bars:foos"},
+		NamespaceMappings:      []string{"my-example:someapp"},
+		LabelMappings:          []string{"legacy.example.com:someapp.io", "my.example.com:someapp.io"},
+		VersionMappings:        []string{"v1alpha1:v1", "v1beta1:v1"},
+		Transforms:             []Transform{{Resources: "foos", Patch: []byte(`[{"op":"remove","path":"/spec/legacy"}]`)}},
+		OnConflict:             "merge",
+		Workers:                4,
+		PageSize:               0,
+	}, options)
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	_, err := parseConfig([]byte(`
+apiVersion: crd-migrator.vmware.com/v1alpha1
+kind: MigrationConfig
+from: my.example.com/v1
+to: someapp.io/v1
+onConflcit: merge
+`))
+	assert.EqualError(t, err, `unknown field "onConflcit"`)
+
+	_, err = parseConfig([]byte(`
+apiVersion: crd-migrator.vmware.com/v1alpha1
+kind: MigrationConfig
+from: my.example.com/v1
+from: someapp.io/v1
+`))
+	assert.EqualError(t, err, "unmarshal errors:\n  line 5: key \"from\" already set in map")
+
+	_, err = parseConfig([]byte(`
+apiVersion: crd-migrator.vmware.com/v2
+kind: MigrationConfig
+from: my.example.com/
+resources:
+  include: ["foo["]
+  settings:
+  - name: foos
+    onConflict: replace
+ownerRefs:
+- parent: bars
+  child: foos
+- parent: foos
+  child: bars
+mappings:
+  labels:
+    my.example.com: ""
+transforms:
+- resources: foos
+  patch:
+  - op: delete
+    path: spec
+workers: -1
+`))
+	assert.EqualError(t, err, `10 error(s):
+  apiVersion: Unsupported value: "crd-migrator.vmware.com/v2": supported values: "crd-migrator.vmware.com/v1alpha1"
+  from: Invalid value: "my.example.com/": must be a group or groupVersion, e.g. example.com or example.com/v1
+  to: Required value: must be a group or groupVersion, e.g. example.com or example.com/v1
+  resources.include[0]: Invalid value: "foo[": must be a resource name or glob pattern
+  resources.settings[0].onConflict: Unsupported value: "replace": supported values: "skip", "overwrite", "merge", "fail", "report"
+  ownerRefs: Forbidden: parents and children must not form a cycle
+  mappings.labels[my.example.com]: Invalid value: "": must map to a value without colons
+  transforms[0].patch[0].op: Unsupported value: "delete": supported values: "add", "remove", "replace", "move", "copy", "test"
+  transforms[0].patch[0].path: Invalid value: "spec": must be a JSON pointer, e.g. /spec/replicas
+  workers: Invalid value: -1: must be at least 1, or 0 to use --workers`)
+}
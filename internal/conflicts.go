@@ -0,0 +1,438 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"sigs.k8s.io/yaml"
+)
+
+// conflictStrategy is what happens to an item that already exists in the
+// new group/version.
+type conflictStrategy string
+
+const (
+	conflictSkip      conflictStrategy = "skip"
+	conflictOverwrite conflictStrategy = "overwrite"
+	conflictMerge     conflictStrategy = "merge"
+	conflictFail      conflictStrategy = "fail"
+	conflictReport    conflictStrategy = "report"
+)
+
+// migratedContentAnnotation records the checksum of the data, labels and
+// annotations an item was migrated with on items created or updated with
+// --on-conflict=merge. The content itself is recorded in the run journal,
+// and is the base of the three-way merge when the item is migrated again.
+const migratedContentAnnotation = "crd-migrator.vmware.com/migrated-content"
+
+// errItemExists is returned for an item that already exists in the new
+// group/version with --on-conflict=fail, and stops the migration of its
+// resource.
+var errItemExists = errors.New("item already exists in new API group")
+
+func parseConflictStrategy(strategy string) (conflictStrategy, error) {
+	switch s := conflictStrategy(strategy); s {
+	case conflictSkip, conflictOverwrite, conflictMerge, conflictFail, conflictReport:
+		return s, nil
+	default:
+		return "", errors.Errorf("invalid --on-conflict %q, must be one of: %s, %s, %s, %s, %s",
+			strategy, conflictSkip, conflictOverwrite, conflictMerge, conflictFail, conflictReport)
+	}
+}
+
+// conflictStrategyFor returns the strategy for existing items of
+// resource: that of the first resource settings matching it, or
+// --on-conflict.
+func (m *Migrator) conflictStrategyFor(resource string) conflictStrategy {
+	for _, settings := range m.resourceSettings {
+		if settings.onConflict != "" && matchesAny([]string{settings.pattern}, resource) {
+			return settings.onConflict
+		}
+	}
+	return m.onConflict
+}
+
+// resolveConflict applies strategy to item, which has been prepared for
+// create, and existingItem, which already exists in gvr.
+func (m *Migrator) resolveConflict(
+	log logrus.FieldLogger,
+	gvr schema.GroupVersionResource,
+	client dynamic.ResourceInterface,
+	subresources subresources,
+	strategy conflictStrategy,
+	item, existingItem *unstructured.Unstructured,
+) (itemOutcome, error) {
+	// need to track the item in case it's a parent and we need to update its UID in child ownerRefs
+	m.createdItemsTracker.registerCreatedItem(existingItem)
+
+	switch strategy {
+	case conflictSkip:
+		log.Warn("Item already exists - skipping")
+		return skipped("already exists"), nil
+	case conflictFail:
+		return itemOutcome{}, errors.WithStack(errItemExists)
+	case conflictReport:
+		return skipped("already exists"), m.reportConflict(log, item, existingItem)
+	case conflictMerge:
+		return m.mergeItem(log, gvr, client, subresources, item, existingItem)
+	}
+
+	if err := m.overwriteItem(log, client, subresources, item, existingItem); err != nil {
+		return itemOutcome{}, err
+	}
+	return itemOutcome{result: itemUpdated}, nil
+}
+
+// mergeItem merges item into existingItem, using the content existingItem
+// was last migrated with as the base. Items without a recorded base are
+// skipped.
+func (m *Migrator) mergeItem(
+	log logrus.FieldLogger,
+	gvr schema.GroupVersionResource,
+	client dynamic.ResourceInterface,
+	subresources subresources,
+	item, existingItem *unstructured.Unstructured,
+) (itemOutcome, error) {
+	checksum, ok := existingItem.GetAnnotations()[migratedContentAnnotation]
+	if !ok {
+		log.Warn("Item already exists but wasn't migrated with --on-conflict=merge - skipping")
+		return skipped("already exists without a recorded migrated content"), nil
+	}
+	base, err := m.mergeBase(checksum)
+	if err != nil {
+		return itemOutcome{}, err
+	}
+	if base == nil {
+		log.WithField("checksum", checksum).Warn("Item already exists but its migrated content isn't in any journal - skipping")
+		return skipped("already exists and its migrated content isn't in any journal"), nil
+	}
+
+	merged, err := mergeContents(item, existingItem, base)
+	if err != nil {
+		return itemOutcome{}, err
+	}
+	if merged == nil {
+		log.Info("Item already exists and its source is unchanged - skipping")
+		return skipped("already exists and its source is unchanged"), nil
+	}
+
+	if err := m.overwriteItem(log, client, subresources, merged, existingItem); err != nil {
+		return itemOutcome{}, err
+	}
+	content := migratedContent(item)
+	if err := m.journal.recordUpdate(gvr, existingItem, content); err != nil {
+		return itemOutcome{}, errors.Wrap(err, "error recording merged item in run journal")
+	}
+	m.addMergeBase(content)
+	return itemOutcome{result: itemUpdated}, nil
+}
+
+// mergeBase returns the content with checksum that an item was migrated
+// with, or nil if it isn't in any of the journals in the journal
+// directory, which are read the first time it's called.
+func (m *Migrator) mergeBase(checksum string) (map[string]interface{}, error) {
+	m.mergeBasesMu.Lock()
+	defer m.mergeBasesMu.Unlock()
+
+	if m.mergeBases == nil {
+		bases, err := readMigratedContents(m.journalDir)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading migrated contents from run journals")
+		}
+		m.mergeBases = bases
+	}
+	return m.mergeBases[checksum], nil
+}
+
+// addMergeBase adds content that an item was just migrated with to the
+// merge bases if they have been read, so that the item can be merged when
+// it's migrated again by the same migrator.
+func (m *Migrator) addMergeBase(content map[string]interface{}) {
+	m.mergeBasesMu.Lock()
+	defer m.mergeBasesMu.Unlock()
+
+	if m.mergeBases != nil {
+		m.mergeBases[migratedContentChecksum(content)] = content
+	}
+}
+
+// overwriteItem replaces the data and metadata of existingItem with those
+// of item, keeping the identity of existingItem.
+func (m *Migrator) overwriteItem(
+	log logrus.FieldLogger,
+	client dynamic.ResourceInterface,
+	subresources subresources,
+	item, existingItem *unstructured.Unstructured,
+) error {
+	updated := existingItem.DeepCopy()
+	for field := range updated.Object {
+		if field != "metadata" {
+			delete(updated.Object, field)
+		}
+	}
+	for field, value := range item.Object {
+		if field != "metadata" {
+			updated.Object[field] = runtime.DeepCopyJSONValue(value)
+		}
+	}
+	updated.SetLabels(item.GetLabels())
+	updated.SetAnnotations(item.GetAnnotations())
+	updated.SetOwnerReferences(item.GetOwnerReferences())
+	updated.SetFinalizers(item.GetFinalizers())
+
+	if m.dryRun {
+		log.Info("Item already exists - rendering overwritten item (dry run)")
+		return m.printer.print(updated)
+	}
+
+	log.Info("Item already exists - overwriting")
+	updated, err := client.Update(updated, metav1.UpdateOptions{})
+	if err != nil {
+		return errors.Wrap(err, "error overwriting item")
+	}
+
+	updated, err = m.migrateSubresources(log, client, subresources, item, updated)
+	if err != nil {
+		return err
+	}
+
+	m.createdItemsTracker.registerCreatedItem(updated)
+
+	return nil
+}
+
+// reportConflict writes a diff of existingItem and item, which would
+// replace it, to the output.
+func (m *Migrator) reportConflict(log logrus.FieldLogger, item, existingItem *unstructured.Unstructured) error {
+	existing, err := diffableYAML(existingItem)
+	if err != nil {
+		return err
+	}
+	migrated, err := diffableYAML(item)
+	if err != nil {
+		return err
+	}
+
+	id := fmt.Sprintf("%s %s", item.GetKind(), itemID(item.GetNamespace(), item.GetName()))
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(existing),
+		B:        difflib.SplitLines(migrated),
+		FromFile: "existing " + id,
+		ToFile:   "migrated " + id,
+		Context:  3,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if diff == "" {
+		log.Info("Item already exists and is up to date")
+		return nil
+	}
+
+	log.Warn("Item already exists and differs from the migrated item - reporting diff")
+
+	m.outMu.Lock()
+	defer m.outMu.Unlock()
+
+	_, err = io.WriteString(m.out, diff)
+	return errors.WithStack(err)
+}
+
+// diffableYAML renders item as YAML without the metadata that's set by
+// the API server.
+func diffableYAML(item *unstructured.Unstructured) (string, error) {
+	item = item.DeepCopy()
+	for _, field := range []string{"uid", "selfLink", "resourceVersion", "creationTimestamp", "generation"} {
+		unstructured.RemoveNestedField(item.Object, "metadata", field)
+	}
+
+	data, err := yaml.Marshal(item.Object)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return string(data), nil
+}
+
+// mergeContents merges the changes made to item in the old group/version
+// since it was migrated with base into existingItem. It returns the merged
+// item, which is item with the merged data, labels and annotations, or nil
+// if item didn't change since it was last migrated. If a field was changed
+// differently in both API groups, an error is returned.
+func mergeContents(item, existingItem *unstructured.Unstructured, base map[string]interface{}) (*unstructured.Unstructured, error) {
+	source := migratedContent(item)
+	if jsonEqual(base, source) {
+		return nil, nil
+	}
+
+	content, conflicts := mergeChanges("", base, source, migratedContent(existingItem))
+	if len(conflicts) > 0 {
+		return nil, errors.Errorf("item was changed in both API groups since it was migrated, unable to merge: %s", strings.Join(conflicts, ", "))
+	}
+
+	merged := item.DeepCopy()
+	for field := range merged.Object {
+		switch field {
+		case "apiVersion", "kind", "metadata", "status":
+		default:
+			delete(merged.Object, field)
+		}
+	}
+	for field, value := range content {
+		switch field {
+		case "labels", "annotations":
+		default:
+			merged.Object[field] = value
+		}
+	}
+	merged.SetLabels(stringMap(content["labels"]))
+	annotations := stringMap(content["annotations"])
+	annotations[migratedContentAnnotation] = item.GetAnnotations()[migratedContentAnnotation]
+	merged.SetAnnotations(annotations)
+
+	return merged, nil
+}
+
+// mergeChanges applies the changes from base to source to current, and
+// returns the result along with the paths of the fields that were changed
+// differently in source and current. Maps are merged key by key, any other
+// value, including lists, is replaced as a whole.
+func mergeChanges(path string, base, source, current map[string]interface{}) (map[string]interface{}, []string) {
+	merged := make(map[string]interface{})
+	for key, value := range current {
+		merged[key] = value
+	}
+
+	keys := make(stringSet)
+	for key := range base {
+		keys.add(key)
+	}
+	for key := range source {
+		keys.add(key)
+	}
+
+	var conflicts []string
+	for key := range keys {
+		baseValue, inBase := base[key]
+		sourceValue, inSource := source[key]
+		currentValue, inCurrent := current[key]
+
+		switch {
+		case inBase == inSource && jsonEqual(baseValue, sourceValue):
+			// unchanged in the old group/version, so the current value is kept
+		case inBase == inCurrent && jsonEqual(baseValue, currentValue):
+			if inSource {
+				merged[key] = sourceValue
+			} else {
+				delete(merged, key)
+			}
+		case inSource == inCurrent && jsonEqual(sourceValue, currentValue):
+			// changed the same way in both API groups
+		default:
+			baseMap, baseIsMap := baseValue.(map[string]interface{})
+			sourceMap, sourceIsMap := sourceValue.(map[string]interface{})
+			currentMap, currentIsMap := currentValue.(map[string]interface{})
+			if sourceIsMap && currentIsMap && (baseIsMap || !inBase) {
+				var nested []string
+				merged[key], nested = mergeChanges(path+key+".", baseMap, sourceMap, currentMap)
+				conflicts = append(conflicts, nested...)
+			} else {
+				conflicts = append(conflicts, path+key)
+			}
+		}
+	}
+
+	sort.Strings(conflicts)
+	return merged, conflicts
+}
+
+// jsonEqual returns whether a and b have the same JSON encoding, so that
+// decoded content, whose numbers are float64, can be compared to the
+// content of items, whose numbers are int64.
+func jsonEqual(a, b interface{}) bool {
+	// the content of unstructured items can always be marshaled
+	dataA, _ := json.Marshal(a)
+	dataB, _ := json.Marshal(b)
+	return bytes.Equal(dataA, dataB)
+}
+
+// stringMap converts the labels or annotations of migrated content back
+// to a map of strings.
+func stringMap(value interface{}) map[string]string {
+	result := make(map[string]string)
+	values, _ := value.(map[string]interface{})
+	for key, value := range values {
+		result[key], _ = value.(string)
+	}
+	return result
+}
+
+// migratedContent returns the data, labels and annotations of item, which
+// are what an item is migrated with, other than the migrated content
+// annotation and the status.
+func migratedContent(item *unstructured.Unstructured) map[string]interface{} {
+	content := make(map[string]interface{})
+	for field, value := range item.Object {
+		switch field {
+		case "apiVersion", "kind", "metadata", "status":
+		default:
+			content[field] = value
+		}
+	}
+
+	labels := make(map[string]interface{})
+	for key, value := range item.GetLabels() {
+		labels[key] = value
+	}
+	annotations := make(map[string]interface{})
+	for key, value := range item.GetAnnotations() {
+		if key != migratedContentAnnotation {
+			annotations[key] = value
+		}
+	}
+	content["labels"] = labels
+	content["annotations"] = annotations
+
+	return content
+}
+
+// migratedContentChecksum returns the checksum of migrated content that
+// is recorded in the migrated content annotation.
+func migratedContentChecksum(content map[string]interface{}) string {
+	// maps are marshaled with sorted keys, and the content of unstructured
+	// items can always be marshaled
+	data, _ := json.Marshal(content)
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+// recordMigratedContent sets the migrated content annotation of item,
+// which has been prepared for create, and returns the content to record
+// in the run journal.
+func recordMigratedContent(item *unstructured.Unstructured) map[string]interface{} {
+	content := migratedContent(item)
+
+	annotations := item.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[migratedContentAnnotation] = migratedContentChecksum(content)
+	item.SetAnnotations(annotations)
+
+	return content
+}
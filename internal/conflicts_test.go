@@ -0,0 +1,252 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+func TestMigrateOnConflict(t *testing.T) {
+	oldGV := schema.GroupVersion{Group: "old", Version: "v1"}
+	newGV := schema.GroupVersion{Group: "new", Version: "v1"}
+
+	withColor := func(b *unstructuredBuilder, color string) *unstructured.Unstructured {
+		item := b.Build()
+		require.NoError(t, unstructured.SetNestedField(item.Object, color, "spec", "color"))
+		return item
+	}
+
+	tests := []struct {
+		strategy  conflictStrategy
+		wantColor string
+		wantDiff  bool
+	}{
+		{strategy: conflictSkip, wantColor: "blue"},
+		{strategy: conflictOverwrite, wantColor: "red"},
+		{strategy: conflictFail, wantColor: "blue"},
+		{strategy: conflictReport, wantColor: "blue", wantDiff: true},
+		// there's no recorded migrated content to merge with, so the item is skipped
+		{strategy: conflictMerge, wantColor: "blue"},
+	}
+
+	for _, tc := range tests {
+		t.Run(string(tc.strategy), func(t *testing.T) {
+			h := newHarness(t, oldGV, newGV, nil, nil, nil, nil)
+			h.migrator.onConflict = tc.strategy
+			out := new(bytes.Buffer)
+			h.migrator.out = out
+
+			h.RegisterCRD(oldGV.WithResource("foo"))
+			h.AddResources(oldGV.WithResource("foo"), withColor(objectBuilder("old/v1", "Foo", "obj-1").Namespace("ns-1").Labels(map[string]string{"app": "foo"}), "red"))
+			h.RegisterCRD(newGV.WithResource("foo"))
+			h.AddResources(newGV.WithResource("foo"), withColor(objectBuilder("new/v1", "Foo", "obj-1").Namespace("ns-1"), "blue"))
+
+			h.migrator.MigrateAllResources()
+
+			item, err := h.dynamicClient.Resource(newGV.WithResource("foo")).Namespace("ns-1").Get("obj-1", metav1.GetOptions{})
+			require.NoError(t, err)
+			color, _, _ := unstructured.NestedString(item.Object, "spec", "color")
+			assert.Equal(t, tc.wantColor, color)
+
+			if tc.wantDiff {
+				assert.Contains(t, out.String(), "--- existing Foo ns-1/obj-1\n+++ migrated Foo ns-1/obj-1\n")
+				assert.Contains(t, out.String(), "-  color: blue\n+  color: red\n")
+			} else {
+				assert.NotContains(t, out.String(), "--- existing")
+			}
+		})
+	}
+}
+
+func TestMigrateOnConflictMerge(t *testing.T) {
+	oldGV := schema.GroupVersion{Group: "old", Version: "v1"}
+	newGV := schema.GroupVersion{Group: "new", Version: "v1"}
+
+	dir, err := ioutil.TempDir("", "journal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	h := newHarness(t, oldGV, newGV, nil, nil, nil, nil)
+	h.migrator.onConflict = conflictMerge
+	h.migrator.journal = newJournal(h.migrator.log, dir, "test-run")
+	h.migrator.journalDir = dir
+
+	source := objectBuilder("old/v1", "Foo", "obj-1").Namespace("ns-1").Build()
+	require.NoError(t, unstructured.SetNestedField(source.Object, "red", "spec", "color"))
+
+	h.RegisterCRD(oldGV.WithResource("foo"))
+	h.AddResources(oldGV.WithResource("foo"), source)
+	h.RegisterCRD(newGV.WithResource("foo"))
+
+	oldClient := h.dynamicClient.Resource(oldGV.WithResource("foo")).Namespace("ns-1")
+	newClient := h.dynamicClient.Resource(newGV.WithResource("foo")).Namespace("ns-1")
+
+	setField := func(client dynamic.ResourceInterface, field, value string) {
+		item, err := client.Get("obj-1", metav1.GetOptions{})
+		require.NoError(t, err)
+		require.NoError(t, unstructured.SetNestedField(item.Object, value, "spec", field))
+		_, err = client.Update(item, metav1.UpdateOptions{})
+		require.NoError(t, err)
+	}
+	getSpec := func() map[string]interface{} {
+		item, err := newClient.Get("obj-1", metav1.GetOptions{})
+		require.NoError(t, err)
+		spec, _, _ := unstructured.NestedMap(item.Object, "spec")
+		return spec
+	}
+	migrate := func() *ResourceReport {
+		report, _ := h.migrator.MigrateAllResources()
+		require.Len(t, report.Resources, 1)
+		return report.Resources[0]
+	}
+
+	// the first migration records the checksum of the migrated content on
+	// the item, and the content in the journal
+	migrate()
+	migrated, err := newClient.Get("obj-1", metav1.GetOptions{})
+	require.NoError(t, err)
+	content := map[string]interface{}{
+		"annotations": map[string]interface{}{},
+		"labels":      map[string]interface{}{},
+		"spec":        map[string]interface{}{"color": "red"},
+	}
+	assert.Equal(t, migratedContentChecksum(content), migrated.GetAnnotations()[migratedContentAnnotation])
+	entries, err := ReadJournal(dir, "test-run")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, content, entries[0].MigratedContent)
+
+	// the source is unchanged, so the item is kept
+	assert.Equal(t, []ItemReport{{ID: "ns-1/obj-1", Reason: "already exists and its source is unchanged"}}, migrate().Skipped)
+
+	// only the source changed; a dry run prints the merged item
+	setField(oldClient, "color", "green")
+	out := new(bytes.Buffer)
+	printer, err := newItemPrinter(out, outputFormatYAML)
+	require.NoError(t, err)
+	h.migrator.printer = printer
+	h.migrator.dryRun = true
+	// nothing is journaled in dry-run mode
+	journal := h.migrator.journal
+	h.migrator.journal = nil
+	assert.Len(t, migrate().Updated, 1)
+	assert.Contains(t, out.String(), "spec:\n  color: green\n")
+	assert.Equal(t, map[string]interface{}{"color": "red"}, getSpec())
+
+	// and the item is updated, with the base read from the journals
+	h.migrator.dryRun = false
+	h.migrator.journal = journal
+	h.migrator.mergeBases = nil
+	assert.Len(t, migrate().Updated, 1)
+	assert.Equal(t, map[string]interface{}{"color": "green"}, getSpec())
+	entries, err = ReadJournal(dir, "test-run")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.True(t, entries[1].Updated)
+
+	// different fields changed on both sides, so both changes are kept
+	setField(newClient, "size", "large")
+	setField(oldClient, "color", "yellow")
+	assert.Len(t, migrate().Updated, 1)
+	assert.Equal(t, map[string]interface{}{"color": "yellow", "size": "large"}, getSpec())
+
+	// the same field changed on both sides, so the item fails and is kept
+	setField(newClient, "color", "blue")
+	setField(oldClient, "color", "purple")
+	report := migrate()
+	require.Len(t, report.Failed, 1)
+	assert.Contains(t, report.Failed[0].Reason, "item was changed in both API groups since it was migrated, unable to merge: spec.color")
+	assert.Equal(t, map[string]interface{}{"color": "blue", "size": "large"}, getSpec())
+
+	// the base isn't in any journal, so the item is skipped
+	require.NoError(t, os.Remove(journalPath(dir, "test-run")))
+	h.migrator.mergeBases = nil
+	assert.Equal(t, []ItemReport{{ID: "ns-1/obj-1", Reason: "already exists and its migrated content isn't in any journal"}}, migrate().Skipped)
+
+	// merged items aren't deleted by a rollback
+	h.migrator.journal = newJournal(h.migrator.log, dir, "other-run")
+	item, err := newClient.Get("obj-1", metav1.GetOptions{})
+	require.NoError(t, err)
+	annotations := item.GetAnnotations()
+	annotations[migratedContentAnnotation] = migratedContentChecksum(migratedContent(item))
+	item.SetAnnotations(annotations)
+	_, err = newClient.Update(item, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	require.NoError(t, h.migrator.journal.recordUpdate(newGV.WithResource("foo"), item, migratedContent(item)))
+	h.migrator.mergeBases = nil
+	assert.Len(t, migrate().Updated, 1)
+	require.NoError(t, h.migrator.Rollback("other-run"))
+	_, err = newClient.Get("obj-1", metav1.GetOptions{})
+	assert.NoError(t, err)
+}
+
+func TestMergeChanges(t *testing.T) {
+	base := map[string]interface{}{
+		"replicas": float64(1),
+		"removed":  "a",
+		"nested":   map[string]interface{}{"a": "1", "b": "1"},
+		"list":     []interface{}{"a"},
+	}
+	source := map[string]interface{}{
+		"replicas": int64(1),
+		"nested":   map[string]interface{}{"a": "2", "b": "1"},
+		"list":     []interface{}{"a", "b"},
+		"added":    "b",
+	}
+	current := map[string]interface{}{
+		"replicas": int64(3),
+		"removed":  "a",
+		"nested":   map[string]interface{}{"a": "1", "b": "3", "c": "3"},
+		"list":     []interface{}{"a"},
+	}
+
+	merged, conflicts := mergeChanges("", base, source, current)
+	assert.Empty(t, conflicts)
+	assert.Equal(t, map[string]interface{}{
+		"replicas": int64(3),
+		"nested":   map[string]interface{}{"a": "2", "b": "3", "c": "3"},
+		"list":     []interface{}{"a", "b"},
+		"added":    "b",
+	}, merged)
+
+	current["list"] = []interface{}{"c"}
+	current["nested"].(map[string]interface{})["a"] = "3"
+	_, conflicts = mergeChanges("", base, source, current)
+	assert.Equal(t, []string{"list", "nested.a"}, conflicts)
+}
+
+func TestParseConflictStrategy(t *testing.T) {
+	strategy, err := parseConflictStrategy("merge")
+	require.NoError(t, err)
+	assert.Equal(t, conflictMerge, strategy)
+
+	_, err = parseConflictStrategy("replace")
+	assert.EqualError(t, err, `invalid --on-conflict "replace", must be one of: skip, overwrite, merge, fail, report`)
+}
+
+func TestConflictStrategyFor(t *testing.T) {
+	m := &Migrator{
+		onConflict: conflictSkip,
+		resourceSettings: []resourceSettings{
+			{pattern: "foo*", onConflict: conflictOverwrite},
+			{pattern: "foobars"},
+			{pattern: "*bars", onConflict: conflictFail},
+		},
+	}
+
+	assert.Equal(t, conflictOverwrite, m.conflictStrategyFor("foos"))
+	assert.Equal(t, conflictOverwrite, m.conflictStrategyFor("foobars"))
+	assert.Equal(t, conflictFail, m.conflictStrategyFor("bars"))
+	assert.Equal(t, conflictSkip, m.conflictStrategyFor("bazs"))
+}
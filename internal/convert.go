@@ -0,0 +1,357 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// StdinPath is the manifest path that reads from stdin.
+const StdinPath = "-"
+
+// manifestFile is a manifest file and all documents in it.
+type manifestFile struct {
+	// path is where the file was read from
+	path string
+	// relPath is where the file is written to, relative to the output
+	// directory
+	relPath   string
+	documents []*unstructured.Unstructured
+}
+
+// ConvertManifests applies the migration to the manifests in paths, which
+// can be files, directories or StdinPath, without connecting to a
+// cluster. Documents in the old group/version get the same changes as
+// items migrated by MigrateAllResources; all other documents are written
+// unchanged. If outputDir is empty, all documents are written to out,
+// otherwise each file is written to the same relative path in outputDir:
+// relative to the directory it was found in, or the path it was given as.
+// It fails if two files would be written to the same path.
+func (m *Migrator) ConvertManifests(paths []string, outputDir, format string, out io.Writer) error {
+	if outputDir != "" {
+		for _, path := range paths {
+			if path == StdinPath {
+				return errors.New("manifests read from stdin can only be written to stdout")
+			}
+		}
+	}
+
+	files, err := readManifests(paths)
+	if err != nil {
+		return err
+	}
+
+	if outputDir != "" {
+		if err := checkOutputPaths(files); err != nil {
+			return err
+		}
+	}
+
+	if err := m.convertDocuments(files); err != nil {
+		return err
+	}
+
+	if outputDir == "" {
+		printer, err := newItemPrinter(out, format)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			for _, doc := range file.documents {
+				if err := printer.print(doc); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	for _, file := range files {
+		if err := writeManifest(filepath.Join(outputDir, file.relPath), format, file.documents); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// convertDocuments converts all documents in the old group/version.
+// Documents of --update-owner-refs resources are converted first, parents
+// before children, followed by all others in the order they were read.
+func (m *Migrator) convertDocuments(files []*manifestFile) error {
+	resourcePriorities, err := calculateResourcePriorities(m.updateOwnerRefMappings)
+	if err != nil {
+		return errors.New("--update-owner-refs contains a cycle")
+	}
+
+	priorities := make(map[string]int)
+	for i, resourceName := range resourcePriorities {
+		priorities[resourceName] = i
+	}
+	priority := func(resourceName string) int {
+		if p, ok := priorities[resourceName]; ok {
+			return p
+		}
+		return len(priorities)
+	}
+
+	type document struct {
+		resource metav1.APIResource
+		object   *unstructured.Unstructured
+	}
+
+	// there's no discovery without a cluster, so resource names are taken
+	// from the CRDs among the manifests, or guessed from the kind
+	resourceNames := crdResourceNames(files, m.oldGroupVersion.Group)
+	guessed := make(stringSet)
+
+	var docs []document
+	for _, file := range files {
+		for _, obj := range file.documents {
+			if obj.GetAPIVersion() != m.oldGroupVersion.String() {
+				continue
+			}
+
+			kind := obj.GetKind()
+			name, ok := resourceNames[kind]
+			if !ok {
+				plural, _ := meta.UnsafeGuessKindToResource(obj.GroupVersionKind())
+				name = plural.Resource
+				if !guessed.has(kind) {
+					guessed.add(kind)
+					m.log.WithFields(logrus.Fields{"kind": kind, "resource": name}).Warn("No CRD of kind among the manifests, guessing its resource name from the kind")
+				}
+			}
+
+			docs = append(docs, document{
+				resource: metav1.APIResource{Name: name, Kind: kind},
+				object:   obj,
+			})
+		}
+	}
+
+	sort.SliceStable(docs, func(i, j int) bool {
+		return priority(docs[i].resource.Name) < priority(docs[j].resource.Name)
+	})
+
+	for _, doc := range docs {
+		log := m.log.WithFields(logrus.Fields{
+			"resource": doc.resource.Name,
+			"id":       itemID(doc.object.GetNamespace(), doc.object.GetName()),
+		})
+		log.Info("Converting document")
+
+		m.registerIfParent(doc.resource)
+		if err := m.prepareForCreate(log, doc.resource.Name, doc.object); err != nil {
+			return errors.Wrapf(err, "error converting %s %s", doc.resource.Name, itemID(doc.object.GetNamespace(), doc.object.GetName()))
+		}
+		m.createdItemsTracker.registerCreatedItem(doc.object)
+	}
+
+	return nil
+}
+
+// crdResourceNames returns the resource names of the kinds of group,
+// keyed by kind, from the CRDs among the documents of files.
+func crdResourceNames(files []*manifestFile, group string) map[string]string {
+	names := make(map[string]string)
+
+	for _, file := range files {
+		for _, obj := range file.documents {
+			if gvk := obj.GroupVersionKind(); gvk.Group != crdResourceV1.Group || gvk.Kind != "CustomResourceDefinition" {
+				continue
+			}
+			if crdGroup, _, _ := unstructured.NestedString(obj.Object, "spec", "group"); crdGroup != group {
+				continue
+			}
+
+			kind, _, _ := unstructured.NestedString(obj.Object, "spec", "names", "kind")
+			plural, _, _ := unstructured.NestedString(obj.Object, "spec", "names", "plural")
+			if kind != "" && plural != "" {
+				names[kind] = plural
+			}
+		}
+	}
+
+	return names
+}
+
+// checkOutputPaths returns an error if two files would be written to the
+// same path in the output directory.
+func checkOutputPaths(files []*manifestFile) error {
+	written := make(map[string]string)
+
+	for _, file := range files {
+		relPath := filepath.Clean(file.relPath)
+		if other, ok := written[relPath]; ok {
+			return errors.Errorf("%s and %s would both be written to %s in the output directory", other, file.path, relPath)
+		}
+		written[relPath] = file.path
+	}
+
+	return nil
+}
+
+// readManifests reads all documents from the manifest files in paths.
+// Directories are searched recursively for .yaml, .yml and .json files.
+func readManifests(paths []string) ([]*manifestFile, error) {
+	var files []*manifestFile
+
+	for _, path := range paths {
+		if path == StdinPath {
+			docs, err := decodeManifest(os.Stdin)
+			if err != nil {
+				return nil, errors.Wrap(err, "error reading manifests from stdin")
+			}
+			files = append(files, &manifestFile{path: StdinPath, documents: docs})
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		if !info.IsDir() {
+			file, err := readManifestFile(path, fileOutputPath(path))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, file)
+			continue
+		}
+
+		err = filepath.Walk(path, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			switch filepath.Ext(filePath) {
+			case ".yaml", ".yml", ".json":
+			default:
+				return nil
+			}
+
+			relPath, err := filepath.Rel(path, filePath)
+			if err != nil {
+				return err
+			}
+
+			file, err := readManifestFile(filePath, relPath)
+			if err != nil {
+				return err
+			}
+			files = append(files, file)
+			return nil
+		})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	return files, nil
+}
+
+// fileOutputPath returns the path a manifest file given by path is
+// written to, relative to the output directory: path itself, unless it's
+// absolute or outside of the working directory, in which case it's the
+// file name.
+func fileOutputPath(path string) string {
+	relPath := filepath.Clean(path)
+	if filepath.IsAbs(relPath) || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return filepath.Base(path)
+	}
+	return relPath
+}
+
+func readManifestFile(path, relPath string) (*manifestFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	docs, err := decodeManifest(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading manifests from %s", path)
+	}
+
+	return &manifestFile{path: path, relPath: relPath, documents: docs}, nil
+}
+
+// decodeManifest decodes a stream of YAML documents or JSON objects.
+// Empty documents are skipped.
+func decodeManifest(r io.Reader) ([]*unstructured.Unstructured, error) {
+	var docs []*unstructured.Unstructured
+
+	err := decodeDocuments(r, func(obj *unstructured.Unstructured) error {
+		docs = append(docs, obj)
+		return nil
+	})
+
+	return docs, err
+}
+
+// decodeDocuments decodes a stream of YAML documents or JSON objects and
+// calls fn with each, one at a time. Empty documents are skipped.
+func decodeDocuments(r io.Reader, fn func(*unstructured.Unstructured) error) error {
+	decoder := utilyaml.NewYAMLOrJSONDecoder(r, 4096)
+
+	for i := 1; ; i++ {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if trimmed := bytes.TrimSpace(raw); len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")) {
+			continue
+		}
+
+		obj := new(unstructured.Unstructured)
+		if err := obj.UnmarshalJSON(raw); err != nil {
+			return errors.Wrapf(err, "error decoding document %d", i)
+		}
+
+		if err := fn(obj); err != nil {
+			return err
+		}
+	}
+}
+
+func writeManifest(path, format string, docs []*unstructured.Unstructured) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	buf := new(bytes.Buffer)
+	printer, err := newItemPrinter(buf, format)
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		if err := printer.print(doc); err != nil {
+			return err
+		}
+	}
+
+	return errors.WithStack(ioutil.WriteFile(path, buf.Bytes(), 0644))
+}
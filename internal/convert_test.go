@@ -0,0 +1,226 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertManifests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "convert")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	inputDir := filepath.Join(dir, "in")
+	require.NoError(t, os.MkdirAll(filepath.Join(inputDir, "nested"), 0755))
+
+	// the child is read before its parent
+	require.NoError(t, ioutil.WriteFile(filepath.Join(inputDir, "foo.yaml"), []byte(`
+apiVersion: my.example.com/v1
+kind: Foo
+metadata:
+  name: foo1
+  namespace: example
+  labels:
+    my.example.com/color: blue
+  ownerReferences:
+  - apiVersion: my.example.com/v1
+    kind: Bar
+    name: bar1
+    uid: old-uid
+spec:
+  replicas: 3
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: unrelated
+  namespace: example
+`), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(inputDir, "nested", "bar.json"), []byte(`
+{"apiVersion": "my.example.com/v1", "kind": "Bar", "metadata": {"name": "bar1", "namespace": "example"}}
+`), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(inputDir, "README.md"), []byte("not a manifest"), 0644))
+
+	m, err := NewOfflineMigrator(Options{
+		LogLevel:               "debug",
+		OldGroupVersion:        "my.example.com/v1",
+		NewGroupVersion:        "example.io/v1",
+		NamespaceMappings:      []string{"example:other"},
+		LabelMappings:          []string{"my.example.com:example.io"},
+		UpdateOwnerRefMappings: []string{"bars:foos"},
+	})
+	require.NoError(t, err)
+
+	outputDir := filepath.Join(dir, "out")
+	require.NoError(t, m.ConvertManifests([]string{inputDir}, outputDir, outputFormatYAML, nil))
+
+	foo, err := ioutil.ReadFile(filepath.Join(outputDir, "foo.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, `apiVersion: example.io/v1
+kind: Foo
+metadata:
+  labels:
+    example.io/color: blue
+  name: foo1
+  namespace: other
+  ownerReferences:
+  - apiVersion: example.io/v1
+    kind: Bar
+    name: bar1
+    uid: old-uid
+spec:
+  replicas: 3
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: unrelated
+  namespace: example
+`, string(foo))
+
+	bar, err := ioutil.ReadFile(filepath.Join(outputDir, "nested", "bar.json"))
+	require.NoError(t, err)
+	assert.Equal(t, `apiVersion: example.io/v1
+kind: Bar
+metadata:
+  name: bar1
+  namespace: other
+`, string(bar))
+
+	_, err = os.Stat(filepath.Join(outputDir, "README.md"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestConvertManifestsToStdout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "convert")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "foo.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`
+apiVersion: my.example.com/v1
+kind: Foo
+metadata:
+  name: foo1
+`), 0644))
+
+	m, err := NewOfflineMigrator(Options{
+		LogLevel:        "debug",
+		OldGroupVersion: "my.example.com/v1",
+		NewGroupVersion: "example.io/v1",
+	})
+	require.NoError(t, err)
+
+	out := new(bytes.Buffer)
+	require.NoError(t, m.ConvertManifests([]string{path}, "", outputFormatJSON, out))
+	assert.JSONEq(t, `{"apiVersion": "example.io/v1", "kind": "Foo", "metadata": {"name": "foo1"}}`, out.String())
+
+	assert.EqualError(t, m.ConvertManifests([]string{StdinPath}, dir, outputFormatYAML, nil), "manifests read from stdin can only be written to stdout")
+}
+
+func TestConvertManifestsResourceNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "convert")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the CRD names the resource of Bar, which isn't the guessed "bars"
+	path := filepath.Join(dir, "manifests.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`
+apiVersion: apiextensions.k8s.io/v1beta1
+kind: CustomResourceDefinition
+metadata:
+  name: barz.my.example.com
+spec:
+  group: my.example.com
+  names:
+    kind: Bar
+    plural: barz
+---
+apiVersion: my.example.com/v1
+kind: Foo
+metadata:
+  name: foo1
+  ownerReferences:
+  - apiVersion: my.example.com/v1
+    kind: Bar
+    name: bar1
+    uid: old-uid
+---
+apiVersion: my.example.com/v1
+kind: Bar
+metadata:
+  name: bar1
+`), 0644))
+
+	m, err := NewOfflineMigrator(Options{
+		LogLevel:               "debug",
+		OldGroupVersion:        "my.example.com/v1",
+		NewGroupVersion:        "example.io/v1",
+		UpdateOwnerRefMappings: []string{"barz:foos"},
+	})
+	require.NoError(t, err)
+
+	out := new(bytes.Buffer)
+	require.NoError(t, m.ConvertManifests([]string{path}, "", outputFormatYAML, out))
+	assert.Contains(t, out.String(), `  ownerReferences:
+  - apiVersion: example.io/v1
+    kind: Bar
+    name: bar1
+    uid: old-uid
+`)
+}
+
+func TestConvertManifestsOutputPaths(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{path: "foo.yaml", expected: "foo.yaml"},
+		{path: "./manifests/foo.yaml", expected: filepath.Join("manifests", "foo.yaml")},
+		{path: "../foo.yaml", expected: "foo.yaml"},
+		{path: "/manifests/foo.yaml", expected: "foo.yaml"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			assert.Equal(t, tc.expected, fileOutputPath(filepath.FromSlash(tc.path)))
+		})
+	}
+
+	t.Run("collision", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "convert")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		var paths []string
+		for _, subdir := range []string{"a", "b"} {
+			path := filepath.Join(dir, subdir, "foo.yaml")
+			require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+			require.NoError(t, ioutil.WriteFile(path, []byte("kind: ConfigMap\napiVersion: v1\n"), 0644))
+			paths = append(paths, path)
+		}
+
+		m, err := NewOfflineMigrator(Options{
+			LogLevel:        "debug",
+			OldGroupVersion: "my.example.com/v1",
+			NewGroupVersion: "example.io/v1",
+		})
+		require.NoError(t, err)
+
+		outputDir := filepath.Join(dir, "out")
+		err = m.ConvertManifests(paths, outputDir, outputFormatYAML, nil)
+		assert.EqualError(t, err, paths[0]+" and "+paths[1]+" would both be written to foo.yaml in the output directory")
+
+		_, err = os.Stat(outputDir)
+		assert.True(t, os.IsNotExist(err))
+	})
+}
@@ -0,0 +1,387 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
+)
+
+// crdResourceV1 and crdResourceV1beta1 are the resources of the CRDs
+// themselves. v1 is used if a cluster serves it.
+var (
+	crdResourceV1 = schema.GroupVersionResource{
+		Group:    "apiextensions.k8s.io",
+		Version:  "v1",
+		Resource: "customresourcedefinitions",
+	}
+	crdResourceV1beta1 = schema.GroupVersionResource{
+		Group:    "apiextensions.k8s.io",
+		Version:  "v1beta1",
+		Resource: "customresourcedefinitions",
+	}
+)
+
+const (
+	// defaultCRDEstablishedTimeout is how long to wait for a migrated CRD
+	// to be established unless --crd-timeout says otherwise.
+	defaultCRDEstablishedTimeout = 2 * time.Minute
+	// crdPollInterval is how often a migrated CRD is checked for being
+	// established.
+	crdPollInterval = time.Second
+)
+
+// discoverCRDResource returns the CRD resource to use with a cluster:
+// apiextensions.k8s.io/v1 if the cluster serves it, otherwise v1beta1.
+func discoverCRDResource(client discovery.ServerResourcesInterface) (schema.GroupVersionResource, error) {
+	resources, err := client.ServerResourcesForGroupVersion(crdResourceV1.GroupVersion().String())
+	if apierrors.IsNotFound(err) {
+		return crdResourceV1beta1, nil
+	} else if err != nil {
+		return schema.GroupVersionResource{}, errors.Wrap(err, "error retrieving server resources for apiextensions.k8s.io/v1")
+	}
+
+	if resources != nil {
+		for _, resource := range resources.APIResources {
+			if resource.Name == crdResourceV1.Resource {
+				return crdResourceV1, nil
+			}
+		}
+	}
+
+	return crdResourceV1beta1, nil
+}
+
+// migrateAllCRDs creates the CRD in the new group/version of every
+// resource in the old group/version, unless it already exists, and waits
+// until each is established.
+func (m *Migrator) migrateAllCRDs() error {
+	resources, _, err := m.discoverResources()
+	if err != nil {
+		return err
+	}
+
+	for _, resource := range resources {
+		if m.stopped() {
+			return ErrInterrupted
+		}
+
+		if err := m.migrateCRD(resource); err != nil {
+			return errors.Wrapf(err, "error migrating CRD of %s", resource.Name)
+		}
+	}
+
+	return nil
+}
+
+func (m *Migrator) migrateCRD(resource metav1.APIResource) error {
+	oldName := fmt.Sprintf("%s.%s", resource.Name, m.oldGroupVersion.Group)
+	log := m.log.WithField("crd", oldName)
+
+	oldCRD, err := m.sourceCRDClient.Get(oldName, metav1.GetOptions{})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	newCRD, err := m.convertCRD(log, oldCRD)
+	if err != nil {
+		return err
+	}
+	log = m.log.WithFields(logrus.Fields{
+		"crd":          newCRD.GetName(),
+		"original-crd": oldName,
+	})
+
+	existing, err := m.destCRDClient.Get(newCRD.GetName(), metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		// CRDs aren't recorded in the run journal: deleting one deletes
+		// every item of it, including those the run didn't create
+		log.Info("Creating CRD")
+		if _, err := m.destCRDClient.Create(newCRD, metav1.CreateOptions{}); err != nil {
+			return errors.WithStack(err)
+		}
+	case err != nil:
+		return errors.WithStack(err)
+	default:
+		if err := m.checkExistingCRD(existing, newCRD); err != nil {
+			return err
+		}
+		log.Info("CRD already exists")
+	}
+
+	log.Info("Waiting for CRD to be established")
+	return m.waitForCRDEstablished(newCRD.GetName())
+}
+
+// checkExistingCRD returns an error unless crd, a CRD that already exists
+// in the new group, serves the new version with the same kind as
+// converted, the CRD converted from the old group. An existing CRD is never
+// changed: it may have been created by hand or by another tool, and its
+// items may be stored at versions the old CRD doesn't have.
+func (m *Migrator) checkExistingCRD(crd, converted *unstructured.Unstructured) error {
+	kind, _, _ := unstructured.NestedString(crd.Object, "spec", "names", "kind")
+	if convertedKind, _, _ := unstructured.NestedString(converted.Object, "spec", "names", "kind"); kind != convertedKind {
+		return errors.Errorf("CRD %s already exists with kind %s instead of %s", crd.GetName(), kind, convertedKind)
+	}
+
+	newVersion := m.newGroupVersion.Version
+	served := false
+	if version, _, _ := unstructured.NestedString(crd.Object, "spec", "version"); version == newVersion {
+		served = true
+	}
+	versions, _, _ := unstructured.NestedSlice(crd.Object, "spec", "versions")
+	for _, v := range versions {
+		if version, ok := v.(map[string]interface{}); ok && version["name"] == newVersion {
+			served = version["served"] != false
+		}
+	}
+	if !served {
+		return errors.Errorf("CRD %s already exists but doesn't serve version %s", crd.GetName(), newVersion)
+	}
+
+	return nil
+}
+
+// convertCRD returns a copy of crd, a CRD in the old group, for the new
+// group/version, in the apiextensions.k8s.io version served by the
+// destination cluster. If the CRD doesn't have the new version, the old
+// version is renamed to it. Of spec.names, only shortNames and categories
+// are mapped; the rest of the migration relies on the plural and kind
+// being the same in both groups.
+func (m *Migrator) convertCRD(log logrus.FieldLogger, crd *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	plural, _, _ := unstructured.NestedString(crd.Object, "spec", "names", "plural")
+	if plural == "" {
+		return nil, errors.Errorf("CRD %s has no spec.names.plural", crd.GetName())
+	}
+
+	spec, _, _ := unstructured.NestedMap(crd.Object, "spec")
+	switch sourceVersion, destVersion := crd.GroupVersionKind().Version, m.destCRDResource.Version; {
+	case sourceVersion == crdResourceV1beta1.Version && destVersion == crdResourceV1.Version:
+		convertCRDSpecToV1(spec)
+	case sourceVersion == crdResourceV1.Version && destVersion == crdResourceV1beta1.Version:
+		convertCRDSpecToV1beta1(spec)
+	}
+
+	newCRD := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": m.destCRDResource.GroupVersion().String(),
+		"kind":       "CustomResourceDefinition",
+		"spec":       spec,
+	}}
+	newCRD.SetName(fmt.Sprintf("%s.%s", plural, m.newGroupVersion.Group))
+	newCRD.SetLabels(updateMapKeys(crd.GetLabels(), m.labelMappings))
+	newCRD.SetAnnotations(updateMapKeys(crd.GetAnnotations(), m.annotationMappings))
+
+	if err := unstructured.SetNestedField(newCRD.Object, m.newGroupVersion.Group, "spec", "group"); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if err := m.renameCRDVersion(log, newCRD); err != nil {
+		return nil, err
+	}
+
+	for _, field := range []struct {
+		name     string
+		mappings map[string]string
+	}{
+		{"shortNames", m.crdShortNameMappings},
+		{"categories", m.crdCategoryMappings},
+	} {
+		values, found, _ := unstructured.NestedStringSlice(newCRD.Object, "spec", "names", field.name)
+		if !found || len(field.mappings) == 0 {
+			continue
+		}
+		for i, value := range values {
+			if mapped, ok := field.mappings[value]; ok {
+				values[i] = mapped
+			}
+		}
+		if err := unstructured.SetNestedStringSlice(newCRD.Object, values, "spec", "names", field.name); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	return newCRD, nil
+}
+
+// renameCRDVersion makes sure that crd serves the new version, by renaming
+// the old version if needed.
+func (m *Migrator) renameCRDVersion(log logrus.FieldLogger, crd *unstructured.Unstructured) error {
+	oldVersion, newVersion := m.oldGroupVersion.Version, m.newGroupVersion.Version
+	if oldVersion == newVersion {
+		return nil
+	}
+
+	versions, _, _ := unstructured.NestedSlice(crd.Object, "spec", "versions")
+	for _, v := range versions {
+		if version, ok := v.(map[string]interface{}); ok && version["name"] == newVersion {
+			return nil
+		}
+	}
+
+	log.WithFields(logrus.Fields{"from": oldVersion, "to": newVersion}).Info("Renaming CRD version")
+
+	if version, _, _ := unstructured.NestedString(crd.Object, "spec", "version"); version == oldVersion {
+		if err := unstructured.SetNestedField(crd.Object, newVersion, "spec", "version"); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	for _, v := range versions {
+		if version, ok := v.(map[string]interface{}); ok && version["name"] == oldVersion {
+			version["name"] = newVersion
+		}
+	}
+	if len(versions) > 0 {
+		if err := unstructured.SetNestedSlice(crd.Object, versions, "spec", "versions"); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+// waitForCRDEstablished waits until the CRD called name has the
+// Established condition, i.e. until its resources are served.
+func (m *Migrator) waitForCRDEstablished(name string) error {
+	err := wait.PollImmediate(crdPollInterval, m.crdEstablishedTimeout, func() (bool, error) {
+		crd, err := m.destCRDClient.Get(name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+
+		conditions, _, _ := unstructured.NestedSlice(crd.Object, "status", "conditions")
+		for _, c := range conditions {
+			condition, ok := c.(map[string]interface{})
+			if ok && condition["type"] == "Established" && condition["status"] == "True" {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return errors.Errorf("CRD %s was not established within %s", name, m.crdEstablishedTimeout)
+	}
+
+	return errors.WithStack(err)
+}
+
+// convertCRDSpecToV1 converts the spec of a v1beta1 CRD to v1, which only
+// has per-version schemas, subresources and printer columns, and requires
+// a schema for every version.
+func convertCRDSpecToV1(spec map[string]interface{}) {
+	versions, _, _ := unstructured.NestedSlice(spec, "versions")
+	if version, ok := spec["version"].(string); ok && len(versions) == 0 {
+		versions = []interface{}{
+			map[string]interface{}{"name": version, "served": true, "storage": true},
+		}
+	}
+
+	// unless preserveUnknownFields is false, v1beta1 CRDs preserve unknown
+	// fields, which v1 only allows in the schema
+	preserveUnknownFields, found, _ := unstructured.NestedBool(spec, "preserveUnknownFields")
+	preserveUnknownFields = preserveUnknownFields || !found
+
+	for _, v := range versions {
+		version, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if _, ok := version["subresources"]; !ok && spec["subresources"] != nil {
+			version["subresources"] = runtime.DeepCopyJSONValue(spec["subresources"])
+		}
+		if _, ok := version["additionalPrinterColumns"]; !ok && spec["additionalPrinterColumns"] != nil {
+			version["additionalPrinterColumns"] = runtime.DeepCopyJSONValue(spec["additionalPrinterColumns"])
+		}
+		if _, ok := version["schema"]; !ok && spec["validation"] != nil {
+			version["schema"] = runtime.DeepCopyJSONValue(spec["validation"])
+		}
+		if _, ok := version["schema"]; !ok {
+			version["schema"] = map[string]interface{}{
+				"openAPIV3Schema": map[string]interface{}{"type": "object"},
+			}
+		}
+		if preserveUnknownFields {
+			_ = unstructured.SetNestedField(version, true, "schema", "openAPIV3Schema", "x-kubernetes-preserve-unknown-fields")
+		}
+
+		renamePrinterColumnField(version, "JSONPath", "jsonPath")
+	}
+
+	delete(spec, "version")
+	delete(spec, "validation")
+	delete(spec, "subresources")
+	delete(spec, "additionalPrinterColumns")
+	delete(spec, "preserveUnknownFields")
+	if len(versions) > 0 {
+		spec["versions"] = versions
+	}
+
+	if strategy, _, _ := unstructured.NestedString(spec, "conversion", "strategy"); strategy == "Webhook" {
+		conversion := spec["conversion"].(map[string]interface{})
+		webhook := map[string]interface{}{
+			"conversionReviewVersions": []interface{}{"v1beta1"},
+		}
+		if clientConfig, ok := conversion["webhookClientConfig"]; ok {
+			webhook["clientConfig"] = clientConfig
+		}
+		if reviewVersions, ok := conversion["conversionReviewVersions"]; ok {
+			webhook["conversionReviewVersions"] = reviewVersions
+		}
+		delete(conversion, "webhookClientConfig")
+		delete(conversion, "conversionReviewVersions")
+		conversion["webhook"] = webhook
+	}
+}
+
+// convertCRDSpecToV1beta1 converts the spec of a v1 CRD to v1beta1, which
+// also supports per-version schemas, subresources and printer columns.
+func convertCRDSpecToV1beta1(spec map[string]interface{}) {
+	versions, _, _ := unstructured.NestedSlice(spec, "versions")
+	for _, v := range versions {
+		if version, ok := v.(map[string]interface{}); ok {
+			renamePrinterColumnField(version, "jsonPath", "JSONPath")
+		}
+	}
+	if len(versions) > 0 {
+		spec["versions"] = versions
+	}
+
+	if webhook, found, _ := unstructured.NestedMap(spec, "conversion", "webhook"); found {
+		conversion := spec["conversion"].(map[string]interface{})
+		if clientConfig, ok := webhook["clientConfig"]; ok {
+			conversion["webhookClientConfig"] = clientConfig
+		}
+		if reviewVersions, ok := webhook["conversionReviewVersions"]; ok {
+			conversion["conversionReviewVersions"] = reviewVersions
+		}
+		delete(conversion, "webhook")
+	}
+}
+
+// renamePrinterColumnField renames a field of every printer column of a
+// CRD version.
+func renamePrinterColumnField(version map[string]interface{}, from, to string) {
+	columns, _ := version["additionalPrinterColumns"].([]interface{})
+	for _, c := range columns {
+		if column, ok := c.(map[string]interface{}); ok {
+			if value, ok := column[from]; ok {
+				column[to] = value
+				delete(column, from)
+			}
+		}
+	}
+}
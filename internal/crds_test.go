@@ -0,0 +1,276 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestMigrateCRDs(t *testing.T) {
+	oldGV := schema.GroupVersion{Group: "old", Version: "v1"}
+	newGV := schema.GroupVersion{Group: "new", Version: "v2"}
+
+	h := newHarness(t, oldGV, newGV, nil, map[string]string{"old": "new"}, nil, nil)
+	h.migrator.migrateCRDs = true
+	h.migrator.crdShortNameMappings = map[string]string{"f": "nf"}
+
+	h.RegisterCRD(oldGV.WithResource("foo"))
+	h.AddResources(oldGV.WithResource("foo"), objectBuilder("old/v1", "Foo", "obj-1").Build())
+
+	oldCRD, err := h.migrator.sourceCRDClient.Get("foo.old", metav1.GetOptions{})
+	require.NoError(t, err)
+	oldCRD.SetAPIVersion("apiextensions.k8s.io/v1beta1")
+	oldCRD.SetKind("CustomResourceDefinition")
+	oldCRD.SetLabels(map[string]string{"old/app": "foo"})
+	oldCRD.Object["spec"] = map[string]interface{}{
+		"group":   "old",
+		"version": "v1",
+		"versions": []interface{}{
+			map[string]interface{}{"name": "v1", "served": true, "storage": true},
+		},
+		"scope": "Namespaced",
+		"names": map[string]interface{}{
+			"plural":     "foo",
+			"kind":       "Foo",
+			"shortNames": []interface{}{"f", "fo"},
+		},
+	}
+	_, err = h.migrator.sourceCRDClient.Update(oldCRD, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	// the new group/version is served once the CRD is established
+	h.discoveryClient.Resources = append(h.discoveryClient.Resources, &metav1.APIResourceList{
+		GroupVersion: newGV.String(),
+		APIResources: []metav1.APIResource{{Name: "foo", Kind: "Foo"}},
+	})
+	// reactors get a copy of the created CRD, so it's only established when
+	// it's read
+	var created *unstructured.Unstructured
+	h.dynamicClient.PrependReactor("create", "customresourcedefinitions", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		created = action.(k8stesting.CreateAction).GetObject().(*unstructured.Unstructured)
+		conditions := []interface{}{map[string]interface{}{"type": "Established", "status": "True"}}
+		require.NoError(t, unstructured.SetNestedSlice(created.Object, conditions, "status", "conditions"))
+		return false, nil, nil
+	})
+	h.dynamicClient.PrependReactor("get", "customresourcedefinitions", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if created == nil || action.(k8stesting.GetAction).GetName() != created.GetName() {
+			return false, nil, nil
+		}
+		return true, created.DeepCopy(), nil
+	})
+
+	h.migrator.MigrateAllResources()
+
+	newCRD, err := h.migrator.destCRDClient.Get("foo.new", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"new/app": "foo"}, newCRD.GetLabels())
+	assert.Equal(t, map[string]interface{}{
+		"group":   "new",
+		"version": "v2",
+		"versions": []interface{}{
+			map[string]interface{}{"name": "v2", "served": true, "storage": true},
+		},
+		"scope": "Namespaced",
+		"names": map[string]interface{}{
+			"plural":     "foo",
+			"kind":       "Foo",
+			"shortNames": []interface{}{"nf", "fo"},
+		},
+	}, newCRD.Object["spec"])
+
+	// the old CRD is unchanged
+	oldCRD, err = h.migrator.sourceCRDClient.Get("foo.old", metav1.GetOptions{})
+	require.NoError(t, err)
+	group, _, _ := unstructured.NestedString(oldCRD.Object, "spec", "group")
+	assert.Equal(t, "old", group)
+
+	items, err := h.dynamicClient.Resource(newGV.WithResource("foo")).List(metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Len(t, items.Items, 1)
+}
+
+func TestMigrateCRDsExisting(t *testing.T) {
+	oldGV := schema.GroupVersion{Group: "old", Version: "v1"}
+	newGV := schema.GroupVersion{Group: "new", Version: "v2"}
+
+	tests := []struct {
+		name        string
+		newSpec     map[string]interface{}
+		expectedErr string
+	}{
+		{
+			name: "serves the new version",
+			newSpec: map[string]interface{}{
+				"group": "new",
+				"versions": []interface{}{
+					map[string]interface{}{"name": "v2", "served": true, "storage": false},
+					map[string]interface{}{"name": "v3", "served": true, "storage": true},
+				},
+				"names": map[string]interface{}{"plural": "foo", "kind": "Foo"},
+			},
+		},
+		{
+			name: "doesn't serve the new version",
+			newSpec: map[string]interface{}{
+				"group": "new",
+				"versions": []interface{}{
+					map[string]interface{}{"name": "v2", "served": false, "storage": false},
+					map[string]interface{}{"name": "v3", "served": true, "storage": true},
+				},
+				"names": map[string]interface{}{"plural": "foo", "kind": "Foo"},
+			},
+			expectedErr: "error migrating CRDs: error migrating CRD of foo: CRD foo.new already exists but doesn't serve version v2",
+		},
+		{
+			name: "different kind",
+			newSpec: map[string]interface{}{
+				"group":   "new",
+				"version": "v2",
+				"names":   map[string]interface{}{"plural": "foo", "kind": "NewFoo"},
+			},
+			expectedErr: "error migrating CRDs: error migrating CRD of foo: CRD foo.new already exists with kind NewFoo instead of Foo",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newHarness(t, oldGV, newGV, nil, nil, nil, nil)
+			h.migrator.migrateCRDs = true
+
+			h.RegisterCRD(oldGV.WithResource("foo"))
+			h.RegisterCRD(newGV.WithResource("foo"))
+			h.AddResources(oldGV.WithResource("foo"), objectBuilder("old/v1", "Foo", "obj-1").Build())
+
+			oldCRD, err := h.migrator.sourceCRDClient.Get("foo.old", metav1.GetOptions{})
+			require.NoError(t, err)
+			oldCRD.Object["spec"] = map[string]interface{}{
+				"group":   "old",
+				"version": "v1",
+				"names":   map[string]interface{}{"plural": "foo", "kind": "Foo"},
+			}
+			_, err = h.migrator.sourceCRDClient.Update(oldCRD, metav1.UpdateOptions{})
+			require.NoError(t, err)
+
+			newCRD, err := h.migrator.destCRDClient.Get("foo.new", metav1.GetOptions{})
+			require.NoError(t, err)
+			newCRD.Object["spec"] = tc.newSpec
+			conditions := []interface{}{map[string]interface{}{"type": "Established", "status": "True"}}
+			require.NoError(t, unstructured.SetNestedSlice(newCRD.Object, conditions, "status", "conditions"))
+			_, err = h.migrator.destCRDClient.Update(newCRD, metav1.UpdateOptions{})
+			require.NoError(t, err)
+
+			_, err = h.migrator.MigrateAllResources()
+
+			items, listErr := h.dynamicClient.Resource(newGV.WithResource("foo")).List(metav1.ListOptions{})
+			require.NoError(t, listErr)
+			if tc.expectedErr != "" {
+				assert.EqualError(t, err, tc.expectedErr)
+				assert.Empty(t, items.Items)
+			} else {
+				require.NoError(t, err)
+				assert.Len(t, items.Items, 1)
+			}
+
+			// the existing CRD is never changed
+			newCRD, err = h.migrator.destCRDClient.Get("foo.new", metav1.GetOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, tc.newSpec, newCRD.Object["spec"])
+		})
+	}
+}
+
+func TestDiscoverCRDResource(t *testing.T) {
+	discoveryClient := fakeDiscovery{&fakediscovery.FakeDiscovery{Fake: new(k8stesting.Fake)}}
+
+	resource, err := discoverCRDResource(discoveryClient)
+	require.NoError(t, err)
+	assert.Equal(t, crdResourceV1beta1, resource)
+
+	discoveryClient.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: "apiextensions.k8s.io/v1",
+			APIResources: []metav1.APIResource{{Name: "customresourcedefinitions", Kind: "CustomResourceDefinition"}},
+		},
+	}
+
+	resource, err = discoverCRDResource(discoveryClient)
+	require.NoError(t, err)
+	assert.Equal(t, crdResourceV1, resource)
+}
+
+func TestConvertCRDSpec(t *testing.T) {
+	v1beta1 := func() map[string]interface{} {
+		return map[string]interface{}{
+			"group":   "old",
+			"version": "v1",
+			"names":   map[string]interface{}{"plural": "foo", "kind": "Foo"},
+			"validation": map[string]interface{}{
+				"openAPIV3Schema": map[string]interface{}{"type": "object"},
+			},
+			"subresources": map[string]interface{}{"status": map[string]interface{}{}},
+			"additionalPrinterColumns": []interface{}{
+				map[string]interface{}{"name": "Phase", "type": "string", "JSONPath": ".status.phase"},
+			},
+			"conversion": map[string]interface{}{
+				"strategy":            "Webhook",
+				"webhookClientConfig": map[string]interface{}{"url": "https://example.com"},
+			},
+		}
+	}
+
+	v1 := func() map[string]interface{} {
+		return map[string]interface{}{
+			"group": "old",
+			"names": map[string]interface{}{"plural": "foo", "kind": "Foo"},
+			"versions": []interface{}{
+				map[string]interface{}{
+					"name":    "v1",
+					"served":  true,
+					"storage": true,
+					"schema": map[string]interface{}{
+						"openAPIV3Schema": map[string]interface{}{
+							"type":                                 "object",
+							"x-kubernetes-preserve-unknown-fields": true,
+						},
+					},
+					"subresources": map[string]interface{}{"status": map[string]interface{}{}},
+					"additionalPrinterColumns": []interface{}{
+						map[string]interface{}{"name": "Phase", "type": "string", "jsonPath": ".status.phase"},
+					},
+				},
+			},
+			"conversion": map[string]interface{}{
+				"strategy": "Webhook",
+				"webhook": map[string]interface{}{
+					"clientConfig":             map[string]interface{}{"url": "https://example.com"},
+					"conversionReviewVersions": []interface{}{"v1beta1"},
+				},
+			},
+		}
+	}
+
+	spec := v1beta1()
+	convertCRDSpecToV1(spec)
+	assert.Equal(t, v1(), spec)
+
+	spec = v1()
+	convertCRDSpecToV1beta1(spec)
+	versions := spec["versions"].([]interface{})
+	columns := versions[0].(map[string]interface{})["additionalPrinterColumns"].([]interface{})
+	assert.Equal(t, ".status.phase", columns[0].(map[string]interface{})["JSONPath"])
+	assert.Equal(t, map[string]interface{}{
+		"strategy":                 "Webhook",
+		"webhookClientConfig":      map[string]interface{}{"url": "https://example.com"},
+		"conversionReviewVersions": []interface{}{"v1beta1"},
+	}, spec["conversion"])
+}
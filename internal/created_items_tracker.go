@@ -4,38 +4,78 @@
 package internal
 
 import (
+	"sync"
+
 	"github.com/sirupsen/logrus"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 )
 
+// createdItemsTracker keeps track of the UIDs of migrated ownerRef parents.
+// It is safe for concurrent use.
 type createdItemsTracker struct {
-	log                logrus.FieldLogger
-	oldGroupVersion    string
-	newGroupVersion    string
-	resourcesByKind    map[string]metav1.APIResource
-	createdItemsByKind map[string]*createdItems
+	mu  sync.RWMutex
+	log logrus.FieldLogger
+	// newGroups maps each old group whose ownerRefs are updated to its new
+	// group. A run of several group/versions shares one tracker, so that
+	// ownerRefs can point to another group.
+	newGroups map[string]string
+	// created items are tracked by their new group and kind, whatever
+	// version the ownerRefs pointing to them use, since all versions of a
+	// resource serve the same items
+	resourcesByKind    map[schema.GroupKind]metav1.APIResource
+	createdItemsByKind map[schema.GroupKind]*createdItems
 }
 
 func newCreatedItemsTracker(log logrus.FieldLogger, oldGroupVersion, newGroupVersion string) *createdItemsTracker {
-	return &createdItemsTracker{
+	c := &createdItemsTracker{
 		log:                log,
-		oldGroupVersion:    oldGroupVersion,
-		newGroupVersion:    newGroupVersion,
-		resourcesByKind:    make(map[string]metav1.APIResource),
-		createdItemsByKind: make(map[string]*createdItems),
+		newGroups:          make(map[string]string),
+		resourcesByKind:    make(map[schema.GroupKind]metav1.APIResource),
+		createdItemsByKind: make(map[schema.GroupKind]*createdItems),
 	}
+	c.addGroupVersion(oldGroupVersion, newGroupVersion)
+	return c
+}
+
+// addGroupVersion updates the ownerRefs pointing to the group of
+// oldGroupVersion to point to the items created in the group of
+// newGroupVersion as well.
+func (c *createdItemsTracker) addGroupVersion(oldGroupVersion, newGroupVersion string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.newGroups[apiGroup(oldGroupVersion)] = apiGroup(newGroupVersion)
 }
 
-func (c *createdItemsTracker) registerResource(resource metav1.APIResource) {
-	c.log.WithField("kind", resource.Kind).Debug("Registering resource for ownerRef tracking")
-	c.resourcesByKind[resource.Kind] = resource
-	c.createdItemsByKind[resource.Kind] = newCreatedItems()
+// apiGroup returns the group of an apiVersion.
+func apiGroup(apiVersion string) string {
+	gv, _ := schema.ParseGroupVersion(apiVersion)
+	return gv.Group
+}
+
+// registerResource starts tracking the items of resource that are created
+// in newGroupVersion.
+func (c *createdItemsTracker) registerResource(newGroupVersion string, resource metav1.APIResource) {
+	groupKind := schema.GroupKind{Group: apiGroup(newGroupVersion), Kind: resource.Kind}
+	c.log.WithField("kind", groupKind.String()).Debug("Registering resource for ownerRef tracking")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.resourcesByKind[groupKind] = resource
+	if _, ok := c.createdItemsByKind[groupKind]; !ok {
+		c.createdItemsByKind[groupKind] = newCreatedItems()
+	}
 }
 
 func (c *createdItemsTracker) registerCreatedItem(item *unstructured.Unstructured) {
-	byKind, ok := c.createdItemsByKind[item.GetKind()]
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	byKind, ok := c.createdItemsByKind[item.GroupVersionKind().GroupKind()]
 	if !ok {
 		c.log.WithFields(logrus.Fields{
 			"kind": item.GetKind(),
@@ -48,7 +88,61 @@ func (c *createdItemsTracker) registerCreatedItem(item *unstructured.Unstructure
 	byKind.registerCreatedItem(item)
 }
 
-func (c *createdItemsTracker) updateOwnerRefs(item *unstructured.Unstructured) {
+// trackedItems returns the UIDs of all tracked items by kind and name.
+// Kinds are qualified with the new group/version the items were created
+// in as kind.version.group, e.g. Foo.v1.example.com.
+func (c *createdItemsTracker) trackedItems() map[string]map[string]types.UID {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	out := make(map[string]map[string]types.UID)
+	for groupKind, byKind := range c.createdItemsByKind {
+		for name, info := range byKind.items {
+			gv, _ := schema.ParseGroupVersion(info.apiVersion)
+			key := groupKind.Kind + "." + gv.Version + "." + gv.Group
+			if out[key] == nil {
+				out[key] = make(map[string]types.UID)
+			}
+			out[key][name] = info.uid
+		}
+	}
+	return out
+}
+
+// restoreTrackedItems tracks the items returned by trackedItems in an
+// earlier run, so that ownerRefs pointing to them can still be updated.
+// Kinds that aren't qualified, as recorded by earlier versions, are in
+// newGroupVersion.
+func (c *createdItemsTracker) restoreTrackedItems(newGroupVersion string, items map[string]map[string]types.UID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for kind, uids := range items {
+		gvk := schema.FromAPIVersionAndKind(newGroupVersion, kind)
+		if qualified, _ := schema.ParseKindArg(kind); qualified != nil {
+			gvk = *qualified
+		}
+
+		byKind, ok := c.createdItemsByKind[gvk.GroupKind()]
+		if !ok {
+			byKind = newCreatedItems()
+			c.createdItemsByKind[gvk.GroupKind()] = byKind
+		}
+		for name, uid := range uids {
+			byKind.items[name] = itemInfo{name: name, apiVersion: gvk.GroupVersion().String(), uid: uid}
+		}
+	}
+}
+
+// updateOwnerRefs points the ownerRefs of item to the migrated owners.
+// ownerRefs that can't be updated are kept as they are, unless
+// dropUnresolved is set because item is created in another cluster, where
+// the UIDs they point to don't exist and the garbage collector would
+// delete item.
+func (c *createdItemsTracker) updateOwnerRefs(item *unstructured.Unstructured, dropUnresolved bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	var updatedOwnerRefs []metav1.OwnerReference
 	for _, ownerRef := range item.GetOwnerReferences() {
 		log := c.log.WithFields(logrus.Fields{
@@ -56,29 +150,42 @@ func (c *createdItemsTracker) updateOwnerRefs(item *unstructured.Unstructured) {
 			"ownerRef.name": ownerRef.Name,
 		})
 
-		if ownerRef.APIVersion != c.oldGroupVersion {
-			log.Debug("ownerRef's apiVersion is not the one being migrated, not updating")
+		unresolved := func(reason string) {
+			if dropUnresolved {
+				log.Warnf("Dropping ownerRef because %s, and its UID doesn't exist in the destination cluster", reason)
+				return
+			}
 			updatedOwnerRefs = append(updatedOwnerRefs, ownerRef)
+		}
+
+		newGroup, ok := c.newGroups[apiGroup(ownerRef.APIVersion)]
+		if !ok {
+			log.Debug("ownerRef's group is not one being migrated, not updating")
+			unresolved("its group is not one being migrated")
 			continue
 		}
 
-		byKind := c.createdItemsByKind[ownerRef.Kind]
+		byKind := c.createdItemsByKind[schema.GroupKind{Group: newGroup, Kind: ownerRef.Kind}]
 		if byKind == nil {
 			log.Debug("ownerRef's kind is not being tracked, not updating")
-			updatedOwnerRefs = append(updatedOwnerRefs, ownerRef)
+			unresolved("its kind is not being tracked")
 			continue
 		}
 
 		createdItem, ok := byKind.getByName(ownerRef.Name)
 		if !ok {
 			log.Warn("Unable to update ownerRef because owner was not migrated by this tool")
-			updatedOwnerRefs = append(updatedOwnerRefs, ownerRef)
+			unresolved("its owner was not migrated by this tool")
 			continue
 		}
 
 		log.Info("Updating ownerRef's apiVersion and UID")
-		ownerRef.APIVersion = c.newGroupVersion
-		ownerRef.UID = createdItem.uid
+		// the ownerRef points to the version the owner was created in
+		ownerRef.APIVersion = createdItem.apiVersion
+		// manifests converted without a cluster may not have a UID
+		if createdItem.uid != "" {
+			ownerRef.UID = createdItem.uid
+		}
 
 		updatedOwnerRefs = append(updatedOwnerRefs, ownerRef)
 	}
@@ -106,13 +213,15 @@ func (c *createdItems) getByName(name string) (itemInfo, bool) {
 }
 
 type itemInfo struct {
-	name string
-	uid  types.UID
+	name       string
+	apiVersion string
+	uid        types.UID
 }
 
 func newItemInfo(item *unstructured.Unstructured) itemInfo {
 	return itemInfo{
-		name: item.GetName(),
-		uid:  item.GetUID(),
+		name:       item.GetName(),
+		apiVersion: item.GetAPIVersion(),
+		uid:        item.GetUID(),
 	}
 }
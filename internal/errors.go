@@ -0,0 +1,74 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInterrupted is returned when a migration is stopped before it has
+// completed.
+var ErrInterrupted = errors.New("migration interrupted")
+
+// PreflightError is returned when a command can't start, because of its
+// options or because the clusters aren't in a state it can work with. No
+// item has been migrated when it's returned.
+type PreflightError struct {
+	err error
+}
+
+func preflightError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PreflightError{err: err}
+}
+
+func preflightErrorf(format string, args ...interface{}) error {
+	return &PreflightError{err: errors.Errorf(format, args...)}
+}
+
+func (e *PreflightError) Error() string {
+	return e.err.Error()
+}
+
+// Cause returns the underlying error, for errors.Cause.
+func (e *PreflightError) Cause() error {
+	return e.err
+}
+
+// IsPreflightError returns whether err is, or wraps, a *PreflightError.
+func IsPreflightError(err error) bool {
+	for err != nil {
+		if _, ok := err.(*PreflightError); ok {
+			return true
+		}
+		causer, ok := err.(interface{ Cause() error })
+		if !ok {
+			return false
+		}
+		err = causer.Cause()
+	}
+	return false
+}
+
+// PartialFailureError is returned when a command ran to the end, but some
+// items or resources couldn't be migrated. Each error has already been
+// logged when it happened.
+type PartialFailureError struct {
+	// Errors are the errors of the failed items and resources, in the
+	// order they happened.
+	Errors []error
+}
+
+func (e *PartialFailureError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("%d error(s) during migration: %s", len(e.Errors), strings.Join(messages, "; "))
+}
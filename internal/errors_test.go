@@ -0,0 +1,86 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestMigrateAllResourcesErrors(t *testing.T) {
+	oldGV := schema.GroupVersion{Group: "old", Version: "v1"}
+	newGV := schema.GroupVersion{Group: "new", Version: "v1"}
+
+	setup := func() *migratorHarness {
+		h := newHarness(t, oldGV, newGV, nil, nil, nil, nil)
+		h.RegisterCRD(oldGV.WithResource("foo"))
+		h.AddResources(oldGV.WithResource("foo"),
+			objectBuilder("old/v1", "Foo", "obj-1").Namespace("ns-1").Build(),
+			objectBuilder("old/v1", "Foo", "obj-2").Namespace("ns-1").Build(),
+		)
+		return h
+	}
+
+	t.Run("success", func(t *testing.T) {
+		h := setup()
+		h.RegisterCRD(newGV.WithResource("foo"))
+
+		_, err := h.migrator.MigrateAllResources()
+		assert.NoError(t, err)
+	})
+
+	t.Run("preflight", func(t *testing.T) {
+		// the new group/version isn't served
+		h := setup()
+
+		_, err := h.migrator.MigrateAllResources()
+		assert.True(t, IsPreflightError(err))
+		assert.EqualError(t, err, "new group version new/v1 is not served by the destination cluster")
+	})
+
+	t.Run("partial failure", func(t *testing.T) {
+		h := setup()
+		h.RegisterCRD(newGV.WithResource("foo"))
+		h.dynamicClient.PrependReactor("create", "foo", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			if action.(k8stesting.CreateAction).GetObject().(*unstructured.Unstructured).GetName() == "obj-1" {
+				return true, nil, errors.New("quota exceeded")
+			}
+			return false, nil, nil
+		})
+
+		report, err := h.migrator.MigrateAllResources()
+		assert.Len(t, report.Resources[0].Failed, 1)
+		require.IsType(t, &PartialFailureError{}, err)
+		assert.Len(t, err.(*PartialFailureError).Errors, 1)
+		assert.EqualError(t, err, "1 error(s) during migration: foo ns-1/obj-1: quota exceeded")
+		assert.False(t, IsPreflightError(err))
+	})
+
+	t.Run("interrupted", func(t *testing.T) {
+		h := setup()
+		h.RegisterCRD(newGV.WithResource("foo"))
+		h.migrator.stop = make(chan struct{})
+		h.migrator.Stop()
+
+		report, err := h.migrator.MigrateAllResources()
+		assert.Equal(t, ErrInterrupted, err)
+		assert.True(t, report.Interrupted)
+	})
+}
+
+func TestIsPreflightError(t *testing.T) {
+	err := preflightErrorf("invalid --workers %d", 0)
+	assert.True(t, IsPreflightError(err))
+	assert.True(t, IsPreflightError(errors.Wrap(err, "error configuring migration")))
+	assert.False(t, IsPreflightError(errors.New("invalid --workers 0")))
+	assert.False(t, IsPreflightError(nil))
+	assert.Nil(t, preflightError(nil))
+}
@@ -0,0 +1,277 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// A run of several group/versions, set up with --group-versions, migrates
+// the resources of all of them in one order, so that the items of a
+// parent in one group are created before its children in another. Each
+// group/version has its own migrator, and they share the tracker of
+// created items, so that ownerRefs pointing to any of the old
+// group/versions are updated.
+//
+// Resources of different groups can have the same name, so in such a run
+// --update-owner-refs and the run report name resources qualified by their
+// old group, e.g. foos.example.com, and the checkpoint by their old
+// group/version, e.g. foos.v1.example.com.
+//
+// A group without a version is also migrated by a run of several
+// group/versions, if its resources are read at different versions.
+
+// addGroups sets up m to run the group/versions of --group-versions along
+// with --from and --to. onlyReadAt are the resources read at each old
+// group/version resolved from a group without a version.
+func (m *Migrator) addGroups(options Options, env Environment, onlyReadAt map[string]stringSet) error {
+	mappings := append([]string{options.OldGroupVersion + ":" + options.NewGroupVersion}, options.GroupVersionMappings...)
+	oldGroups := make(stringSet)
+
+	for _, mapping := range mappings {
+		from, to, err := splitGroupVersionMapping(mapping)
+		if err != nil {
+			return preflightError(err)
+		}
+
+		groupOptions := options
+		groupOptions.OldGroupVersion = from
+		groupOptions.NewGroupVersion = to
+		groupOptions.GroupVersionMappings = nil
+		groupOptions.VersionMappings = nil
+		groupOptions.UpdateOwnerRefMappings = nil
+		// the report of the whole run is written by m, which also records
+		// the checkpoint of all group/versions
+		groupOptions.ReportFile = ""
+		groupOptions.Checkpoint = ""
+		groupOptions.Resume = false
+
+		g, err := NewMigratorForEnvironment(groupOptions, env)
+		if err != nil {
+			return errors.Wrapf(err, "error setting up migration of %s", from)
+		}
+		oldGroups.add(g.oldGroupVersion.Group)
+
+		m.createdItemsTracker.addGroupVersion(g.oldGroupVersion.String(), g.newGroupVersion.String())
+		g.log = m.log.WithField("groupVersion", g.oldGroupVersion.String())
+		g.createdItemsTracker = m.createdItemsTracker
+		g.journal = m.journal
+		g.checkpoint = m.checkpoint
+		g.printer = m.printer
+		g.stop = m.stop
+		g.separateClusters = m.separateClusters
+		g.inGroupRun = true
+		g.ownerRefParents = make(stringSet)
+		g.onlyResources = onlyReadAt[g.oldGroupVersion.String()]
+
+		m.groups = append(m.groups, g)
+	}
+
+	// --update-owner-refs has been parsed by NewMigratorForEnvironment.
+	// With one old group, e.g. read at several versions, names don't need
+	// to be qualified.
+	qualify := func(name string) string {
+		if len(oldGroups) == 1 && !strings.Contains(name, ".") {
+			return name + "." + m.groups[0].oldGroupVersion.Group
+		}
+		return name
+	}
+
+	m.groupOwnerRefs = make(map[string]string)
+	for parent, child := range m.updateOwnerRefMappings {
+		parent, child = qualify(parent), qualify(child)
+		for _, name := range []string{parent, child} {
+			if _, _, ok := m.groupOf(name); !ok {
+				return preflightErrorf("resource %q from --update-owner-refs must be qualified by the old group of one of the group-versions, e.g. foos.example.com", name)
+			}
+		}
+
+		g, resource, _ := m.groupOf(parent)
+		g.ownerRefParents.add(resource)
+		m.groupOwnerRefs[parent] = child
+	}
+	m.updateOwnerRefMappings = nil
+
+	return nil
+}
+
+// groupOf returns the migrator of a resource name qualified by its old
+// group, and the unqualified name. If the group is read at several
+// versions, it's the migrator of the version the resource is read at.
+func (m *Migrator) groupOf(qualified string) (*Migrator, string, bool) {
+	parts := strings.SplitN(qualified, ".", 2)
+	if len(parts) != 2 {
+		return nil, "", false
+	}
+
+	var found *Migrator
+	for _, g := range m.groups {
+		if g.oldGroupVersion.Group != parts[1] {
+			continue
+		}
+		if g.onlyResources.has(parts[0]) {
+			return g, parts[0], true
+		}
+		if found == nil {
+			found = g
+		}
+	}
+	return found, parts[0], found != nil
+}
+
+// reportName returns the name a resource is reported by, which is
+// qualified by its old group in a run of several group/versions.
+func (m *Migrator) reportName(resource string) string {
+	if m.inGroupRun {
+		return resource + "." + m.oldGroupVersion.Group
+	}
+	return resource
+}
+
+// checkpointKey returns the name a resource is recorded by in the
+// checkpoint, which is qualified by its old group/version in a run of
+// several group/versions.
+func (m *Migrator) checkpointKey(resource string) string {
+	if m.inGroupRun {
+		return resource + "." + m.oldGroupVersion.Version + "." + m.oldGroupVersion.Group
+	}
+	return resource
+}
+
+// groupResource is a resource of one of the group/versions of a run.
+type groupResource struct {
+	migrator *Migrator
+	resource metav1.APIResource
+}
+
+// migrateAllGroups migrates the resources of all group/versions of a run,
+// like migrateAllResources does for one.
+func (m *Migrator) migrateAllGroups() error {
+	for _, g := range m.groups {
+		g.recorder = m.recorder
+	}
+
+	if m.migrateCRDs {
+		for _, g := range m.groups {
+			if err := g.migrateAllCRDs(); err != nil {
+				if err == ErrInterrupted {
+					m.logInterrupted()
+					return err
+				}
+				return preflightError(errors.Wrapf(err, "error migrating CRDs of %s", g.oldGroupVersion))
+			}
+		}
+	}
+
+	for _, g := range m.groups {
+		if err := g.checkDestination(); err != nil {
+			return preflightError(err)
+		}
+	}
+
+	resources, err := m.discoverGroupResources()
+	if err != nil {
+		return preflightError(err)
+	}
+
+	for _, r := range resources {
+		if m.stopped() {
+			break
+		}
+
+		r.migrator.registerIfParent(r.resource)
+		r.migrator.migrateOneResource(r.resource)
+	}
+
+	return m.runError()
+}
+
+// discoverGroupResources returns the resources of all group/versions of a
+// run that can be migrated, in the order they need to be migrated: the
+// resources from --update-owner-refs first, parents before children,
+// followed by the remaining resources of each group/version in turn.
+func (m *Migrator) discoverGroupResources() ([]groupResource, error) {
+	type discovered struct {
+		resources []metav1.APIResource
+		skipped   []skippedResource
+	}
+
+	var (
+		all       = make(map[*Migrator]discovered)
+		candidate []metav1.APIResource
+		known     = make(stringSet)
+	)
+
+	for _, g := range m.groups {
+		resources, skipped, err := g.discoverResources()
+		if err != nil {
+			return nil, errors.Wrapf(err, "error discovering resources of %s to migrate", g.oldGroupVersion)
+		}
+		all[g] = discovered{resources, skipped}
+
+		candidate = append(candidate, resources...)
+		for _, resource := range resources {
+			known.add(g.reportName(resource.Name))
+		}
+		for _, s := range skipped {
+			if s.unselected {
+				candidate = append(candidate, s.resource)
+				known.add(g.reportName(s.resource.Name))
+			}
+		}
+	}
+
+	// the patterns apply to every group, and each has to match somewhere
+	if err := m.checkPatterns(candidate); err != nil {
+		return nil, err
+	}
+
+	priorities, err := calculateResourcePriorities(m.groupOwnerRefs)
+	if err != nil {
+		return nil, errors.New("--update-owner-refs contains a cycle")
+	}
+	for _, name := range priorities {
+		if !known.has(name) {
+			return nil, errors.Errorf("unable to find resource %q from --update-owner-refs", name)
+		}
+	}
+
+	var (
+		ordered  []groupResource
+		selected = make(map[string]groupResource)
+	)
+
+	for _, g := range m.groups {
+		if err := g.printResourceTable(all[g].resources, all[g].skipped); err != nil {
+			return nil, errors.Wrap(err, "error printing resources to migrate")
+		}
+		if err := g.trackUnselectedParents(all[g].skipped); err != nil {
+			return nil, errors.Wrap(err, "error tracking unselected parent resources")
+		}
+
+		for _, resource := range all[g].resources {
+			selected[g.reportName(resource.Name)] = groupResource{g, resource}
+		}
+	}
+
+	for _, name := range priorities {
+		if r, ok := selected[name]; ok {
+			ordered = append(ordered, r)
+			delete(selected, name)
+		}
+	}
+
+	for _, g := range m.groups {
+		for _, resource := range all[g].resources {
+			if r, ok := selected[g.reportName(resource.Name)]; ok {
+				ordered = append(ordered, r)
+			}
+		}
+	}
+
+	return ordered, nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestMigrateAllGroups(t *testing.T) {
+	oldA := schema.GroupVersion{Group: "a.example.com", Version: "v1"}
+	newA := schema.GroupVersion{Group: "a.example.io", Version: "v1"}
+	oldB := schema.GroupVersion{Group: "b.example.com", Version: "v1"}
+	newB := schema.GroupVersion{Group: "b.example.io", Version: "v1"}
+
+	h := newHarness(t, oldB, newB, nil, nil, nil, nil)
+	for _, gv := range []schema.GroupVersion{oldA, newA, oldB, newB} {
+		h.RegisterCRD(gv.WithResource("bar"))
+	}
+	h.RegisterCRD(oldB.WithResource("foo"))
+	h.RegisterCRD(newB.WithResource("foo"))
+
+	// both groups have a Bar obj-1, and the foos of one group are owned by
+	// the bars of the other
+	h.AddResources(oldA.WithResource("bar"), objectBuilder(oldA.String(), "Bar", "obj-1").UID("a-uid").Build())
+	h.AddResources(oldB.WithResource("bar"), objectBuilder(oldB.String(), "Bar", "obj-1").UID("b-uid").Build())
+	h.AddResources(oldB.WithResource("foo"),
+		objectBuilder(oldB.String(), "Foo", "obj-1").OwnerRef(oldA.String(), "Bar", "obj-1").Build(),
+		objectBuilder(oldB.String(), "Foo", "obj-2").OwnerRef(oldB.String(), "Bar", "obj-1").Build(),
+	)
+
+	options := Options{
+		OldGroupVersion:        oldB.String(),
+		NewGroupVersion:        newB.String(),
+		GroupVersionMappings:   []string{oldA.String() + ":" + newA.String()},
+		UpdateOwnerRefMappings: []string{"bar.a.example.com:foo.b.example.com"},
+		Workers:                1,
+		OnConflict:             "skip",
+	}
+	env := Environment{
+		SourceDynamicClient:   h.dynamicClient,
+		SourceDiscoveryClient: h.discoveryClient,
+		Log:                   discardLogger(),
+	}
+
+	m, err := NewMigratorForEnvironment(options, env)
+	require.NoError(t, err)
+
+	report, err := m.MigrateAllResources()
+	require.NoError(t, err)
+
+	assert.Equal(t, "b.example.com/v1,a.example.com/v1", report.OldGroupVersion)
+	assert.Equal(t, "b.example.io/v1,a.example.io/v1", report.NewGroupVersion)
+	var names []string
+	for _, resource := range report.Resources {
+		names = append(names, resource.Name)
+	}
+	// the parents in group a are migrated before their children in group b
+	assert.Equal(t, []string{"bar.a.example.com", "foo.b.example.com", "bar.b.example.com"}, names)
+
+	foos, err := h.dynamicClient.Resource(newB.WithResource("foo")).List(metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, foos.Items, 2)
+
+	assert.Equal(t, []metav1.OwnerReference{{APIVersion: newA.String(), Kind: "Bar", Name: "obj-1", UID: types.UID("a-uid")}}, foos.Items[0].GetOwnerReferences())
+	// the bars of group b aren't parents
+	assert.Equal(t, []metav1.OwnerReference{{APIVersion: oldB.String(), Kind: "Bar", Name: "obj-1"}}, foos.Items[1].GetOwnerReferences())
+
+	for _, test := range []struct {
+		name    string
+		options func(*Options)
+		err     string
+	}{
+		{
+			name:    "unqualified owner ref",
+			options: func(o *Options) { o.UpdateOwnerRefMappings = []string{"bar:foo"} },
+			err:     `resource "bar" from --update-owner-refs must be qualified by the old group of one of the group-versions, e.g. foos.example.com`,
+		},
+		{
+			name:    "group migrated twice",
+			options: func(o *Options) { o.GroupVersionMappings = []string{"b.example.com/v2:b.example.io/v2"} },
+			err:     "group b.example.com is migrated more than once",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			invalid := options
+			test.options(&invalid)
+
+			_, err := NewMigratorForEnvironment(invalid, env)
+			assert.True(t, IsPreflightError(err))
+			assert.EqualError(t, err, test.err)
+		})
+	}
+}
+
+func TestMigrateAllGroupsResumesFromCheckpoint(t *testing.T) {
+	oldA := schema.GroupVersion{Group: "a.example.com", Version: "v1"}
+	newA := schema.GroupVersion{Group: "a.example.io", Version: "v1"}
+	oldB := schema.GroupVersion{Group: "b.example.com", Version: "v1"}
+	newB := schema.GroupVersion{Group: "b.example.io", Version: "v1"}
+
+	dir, err := ioutil.TempDir("", "checkpoint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	h := newHarness(t, oldB, newB, nil, nil, nil, nil)
+	for _, gv := range []schema.GroupVersion{oldA, newA, oldB, newB} {
+		h.RegisterCRD(gv.WithResource("bar"))
+	}
+	h.AddResources(oldA.WithResource("bar"), objectBuilder(oldA.String(), "Bar", "obj-1").Build())
+	h.AddResources(oldB.WithResource("bar"), objectBuilder(oldB.String(), "Bar", "obj-1").Build())
+
+	// the bars of group a were completed by an earlier run, and those of
+	// group b, which have the same name, weren't
+	path := filepath.Join(dir, "checkpoint.json")
+	c := newCheckpoint(path, oldB.String(), newB.String())
+	c.completePage("bar.v1.a.example.com", "")
+	require.NoError(t, c.save(h.migrator.createdItemsTracker))
+
+	m, err := NewMigratorForEnvironment(Options{
+		OldGroupVersion:      oldB.String(),
+		NewGroupVersion:      newB.String(),
+		GroupVersionMappings: []string{oldA.String() + ":" + newA.String()},
+		Checkpoint:           path,
+		Resume:               true,
+		Workers:              1,
+		OnConflict:           "skip",
+	}, Environment{
+		SourceDynamicClient:   h.dynamicClient,
+		SourceDiscoveryClient: h.discoveryClient,
+		Log:                   discardLogger(),
+	})
+	require.NoError(t, err)
+
+	_, err = m.MigrateAllResources()
+	require.NoError(t, err)
+
+	barsA, err := h.dynamicClient.Resource(newA.WithResource("bar")).List(metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, barsA.Items)
+
+	barsB, err := h.dynamicClient.Resource(newB.WithResource("bar")).List(metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Len(t, barsB.Items, 1)
+
+	loaded, err := loadCheckpoint(path, oldB.String(), newB.String())
+	require.NoError(t, err)
+	assert.True(t, loaded.isResourceCompleted("bar.v1.b.example.com"))
+	assert.False(t, loaded.isResourceCompleted("bar"))
+}
@@ -0,0 +1,247 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// JournalEntry is an item that was created, or updated with
+// --on-conflict=merge, by a migration run.
+type JournalEntry struct {
+	Group     string    `json:"group"`
+	Version   string    `json:"version"`
+	Resource  string    `json:"resource"`
+	Namespace string    `json:"namespace,omitempty"`
+	Name      string    `json:"name"`
+	UID       types.UID `json:"uid"`
+	// Updated is set for items that already existed, which are not
+	// deleted by a rollback.
+	Updated bool `json:"updated,omitempty"`
+	// MigratedContent is the content an item was migrated with using
+	// --on-conflict=merge, which is the base of the merge when it's
+	// migrated again.
+	MigratedContent map[string]interface{} `json:"migratedContent,omitempty"`
+}
+
+// journal records every item created by a migration run, one JSON entry
+// per line, so that the run can be rolled back. Items that already
+// existed are only recorded when they're merged, for their migrated
+// content. The file is only created once the first item is recorded. A
+// nil *journal records nothing. It is safe for concurrent use.
+type journal struct {
+	mu    sync.Mutex
+	log   logrus.FieldLogger
+	path  string
+	runID string
+}
+
+// newRunID returns an ID for a migration run that sorts by the time the
+// run was started.
+func newRunID() string {
+	return fmt.Sprintf("%s-%d", time.Now().UTC().Format("20060102T150405Z"), os.Getpid())
+}
+
+func journalPath(dir, runID string) string {
+	return filepath.Join(dir, runID+".jsonl")
+}
+
+func newJournal(log logrus.FieldLogger, dir, runID string) *journal {
+	return &journal{
+		log:   log,
+		path:  journalPath(dir, runID),
+		runID: runID,
+	}
+}
+
+// record appends an entry for item, which was created in gvr, to the
+// journal, with the content it was migrated with if it was migrated with
+// --on-conflict=merge. The file is synced before returning so that no
+// created item is lost if the process is killed.
+func (j *journal) record(gvr schema.GroupVersionResource, item *unstructured.Unstructured, content map[string]interface{}) error {
+	return j.write(journalEntry(gvr, item, content))
+}
+
+// recordUpdate appends an entry for item, which already existed in gvr
+// and was updated with --on-conflict=merge, to the journal.
+func (j *journal) recordUpdate(gvr schema.GroupVersionResource, item *unstructured.Unstructured, content map[string]interface{}) error {
+	entry := journalEntry(gvr, item, content)
+	entry.Updated = true
+	return j.write(entry)
+}
+
+func journalEntry(gvr schema.GroupVersionResource, item *unstructured.Unstructured, content map[string]interface{}) JournalEntry {
+	return JournalEntry{
+		Group:           gvr.Group,
+		Version:         gvr.Version,
+		Resource:        gvr.Resource,
+		Namespace:       item.GetNamespace(),
+		Name:            item.GetName(),
+		UID:             item.GetUID(),
+		MigratedContent: content,
+	}
+}
+
+func (j *journal) write(entry JournalEntry) error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := os.Stat(j.path); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(j.path), 0755); err != nil {
+			return errors.WithStack(err)
+		}
+		j.log.WithFields(logrus.Fields{"run": j.runID, "journal": j.path}).Info("Recording created items, use rollback --run to delete them")
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(f.Sync())
+}
+
+// ReadJournal reads the items created or merged by run runID from the
+// journal in dir, in the order they were recorded.
+func ReadJournal(dir, runID string) ([]JournalEntry, error) {
+	entries, err := readJournalFile(journalPath(dir, runID))
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil, errors.Errorf("no journal for run %q in %s", runID, dir)
+	}
+	return entries, err
+}
+
+// readMigratedContents reads the content items were migrated with using
+// --on-conflict=merge from all the journals in dir, by checksum.
+func readMigratedContents(dir string) (map[string]map[string]interface{}, error) {
+	paths, err := filepath.Glob(journalPath(dir, "*"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	contents := make(map[string]map[string]interface{})
+	for _, path := range paths {
+		entries, err := readJournalFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.MigratedContent != nil {
+				contents[migratedContentChecksum(entry.MigratedContent)] = entry.MigratedContent
+			}
+		}
+	}
+
+	return contents, nil
+}
+
+func readJournalFile(path string) ([]JournalEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	var entries []JournalEntry
+	decoder := json.NewDecoder(f)
+	for decoder.More() {
+		var entry JournalEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return nil, errors.Wrapf(err, "error parsing journal %s", path)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// Rollback deletes the items created by run runID from the destination
+// cluster, in the reverse order they were created in, so that children
+// are deleted before their parents. Only the exact items that were created
+// are deleted: items that have since been deleted, or deleted and
+// recreated with a different UID, are skipped. Deletes don't cascade, so
+// that items that the run skipped are never garbage collected. Merged
+// items that already existed are left as they are.
+func (m *Migrator) Rollback(runID string) error {
+	recorded, err := ReadJournal(m.journalDir, runID)
+	if err != nil {
+		return err
+	}
+
+	var entries []JournalEntry
+	for _, entry := range recorded {
+		if !entry.Updated {
+			entries = append(entries, entry)
+		}
+	}
+
+	m.log.WithFields(logrus.Fields{"run": runID, "count": len(entries)}).Info("Rolling back migration run")
+
+	orphan := metav1.DeletePropagationOrphan
+	failed := 0
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		if m.stopped() {
+			return ErrInterrupted
+		}
+
+		entry := entries[i]
+		gvr := schema.GroupVersionResource{Group: entry.Group, Version: entry.Version, Resource: entry.Resource}
+		client := clientForItem(m.destDynamicClient.Resource(gvr), entry.Namespace)
+		log := m.log.WithFields(logrus.Fields{
+			"resource": gvr.GroupResource().String(),
+			"id":       itemID(entry.Namespace, entry.Name),
+		})
+
+		log.Info("Deleting item")
+		uid := entry.UID
+		err := client.Delete(entry.Name, &metav1.DeleteOptions{
+			Preconditions:     &metav1.Preconditions{UID: &uid},
+			PropagationPolicy: &orphan,
+		})
+		switch {
+		case err == nil:
+		case apierrors.IsNotFound(err):
+			log.Warn("Item no longer exists - skipping")
+		case apierrors.IsConflict(err):
+			log.Warn("Item was replaced since it was created - skipping")
+		default:
+			log.WithError(err).Error("Unable to delete item")
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return errors.Errorf("unable to delete %d item(s)", failed)
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestRollback(t *testing.T) {
+	oldGV := schema.GroupVersion{Group: "old", Version: "v1"}
+	newGV := schema.GroupVersion{Group: "new", Version: "v1"}
+
+	dir, err := ioutil.TempDir("", "journal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	h := newHarness(t, oldGV, newGV, nil, nil, nil, map[string]string{"bar": "foo"})
+	h.migrator.journal = newJournal(h.migrator.log, dir, "test-run")
+	h.migrator.journalDir = dir
+
+	h.RegisterCRD(oldGV.WithResource("foo"))
+	h.AddResources(oldGV.WithResource("foo"),
+		objectBuilder("old/v1", "Foo", "obj-1").Namespace("ns-1").OwnerRef("old/v1", "Bar", "obj-1").Build(),
+		objectBuilder("old/v1", "Foo", "obj-2").Namespace("ns-1").Build(),
+	)
+	h.RegisterCRD(oldGV.WithResource("bar"))
+	h.AddResources(oldGV.WithResource("bar"),
+		objectBuilder("old/v1", "Bar", "obj-1").Namespace("ns-1").Build(),
+	)
+	h.RegisterCRD(newGV.WithResource("foo"))
+	h.RegisterCRD(newGV.WithResource("bar"))
+	// already exists, so it's skipped and must survive the rollback
+	h.AddResources(newGV.WithResource("foo"),
+		objectBuilder("new/v1", "Foo", "obj-2").Namespace("ns-1").Build(),
+	)
+
+	h.migrator.MigrateAllResources()
+
+	entries, err := ReadJournal(dir, "test-run")
+	require.NoError(t, err)
+	assert.Equal(t, []JournalEntry{
+		{Group: "new", Version: "v1", Resource: "bar", Namespace: "ns-1", Name: "obj-1"},
+		{Group: "new", Version: "v1", Resource: "foo", Namespace: "ns-1", Name: "obj-1"},
+	}, entries)
+
+	require.NoError(t, h.migrator.Rollback("test-run"))
+
+	bars, err := h.dynamicClient.Resource(newGV.WithResource("bar")).List(metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, bars.Items)
+
+	foos, err := h.dynamicClient.Resource(newGV.WithResource("foo")).List(metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, foos.Items, 1)
+	assert.Equal(t, "obj-2", foos.Items[0].GetName())
+
+	_, err = ReadJournal(dir, "other-run")
+	assert.EqualError(t, err, `no journal for run "other-run" in `+dir)
+}
@@ -5,15 +5,27 @@ package internal
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"path"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/rest"
@@ -26,67 +38,507 @@ type Options struct {
 	LogLevel               string
 	Kubeconfig             string
 	Context                string
+	SourceKubeconfig       string
+	SourceContext          string
+	DestKubeconfig         string
+	DestContext            string
 	OldGroupVersion        string
 	NewGroupVersion        string
+	GroupVersionMappings   []string
+	VersionMappings        []string
 	QPS                    float32
 	Burst                  int
 	NamespaceMappings      []string
 	LabelMappings          []string
 	AnnotationMappings     []string
 	UpdateOwnerRefMappings []string
+	DryRun                 bool
+	Output                 string
+	Checkpoint             string
+	Resume                 bool
+	PageSize               int64
+	ReportNewItems         bool
+	Workers                int
+	JournalDir             string
+	MigrateCRDs            bool
+	CRDTimeout             time.Duration
+	CRDShortNameMappings   []string
+	CRDCategoryMappings    []string
+	Resources              []string
+	ExcludeResources       []string
+	Selector               string
+	FieldSelector          string
+	Namespaces             []string
+	ExcludeNamespaces      []string
+	OptOutAnnotation       string
+	OnConflict             string
+	ResourceSettings       []ResourceSettings
+	Transforms             []Transform
+	ReportFile             string
+	ReportFormat           string
+	// OneVersion resolves groups without a version in --from and --to to
+	// one group/version each, for the commands other than migrate, which
+	// can't run several group/versions.
+	OneVersion bool
+	// Restore is set for restoring a snapshot of the old group/version,
+	// which isn't looked up in the source cluster, where it may no longer
+	// exist.
+	Restore bool
+}
+
+// ResourceSettings override options for the resources matching a glob
+// pattern. They're set in a config file.
+type ResourceSettings struct {
+	Resources string
+	// OnConflict overrides Options.OnConflict.
+	OnConflict string
+}
+
+// Transform is a JSON patch (RFC 6902) applied to the items of the
+// resources matching a glob pattern as they're migrated. It's set in a
+// config file.
+type Transform struct {
+	Resources string
+	// Patch is the JSON encoding of the list of operations.
+	Patch []byte
+}
+
+// resourceSettings are ResourceSettings that have been validated.
+type resourceSettings struct {
+	pattern    string
+	onConflict conflictStrategy
 }
 
 // Migrator can copy CRD instances from one API group to
 // another.
 type Migrator struct {
-	log                    logrus.FieldLogger
-	discoveryClient        discovery.ServerResourcesInterface
-	dynamicClient          dynamic.Interface
+	log                   logrus.FieldLogger
+	sourceDiscoveryClient discovery.ServerResourcesInterface
+	sourceDynamicClient   dynamic.Interface
+	sourceCRDClient       dynamic.ResourceInterface
+	destDiscoveryClient   discovery.ServerResourcesInterface
+	destDynamicClient     dynamic.Interface
+	destCRDClient         dynamic.ResourceInterface
+	destCRDResource       schema.GroupVersionResource
+	// separateClusters is set if items are created in another cluster than
+	// the one they are read from
+	separateClusters bool
+	// out is where tables and summaries for the user are written
+	out                    io.Writer
+	outMu                  sync.Mutex
 	oldGroupVersion        schema.GroupVersion
 	newGroupVersion        schema.GroupVersion
-	crdClient              dynamic.ResourceInterface
 	namespaceMappings      map[string]string
 	labelMappings          map[string]string
 	annotationMappings     map[string]string
 	updateOwnerRefMappings map[string]string
 	createdItemsTracker    *createdItemsTracker
+	dryRun                 bool
+	printer                *itemPrinter
+	checkpoint             *checkpoint
+	stop                   chan struct{}
+	stopOnce               sync.Once
+	pageSize               int64
+	reportNewItems         bool
+	workers                int
+	journal                *journal
+	journalDir             string
+	migrateCRDs            bool
+	crdEstablishedTimeout  time.Duration
+	crdShortNameMappings   map[string]string
+	crdCategoryMappings    map[string]string
+	includeResources       []string
+	excludeResources       []string
+	labelSelector          string
+	fieldSelector          string
+	namespaces             []string
+	excludeNamespaces      stringSet
+	optOutAnnotation       string
+	onConflict             conflictStrategy
+	resourceSettings       []resourceSettings
+	transforms             []transform
+	reportFile             string
+	reportFormat           string
+	reportItems            bool
+	recorder               *runRecorder
+	observer               Observer
+	// mergeBases are the contents items were migrated with using
+	// --on-conflict=merge, by checksum, read from the journals in
+	// journalDir when the first item is merged. See conflicts.go.
+	mergeBasesMu sync.Mutex
+	mergeBases   map[string]map[string]interface{}
+	// groups are the migrators of the group/versions of a run of several,
+	// which this one runs. See groups.go.
+	groups []*Migrator
+	// groupOwnerRefs are the --update-owner-refs of a run of several
+	// group/versions, with resource names qualified by their old group.
+	groupOwnerRefs map[string]string
+	// inGroupRun is set on all migrators of a run of several group/versions
+	inGroupRun bool
+	// ownerRefParents are the resources of a migrator in a run of several
+	// group/versions that are parents in groupOwnerRefs
+	ownerRefParents stringSet
+	// onlyResources are the resources read at the old version of a
+	// migrator in a run of groups without versions; see versions.go
+	onlyResources stringSet
+}
+
+// pageHandler processes a page of listed items. next is the continue
+// token of the following page, or empty if this is the last page.
+type pageHandler func(items []unstructured.Unstructured, next string) error
+
+// dryRunUID stands in for the UID the API server would assign to an
+// item on create, so that rendered children show which ownerRefs
+// would be rewritten.
+const dryRunUID = types.UID("<assigned-on-create>")
+
+// Environment is what a Migrator works with: the clients of the source
+// and destination clusters, and where it logs and writes its output.
+type Environment struct {
+	SourceDynamicClient   dynamic.Interface
+	SourceDiscoveryClient discovery.ServerResourcesInterface
+	// DestDynamicClient and DestDiscoveryClient default to the source
+	// clients, for migrations within one cluster.
+	DestDynamicClient   dynamic.Interface
+	DestDiscoveryClient discovery.ServerResourcesInterface
+	// SeparateClusters is set if the destination clients are of another
+	// cluster than the source clients, rather than of the same cluster,
+	// e.g. with other credentials. ownerRefs to owners that aren't
+	// migrated are then dropped, since their UIDs don't exist in the
+	// destination cluster.
+	SeparateClusters bool
+	// Log defaults to a logger at Options.LogLevel that writes to stderr.
+	Log logrus.FieldLogger
+	// Out is where tables, summaries and diffs for the user are written.
+	// It defaults to discarding them.
+	Out io.Writer
+	// DryRunOut is where the items rendered by a dry run are written. It
+	// defaults to stdout.
+	DryRunOut io.Writer
+	// Observer, if set, receives the events of every migration run.
+	Observer Observer
 }
 
 // NewMigrator constructs and returns a *Migrator from
-// the provided options.
-func NewMigrator(options Options) *Migrator {
-	log := newLogger(options.LogLevel)
+// the provided options. The returned error is a *PreflightError if the
+// options are invalid or the clusters can't be reached.
+func NewMigrator(options Options) (*Migrator, error) {
+	// in dry-run mode stdout is reserved for the rendered items
+	logOut := io.Writer(os.Stdout)
+	if options.DryRun {
+		logOut = os.Stderr
+	}
+
+	env := Environment{
+		Log:       newLogger(options.LogLevel, logOut),
+		Out:       logOut,
+		DryRunOut: os.Stdout,
+	}
+
+	// items are read from the source cluster and created in the destination
+	// cluster, which both default to --kubeconfig and --context
+	sourceConfig, err := newRestConfig(firstNonEmpty(options.SourceKubeconfig, options.Kubeconfig), firstNonEmpty(options.SourceContext, options.Context))
+	if err != nil {
+		return nil, preflightError(errors.Wrap(err, "error loading kubeconfig of source cluster"))
+	}
+	sourceConfig.QPS = options.QPS
+	sourceConfig.Burst = options.Burst
+
+	destConfig, err := newRestConfig(firstNonEmpty(options.DestKubeconfig, options.Kubeconfig), firstNonEmpty(options.DestContext, options.Context))
+	if err != nil {
+		return nil, preflightError(errors.Wrap(err, "error loading kubeconfig of destination cluster"))
+	}
+	destConfig.QPS = options.QPS
+	destConfig.Burst = options.Burst
+
+	if env.SourceDynamicClient, err = dynamic.NewForConfig(sourceConfig); err != nil {
+		return nil, preflightError(errors.WithStack(err))
+	}
+	if env.SourceDiscoveryClient, err = discovery.NewDiscoveryClientForConfig(sourceConfig); err != nil {
+		return nil, preflightError(errors.WithStack(err))
+	}
+	if env.DestDynamicClient, err = dynamic.NewForConfig(destConfig); err != nil {
+		return nil, preflightError(errors.WithStack(err))
+	}
+	if env.DestDiscoveryClient, err = discovery.NewDiscoveryClientForConfig(destConfig); err != nil {
+		return nil, preflightError(errors.WithStack(err))
+	}
+
+	// contexts of the same API server, e.g. with other credentials, are
+	// the same cluster
+	env.SeparateClusters = sourceConfig.Host != destConfig.Host
+
+	return NewMigratorForEnvironment(options, env)
+}
+
+// NewMigratorForEnvironment constructs and returns a *Migrator from the
+// provided options that works with the clients and outputs of env instead
+// of connecting to the clusters itself. The client options are ignored.
+// The returned error is a *PreflightError if the options are invalid or
+// the clusters can't be reached.
+func NewMigratorForEnvironment(options Options, env Environment) (*Migrator, error) {
+	if env.SourceDynamicClient == nil || env.SourceDiscoveryClient == nil {
+		return nil, preflightErrorf("the source dynamic and discovery clients are required")
+	}
+	if env.DestDynamicClient == nil {
+		env.DestDynamicClient = env.SourceDynamicClient
+	}
+	if env.DestDiscoveryClient == nil {
+		env.DestDiscoveryClient = env.SourceDiscoveryClient
+	}
+	if env.Log == nil {
+		env.Log = newLogger(options.LogLevel, os.Stderr)
+	}
+	if env.Out == nil {
+		env.Out = ioutil.Discard
+	}
+	if env.DryRunOut == nil {
+		env.DryRunOut = os.Stdout
+	}
+	log := env.Log
+
+	if options.PageSize < 0 {
+		return nil, preflightErrorf("invalid --page-size %d", options.PageSize)
+	}
+	if options.Workers < 1 {
+		return nil, preflightErrorf("invalid --workers %d", options.Workers)
+	}
+	if err := validatePatterns("--resources", options.Resources); err != nil {
+		return nil, preflightError(err)
+	}
+	if err := validatePatterns("--exclude-resources", options.ExcludeResources); err != nil {
+		return nil, preflightError(err)
+	}
+	if _, err := labels.Parse(options.Selector); err != nil {
+		return nil, preflightError(errors.Wrapf(err, "invalid --selector %q", options.Selector))
+	}
+	if _, err := fields.ParseSelector(options.FieldSelector); err != nil {
+		return nil, preflightError(errors.Wrapf(err, "invalid --field-selector %q", options.FieldSelector))
+	}
+	switch {
+	case options.Resume && options.Checkpoint == "":
+		return nil, preflightErrorf("--resume requires --checkpoint")
+	case options.Checkpoint != "" && options.DryRun:
+		return nil, preflightErrorf("--checkpoint can't be used with --dry-run")
+	case options.MigrateCRDs && options.DryRun:
+		return nil, preflightErrorf("--migrate-crds can't be used with --dry-run")
+	}
+
+	onConflict, err := parseConflictStrategy(options.OnConflict)
+	if err != nil {
+		return nil, preflightError(err)
+	}
+
+	merge := onConflict == conflictMerge
+	var settings []resourceSettings
+	for _, s := range options.ResourceSettings {
+		if err := validatePatterns("resource settings", []string{s.Resources}); err != nil {
+			return nil, preflightError(err)
+		}
+		parsed := resourceSettings{pattern: s.Resources}
+		if s.OnConflict != "" {
+			if parsed.onConflict, err = parseConflictStrategy(s.OnConflict); err != nil {
+				return nil, preflightError(errors.Wrapf(err, "invalid settings of resources %q", s.Resources))
+			}
+		}
+		settings = append(settings, parsed)
+		merge = merge || parsed.onConflict == conflictMerge
+	}
+	if merge && options.JournalDir == "" {
+		return nil, preflightErrorf("--on-conflict=merge requires --journal-dir, which keeps the bases of merges")
+	}
+
+	transforms, err := parseTransforms(options.Transforms)
+	if err != nil {
+		return nil, preflightError(err)
+	}
+
+	var reportFormat string
+	if options.ReportFile != "" {
+		if reportFormat, err = reportFormatForPath(options.ReportFile, options.ReportFormat); err != nil {
+			return nil, preflightError(err)
+		}
+	}
+
+	mappings, err := parseAllMappings(options)
+	if err != nil {
+		return nil, preflightError(err)
+	}
+
+	excludeNamespaces := make(stringSet)
+	for _, namespace := range options.ExcludeNamespaces {
+		excludeNamespaces.add(namespace)
+	}
+
+	var printer *itemPrinter
+	if options.DryRun {
+		if printer, err = newItemPrinter(env.DryRunOut, options.Output); err != nil {
+			return nil, preflightError(errors.Wrap(err, "error parsing --output"))
+		}
+	}
+
+	// CRDs are read with apiextensions.k8s.io/v1 where it's served, since
+	// v1beta1 has been removed from newer clusters
+	destCRDResource, err := discoverCRDResource(env.DestDiscoveryClient)
+	if err != nil {
+		return nil, preflightError(errors.Wrap(err, "error discovering CRD API version of destination cluster"))
+	}
+	destCRDClient := env.DestDynamicClient.Resource(destCRDResource)
+
+	// a restore reads nothing from the source cluster, so it doesn't
+	// discover anything there either
+	var (
+		sourceCRDClient dynamic.ResourceInterface
+		onlyReadAt      map[string]stringSet
+	)
+	if options.Restore {
+		if isGroup(options.NewGroupVersion) {
+			return nil, preflightErrorf("a snapshot can only be restored into a groupVersion, not group %s", options.NewGroupVersion)
+		}
+	} else {
+		sourceCRDResource, err := discoverCRDResource(env.SourceDiscoveryClient)
+		if err != nil {
+			return nil, preflightError(errors.Wrap(err, "error discovering CRD API version of source cluster"))
+		}
+		sourceCRDClient = env.SourceDynamicClient.Resource(sourceCRDResource)
+
+		if options, onlyReadAt, err = resolveVersions(options, env.SourceDiscoveryClient, sourceCRDClient); err != nil {
+			return nil, preflightError(err)
+		}
+	}
 
-	restConfig := newRestConfigOrDie(options.Kubeconfig, options.Context)
-	restConfig.QPS = options.QPS
-	restConfig.Burst = options.Burst
+	oldGroupVersion, err := parseGroupVersion(options.OldGroupVersion)
+	if err != nil {
+		return nil, preflightError(err)
+	}
+	newGroupVersion, err := parseGroupVersion(options.NewGroupVersion)
+	if err != nil {
+		return nil, preflightError(err)
+	}
+
+	tracker := newCreatedItemsTracker(log, options.OldGroupVersion, options.NewGroupVersion)
+
+	var checkpoint *checkpoint
+	switch {
+	case options.Resume:
+		if checkpoint, err = loadCheckpoint(options.Checkpoint, oldGroupVersion.String(), newGroupVersion.String()); err != nil {
+			return nil, preflightError(errors.Wrap(err, "error loading checkpoint"))
+		}
+		tracker.restoreTrackedItems(newGroupVersion.String(), checkpoint.TrackedItems)
+	case options.Checkpoint != "":
+		checkpoint = newCheckpoint(options.Checkpoint, oldGroupVersion.String(), newGroupVersion.String())
+	}
+
+	// nothing is created in dry-run mode, so there is nothing to roll back
+	var journal *journal
+	if options.JournalDir != "" && !options.DryRun {
+		journal = newJournal(log, options.JournalDir, newRunID())
+	}
+
+	// Options that don't set a --crd-timeout wait as long as the command
+	// does by default
+	crdTimeout := options.CRDTimeout
+	if crdTimeout <= 0 {
+		crdTimeout = defaultCRDEstablishedTimeout
+	}
 
-	dynamicClient := dynamic.NewForConfigOrDie(restConfig)
-	discoveryClient := discovery.NewDiscoveryClientForConfigOrDie(restConfig)
-	oldGroupVersion := parseGroupVersionOrDie(options.OldGroupVersion)
-	newGroupVersion := parseGroupVersionOrDie(options.NewGroupVersion)
+	m := &Migrator{
+		log:                    log,
+		sourceDiscoveryClient:  env.SourceDiscoveryClient,
+		sourceDynamicClient:    env.SourceDynamicClient,
+		sourceCRDClient:        sourceCRDClient,
+		destDiscoveryClient:    env.DestDiscoveryClient,
+		destDynamicClient:      env.DestDynamicClient,
+		destCRDClient:          destCRDClient,
+		destCRDResource:        destCRDResource,
+		separateClusters:       env.SeparateClusters,
+		out:                    env.Out,
+		oldGroupVersion:        oldGroupVersion,
+		newGroupVersion:        newGroupVersion,
+		namespaceMappings:      mappings["namespace"],
+		labelMappings:          mappings["label"],
+		annotationMappings:     mappings["annotation"],
+		updateOwnerRefMappings: mappings["update-owner-refs"],
+		createdItemsTracker:    tracker,
+		dryRun:                 options.DryRun,
+		printer:                printer,
+		checkpoint:             checkpoint,
+		stop:                   make(chan struct{}),
+		pageSize:               options.PageSize,
+		reportNewItems:         options.ReportNewItems,
+		workers:                options.Workers,
+		journal:                journal,
+		journalDir:             options.JournalDir,
+		migrateCRDs:            options.MigrateCRDs,
+		crdEstablishedTimeout:  crdTimeout,
+		crdShortNameMappings:   mappings["crd-short-name"],
+		crdCategoryMappings:    mappings["crd-category"],
+		includeResources:       options.Resources,
+		excludeResources:       options.ExcludeResources,
+		labelSelector:          options.Selector,
+		fieldSelector:          options.FieldSelector,
+		namespaces:             options.Namespaces,
+		excludeNamespaces:      excludeNamespaces,
+		optOutAnnotation:       options.OptOutAnnotation,
+		onConflict:             onConflict,
+		resourceSettings:       settings,
+		transforms:             transforms,
+		reportFile:             options.ReportFile,
+		reportFormat:           reportFormat,
+		reportItems:            options.ReportFile != "",
+		observer:               env.Observer,
+		onlyResources:          onlyReadAt[oldGroupVersion.String()],
+	}
+
+	if len(options.GroupVersionMappings) > 0 {
+		if err := m.addGroups(options, env, onlyReadAt); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// NewOfflineMigrator constructs and returns a *Migrator from the
+// provided options that can only convert manifests, without connecting to
+// a cluster. Logs are written to stderr.
+func NewOfflineMigrator(options Options) (*Migrator, error) {
+	log := newLogger(options.LogLevel, os.Stderr)
+
+	// the versions of a group are only known to a cluster
+	if isGroup(options.OldGroupVersion) || isGroup(options.NewGroupVersion) {
+		return nil, preflightErrorf("--from and --to must be groupVersions to convert manifests")
+	}
 
-	crdGroupVersionResource := parseGroupVersionOrDie("apiextensions.k8s.io/v1beta1").WithResource("customresourcedefinitions")
-	crdClient := dynamicClient.Resource(crdGroupVersionResource)
+	oldGroupVersion, err := parseGroupVersion(options.OldGroupVersion)
+	if err != nil {
+		return nil, preflightError(err)
+	}
+	newGroupVersion, err := parseGroupVersion(options.NewGroupVersion)
+	if err != nil {
+		return nil, preflightError(err)
+	}
+	mappings, err := parseAllMappings(options)
+	if err != nil {
+		return nil, preflightError(err)
+	}
 
 	return &Migrator{
 		log:                    log,
-		discoveryClient:        discoveryClient,
-		dynamicClient:          dynamicClient,
 		oldGroupVersion:        oldGroupVersion,
 		newGroupVersion:        newGroupVersion,
-		crdClient:              crdClient,
-		namespaceMappings:      parseMappings("namespace", options.NamespaceMappings),
-		labelMappings:          parseMappings("label", options.LabelMappings),
-		annotationMappings:     parseMappings("annotation", options.AnnotationMappings),
-		updateOwnerRefMappings: parseMappings("update-owner-refs", options.UpdateOwnerRefMappings),
+		namespaceMappings:      mappings["namespace"],
+		labelMappings:          mappings["label"],
+		annotationMappings:     mappings["annotation"],
+		updateOwnerRefMappings: mappings["update-owner-refs"],
 		createdItemsTracker:    newCreatedItemsTracker(log, options.OldGroupVersion, options.NewGroupVersion),
-	}
+		stop:                   make(chan struct{}),
+	}, nil
 }
 
-func newLogger(logLevel string) logrus.FieldLogger {
+func newLogger(logLevel string, out io.Writer) logrus.FieldLogger {
 	log := logrus.New()
-	log.Out = os.Stdout
+	log.Out = out
 	log.Level = logrus.InfoLevel
 
 	level, err := logrus.ParseLevel(logLevel)
@@ -99,22 +551,40 @@ func newLogger(logLevel string) logrus.FieldLogger {
 	return log
 }
 
-func parseMappings(kind string, in []string) map[string]string {
+// parseAllMappings parses the from:to mappings of all options, keyed by
+// kind.
+func parseAllMappings(options Options) (map[string]map[string]string, error) {
+	all := make(map[string]map[string]string)
+	for kind, in := range map[string][]string{
+		"namespace":         options.NamespaceMappings,
+		"label":             options.LabelMappings,
+		"annotation":        options.AnnotationMappings,
+		"update-owner-refs": options.UpdateOwnerRefMappings,
+		"crd-short-name":    options.CRDShortNameMappings,
+		"crd-category":      options.CRDCategoryMappings,
+	} {
+		mappings, err := parseMappings(kind, in)
+		if err != nil {
+			return nil, err
+		}
+		all[kind] = mappings
+	}
+	return all, nil
+}
+
+func parseMappings(kind string, in []string) (map[string]string, error) {
 	out := make(map[string]string)
 
 	for _, mapping := range in {
 		parts := strings.Split(mapping, ":")
-		if len(parts) != 2 {
-			logrus.Fatalf("invalid %s mapping %q", kind, mapping)
-		}
-		if parts[0] == "" || parts[1] == "" {
-			logrus.Fatalf("invalid %s mapping %q", kind, mapping)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("invalid %s mapping %q", kind, mapping)
 		}
 
 		out[parts[0]] = parts[1]
 	}
 
-	return out
+	return out, nil
 }
 
 func calculateResourcePriorities(parentChildMappings map[string]string) ([]string, error) {
@@ -126,141 +596,884 @@ func calculateResourcePriorities(parentChildMappings map[string]string) ([]strin
 }
 
 // MigrateAllResources copies all instances of all resources within the
-// old group/version to the new, applying any relevant mappings.
-func (m *Migrator) MigrateAllResources() {
-	serverResources, err := m.discoveryClient.ServerResourcesForGroupVersion(m.oldGroupVersion.String())
+// old group/version to the new, applying any relevant mappings. Items and
+// resources that can't be migrated don't stop the migration; they are
+// logged, and returned together in a *PartialFailureError once every
+// resource has been processed. Errors before anything is migrated are
+// returned as a *PreflightError, and ErrInterrupted is returned if the
+// migration is stopped. The report of the run is returned either way.
+func (m *Migrator) MigrateAllResources() (*RunReport, error) {
+	return m.run(func() error {
+		if len(m.groups) > 0 {
+			return m.migrateAllGroups()
+		}
+		return m.migrateAllResources()
+	})
+}
+
+// run records the run of migrate, and writes its report to --report-file
+// once it returns.
+func (m *Migrator) run(migrate func() error) (*RunReport, error) {
+	m.recorder = newRunRecorder(m)
+
+	err := migrate()
+
+	report := m.recorder.finish(m.stopped())
+	m.writeRunReport(report)
+
+	return report, err
+}
+
+func (m *Migrator) migrateAllResources() error {
+	if m.migrateCRDs {
+		if err := m.migrateAllCRDs(); err != nil {
+			if err == ErrInterrupted {
+				m.logInterrupted()
+				return err
+			}
+			return preflightError(errors.Wrap(err, "error migrating CRDs"))
+		}
+	}
+
+	if err := m.checkDestination(); err != nil {
+		return preflightError(err)
+	}
+
+	resources, skipped, err := m.discoverResources()
+	if err != nil {
+		return preflightError(errors.Wrap(err, "error discovering resources to migrate"))
+	}
+	if err := m.printResourceTable(resources, skipped); err != nil {
+		return preflightError(errors.Wrap(err, "error printing resources to migrate"))
+	}
+	if err := m.trackUnselectedParents(skipped); err != nil {
+		return preflightError(errors.Wrap(err, "error tracking unselected parent resources"))
+	}
+
+	for _, resource := range resources {
+		if m.stopped() {
+			break
+		}
+
+		m.registerIfParent(resource)
+		m.migrateOneResource(resource)
+	}
+
+	return m.runError()
+}
+
+// runError returns ErrInterrupted if the run was stopped, or the errors of
+// the items and resources that failed, if any.
+func (m *Migrator) runError() error {
+	if m.stopped() {
+		m.logInterrupted()
+		return ErrInterrupted
+	}
+	return m.recorder.err()
+}
+
+// writeRunReport writes the report of the run to --report-file.
+func (m *Migrator) writeRunReport(report *RunReport) {
+	if m.reportFile == "" {
+		return
+	}
+
+	if err := WriteRunReport(m.reportFile, m.reportFormat, report); err != nil {
+		m.log.WithError(err).Error("Unable to write run report")
+		return
+	}
+	m.log.WithField("report", m.reportFile).Info("Wrote run report")
+}
+
+// Stop asks a running migration to stop once the in-flight item has been
+// migrated. If a checkpoint is being recorded, it is saved before the
+// migration returns.
+func (m *Migrator) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+}
+
+func (m *Migrator) stopped() bool {
+	select {
+	case <-m.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *Migrator) logInterrupted() {
+	if m.checkpoint != nil {
+		m.log.Warn("Migration interrupted, run again with --resume to continue")
+	} else {
+		m.log.Warn("Migration interrupted")
+	}
+}
+
+func (m *Migrator) saveCheckpoint() error {
+	return errors.Wrap(m.checkpoint.save(m.createdItemsTracker), "error saving checkpoint")
+}
+
+// checkDestination makes sure the new group/version is served by the
+// destination cluster.
+func (m *Migrator) checkDestination() error {
+	newServerResources, err := m.destDiscoveryClient.ServerResourcesForGroupVersion(m.newGroupVersion.String())
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrap(err, "error retrieving server resources for new group version")
+	}
+	if newServerResources == nil {
+		return errors.Errorf("new group version %s is not served by the destination cluster", m.newGroupVersion)
+	}
+
+	return nil
+}
+
+// discoverResources returns all resources within the old group/version
+// that can be migrated, in the order they need to be migrated, and those
+// that can't be migrated.
+func (m *Migrator) discoverResources() ([]metav1.APIResource, []skippedResource, error) {
+	resources, skipped, err := m.discoverAllResources()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resources, unselected, err := m.selectResources(resources)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return resources, append(skipped, unselected...), nil
+}
+
+// discoverAllResources is discoverResources, but ignores --resources and
+// --exclude-resources.
+func (m *Migrator) discoverAllResources() ([]metav1.APIResource, []skippedResource, error) {
+	// only MigrateAllResources goes through the group/versions of a run
+	if len(m.groups) > 0 {
+		return nil, nil, preflightErrorf("a run of %d group/versions can only be migrated, set OneVersion to read a group at one version", len(m.groups))
+	}
+
+	serverResources, err := m.sourceDiscoveryClient.ServerResourcesForGroupVersion(m.oldGroupVersion.String())
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, nil, errors.Wrap(err, "error retrieving server resources for old group version")
+	}
+	if serverResources == nil {
+		return nil, nil, errors.Errorf("old group version %s is not served by the source cluster", m.oldGroupVersion)
+	}
+
+	resources, skipped := filterResources(m.resourcesReadHere(serverResources.APIResources))
+
+	resources, err = m.orderResources(resources)
 	if err != nil {
-		m.log.WithError(err).Fatal("Error retrieving server resources for old group version")
+		return nil, nil, err
+	}
+
+	return resources, skipped, nil
+}
+
+// skippedResource is a resource within the old group/version that isn't
+// migrated, and why.
+type skippedResource struct {
+	resource metav1.APIResource
+	reason   string
+	// unselected is set if the resource could be migrated, but isn't
+	// selected by --resources and --exclude-resources
+	unselected bool
+}
+
+// selectResources splits resources into those that are selected by
+// --resources and --exclude-resources, in the same order, and those that
+// aren't. Every pattern has to match at least one resource, so that typos
+// are caught before doing any real work. In a run of several
+// group/versions, the patterns are checked against the resources of all
+// groups by migrateAllGroups instead.
+func (m *Migrator) selectResources(resources []metav1.APIResource) ([]metav1.APIResource, []skippedResource, error) {
+	if !m.inGroupRun {
+		if err := m.checkPatterns(resources); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var (
+		selected   []metav1.APIResource
+		unselected []skippedResource
+	)
+
+	for _, resource := range resources {
+		switch {
+		case len(m.includeResources) > 0 && !matchesAny(m.includeResources, resource.Name):
+			unselected = append(unselected, skippedResource{resource, "not selected by --resources", true})
+		case matchesAny(m.excludeResources, resource.Name):
+			unselected = append(unselected, skippedResource{resource, "excluded by --exclude-resources", true})
+		default:
+			selected = append(selected, resource)
+		}
+	}
+
+	return selected, unselected, nil
+}
+
+// checkPatterns returns an error if a pattern of --resources or
+// --exclude-resources doesn't match any of resources.
+func (m *Migrator) checkPatterns(resources []metav1.APIResource) error {
+	for _, patterns := range []struct {
+		flag     string
+		patterns []string
+	}{
+		{"--resources", m.includeResources},
+		{"--exclude-resources", m.excludeResources},
+	} {
+		for _, pattern := range patterns.patterns {
+			found := false
+			for _, resource := range resources {
+				if matchesAny([]string{pattern}, resource.Name) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return errors.Errorf("unable to find resource matching %q from %s", pattern, patterns.flag)
+			}
+		}
 	}
 
+	return nil
+}
+
+// matchesAny returns whether name matches any of the glob patterns, which
+// have been validated by validatePatterns.
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// validatePatterns returns an error if any of the glob patterns given to
+// flag are malformed.
+func validatePatterns(flag string, patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Errorf("invalid %s pattern %q", flag, pattern)
+		}
+	}
+	return nil
+}
+
+// trackUnselectedParents tracks the items in the new group/version of
+// --update-owner-refs parent resources that aren't selected, e.g. because
+// they were migrated in an earlier stage, so that ownerRefs pointing to
+// them can still be updated.
+func (m *Migrator) trackUnselectedParents(skipped []skippedResource) error {
+	for _, s := range skipped {
+		if !m.isOwnerRefParent(s.resource.Name) || !s.unselected {
+			continue
+		}
+
+		m.log.WithField("resource", s.resource.Name).Info("Tracking items of unselected parent resource in new API group")
+		m.registerIfParent(s.resource)
+
+		items, err := m.listNewItems(s.resource)
+		if err != nil {
+			return err
+		}
+		for i := range items {
+			m.createdItemsTracker.registerCreatedItem(&items[i])
+		}
+	}
+
+	return nil
+}
+
+// listNewItems returns all items of resource in the new group/version.
+func (m *Migrator) listNewItems(resource metav1.APIResource) ([]unstructured.Unstructured, error) {
+	client := m.destDynamicClient.Resource(m.newGroupVersion.WithResource(resource.Name))
+
+	var items []unstructured.Unstructured
+	continueToken := ""
+	for {
+		list, err := client.List(metav1.ListOptions{Limit: m.pageSize, Continue: continueToken})
+		if err != nil {
+			return nil, errors.Wrapf(err, "error listing %s in new group version", resource.Name)
+		}
+		items = append(items, list.Items...)
+
+		if continueToken = list.GetContinue(); continueToken == "" {
+			return items, nil
+		}
+	}
+}
+
+// requiredVerbs are the verbs a resource has to support to be migrated.
+var requiredVerbs = []string{"list", "create"}
+
+// filterResources splits the resources returned by discovery into those
+// that can be migrated and those that can't. Subresources, such as
+// foos/status, are never migrated by themselves.
+func filterResources(serverResources []metav1.APIResource) ([]metav1.APIResource, []skippedResource) {
+	var (
+		resources []metav1.APIResource
+		skipped   []skippedResource
+	)
+
+	for _, resource := range serverResources {
+		if i := strings.Index(resource.Name, "/"); i >= 0 {
+			skipped = append(skipped, skippedResource{resource: resource, reason: fmt.Sprintf("subresource of %s", resource.Name[:i])})
+			continue
+		}
+
+		verbs := make(stringSet)
+		for _, verb := range resource.Verbs {
+			verbs.add(verb)
+		}
+
+		var missing []string
+		for _, verb := range requiredVerbs {
+			if !verbs.has(verb) {
+				missing = append(missing, verb)
+			}
+		}
+		if len(missing) > 0 {
+			skipped = append(skipped, skippedResource{resource: resource, reason: fmt.Sprintf("doesn't support %s", strings.Join(missing, ", "))})
+			continue
+		}
+
+		resources = append(resources, resource)
+	}
+
+	return resources, skipped
+}
+
+// printResourceTable writes a table of the resources that will be
+// migrated, in order, followed by those that won't be and why.
+func (m *Migrator) printResourceTable(resources []metav1.APIResource, skipped []skippedResource) error {
+	scope := func(resource metav1.APIResource) string {
+		if resource.Namespaced {
+			return "Namespaced"
+		}
+		return "Cluster"
+	}
+
+	w := tabwriter.NewWriter(m.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "RESOURCE\tKIND\tSCOPE\tMIGRATE\tREASON")
+	for _, resource := range resources {
+		fmt.Fprintf(w, "%s\t%s\t%s\tyes\t\n", m.reportName(resource.Name), resource.Kind, scope(resource))
+	}
+	for _, s := range skipped {
+		fmt.Fprintf(w, "%s\t%s\t%s\tno\t%s\n", m.reportName(s.resource.Name), s.resource.Kind, scope(s.resource), s.reason)
+	}
+
+	return errors.WithStack(w.Flush())
+}
+
+// orderResources returns resources in the order they need to be migrated:
+// the resources from --update-owner-refs first, parents before children,
+// followed by all remaining resources sorted by name.
+func (m *Migrator) orderResources(serverResources []metav1.APIResource) ([]metav1.APIResource, error) {
 	serverResourcesByName := map[string]metav1.APIResource{}
 
-	for _, resource := range serverResources.APIResources {
+	for _, resource := range serverResources {
 		serverResourcesByName[resource.Name] = resource
 	}
 
 	resourcePriorities, err := calculateResourcePriorities(m.updateOwnerRefMappings)
 	if err != nil {
-		m.log.Fatal("--update-owner-refs contains a cycle")
+		return nil, errors.New("--update-owner-refs contains a cycle")
 	}
 
 	// check all the --update-owner-refs values to make sure they're valid; if not, error now, before
 	// doing any real work.
 	for _, resourceName := range resourcePriorities {
 		if _, found := serverResourcesByName[resourceName]; !found {
-			m.log.Fatalf("unable to find resource %q from --update-owner-refs", resourceName)
+			return nil, errors.Errorf("unable to find resource %q from --update-owner-refs", resourceName)
 		}
 	}
 
-	// process the sorted list of prioritized resources from --update-owner-refs first
+	var resources []metav1.APIResource
+
+	// the sorted list of prioritized resources from --update-owner-refs goes first
 	for _, resourceName := range resourcePriorities {
-		resource := serverResourcesByName[resourceName]
+		resources = append(resources, serverResourcesByName[resourceName])
 
-		// if it's a parent, register it
-		if _, ok := m.updateOwnerRefMappings[resourceName]; ok {
-			m.createdItemsTracker.registerResource(resource)
-		}
+		// delete the resource from the map so we won't add it again below
+		delete(serverResourcesByName, resourceName)
+	}
 
-		m.migrateOneResource(resource)
+	// followed by any remaining resources not listed in --update-owner-refs
+	var remaining []string
+	for resourceName := range serverResourcesByName {
+		remaining = append(remaining, resourceName)
+	}
+	sort.Strings(remaining)
 
-		// delete the resource from the map so we won't process it again in the 2nd for loop
-		delete(serverResourcesByName, resourceName)
+	for _, resourceName := range remaining {
+		resources = append(resources, serverResourcesByName[resourceName])
 	}
 
-	// process any remaining resources not listed in --update-owner-refs
-	for _, resource := range serverResourcesByName {
-		m.migrateOneResource(resource)
+	return resources, nil
+}
+
+// registerIfParent starts tracking created items of the resource if it's
+// listed as a parent in --update-owner-refs.
+func (m *Migrator) registerIfParent(resource metav1.APIResource) {
+	if m.isOwnerRefParent(resource.Name) {
+		m.createdItemsTracker.registerResource(m.newGroupVersion.String(), resource)
 	}
 }
 
+// isOwnerRefParent returns whether resource is listed as a parent in
+// --update-owner-refs.
+func (m *Migrator) isOwnerRefParent(resource string) bool {
+	_, ok := m.updateOwnerRefMappings[resource]
+	return ok || m.ownerRefParents.has(resource)
+}
+
 func (m *Migrator) migrateOneResource(resource metav1.APIResource) {
+	if m.checkpoint.isResourceCompleted(m.checkpointKey(resource.Name)) {
+		m.log.WithField("resource", resource.Name).Info("Resource already migrated according to checkpoint - skipping")
+		m.recorder.startResource(m.reportName(resource.Name))
+		m.recorder.finishResource(m.reportName(resource.Name), nil)
+		return
+	}
+
+	continueToken := m.checkpoint.continueToken(m.checkpointKey(resource.Name))
+
+	newest, completed := m.migrateResourceItems(resource, func(handle pageHandler, onRestart func()) error {
+		return m.listPages(resource, continueToken, handle, func() {
+			m.checkpoint.restartResource(m.checkpointKey(resource.Name))
+			onRestart()
+		})
+	})
+
+	// when resuming, the items listed by the earlier run aren't known
+	if completed && continueToken == "" {
+		m.checkNewItems(resource, newest)
+	}
+}
+
+// listPages lists the items of resource in the old group/version one
+// page at a time, starting at continueToken, and passes each selected
+// item of a page to handle. If the continue token expires, the list is
+// restarted from the beginning, with a new consistent snapshot, after
+// calling onRestart.
+//
+// With --namespaces, namespaced resources are listed one namespace at a
+// time, and the continue tokens passed to handle also record the
+// namespace.
+func (m *Migrator) listPages(resource metav1.APIResource, continueToken string, handle pageHandler, onRestart func()) error {
+	return m.listItemPages(resource, continueToken, false, handle, onRestart)
+}
+
+// listItemPages is listPages, but passes every item to handle if all is
+// set, ignoring the item selection.
+func (m *Migrator) listItemPages(resource metav1.APIResource, continueToken string, all bool, handle pageHandler, onRestart func()) error {
 	log := m.log.WithField("resource", resource.Name)
+	client := m.sourceDynamicClient.Resource(m.oldGroupVersion.WithResource(resource.Name))
+
+	namespaces := []string{metav1.NamespaceAll}
+	if resource.Namespaced && len(m.namespaces) > 0 && !all {
+		// the namespaces are listed in the order of their items' IDs, like
+		// the items of a list of all namespaces
+		namespaces = append([]string(nil), m.namespaces...)
+		sort.Slice(namespaces, func(i, j int) bool {
+			return namespaces[i]+"/" < namespaces[j]+"/"
+		})
+	}
 
-	log.Info("Starting resource migration")
+	listOptions := metav1.ListOptions{Limit: m.pageSize}
+	if !all {
+		listOptions.LabelSelector = m.labelSelector
+		listOptions.FieldSelector = m.fieldSelector
+	}
 
-	if err := m.validateNewCRD(log, resource); err != nil {
-		log.WithError(err).Error("Unable to migrate resource")
-		return
+	i, continueToken, ok := splitContinueToken(namespaces, continueToken)
+	if !ok {
+		log.Warn("Continue token from checkpoint doesn't match --namespaces, listing from the beginning")
 	}
+	resuming := continueToken != ""
+
+	for i < len(namespaces) {
+		listOptions.Continue = continueToken
+		list, err := client.Namespace(namespaces[i]).List(listOptions)
+		if continueToken != "" && isExpired(err) {
+			if resuming {
+				log.Warn("Continue token from checkpoint has expired, listing from the beginning")
+			} else {
+				log.Warn("Continue token has expired, restarting the list from a new snapshot")
+			}
 
-	defer log.Info("Completed resource migration")
+			if onRestart != nil {
+				onRestart()
+			}
+			i, continueToken, resuming = 0, "", false
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "error listing items")
+		}
+		resuming = false
 
-	oldGVR := m.oldGroupVersion.WithResource(resource.Name)
+		if continueToken = list.GetContinue(); continueToken == "" {
+			i++
+		}
 
-	oldClient := m.dynamicClient.Resource(oldGVR)
-	list, err := oldClient.List(metav1.ListOptions{})
-	if err != nil {
-		log.WithError(err).Error("Unable to list items")
+		items := list.Items
+		if !all {
+			items = m.selectItems(log, items)
+		}
+		if err := handle(items, joinContinueToken(namespaces, i, continueToken)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// joinContinueToken returns the continue token for resuming a list of
+// namespaces at the i-th namespace with continueToken.
+func joinContinueToken(namespaces []string, i int, continueToken string) string {
+	if len(namespaces) == 1 || i == len(namespaces) {
+		return continueToken
+	}
+	return namespaces[i] + "/" + continueToken
+}
+
+// splitContinueToken is the reverse of joinContinueToken. If the token's
+// namespace isn't one of namespaces, e.g. because --namespaces changed
+// since the checkpoint was saved, it returns false and the list starts
+// from the beginning.
+func splitContinueToken(namespaces []string, continueToken string) (int, string, bool) {
+	if len(namespaces) == 1 || continueToken == "" {
+		return 0, continueToken, true
+	}
+
+	parts := strings.SplitN(continueToken, "/", 2)
+	for i, namespace := range namespaces {
+		if len(parts) == 2 && parts[0] == namespace {
+			return i, parts[1], true
+		}
+	}
+	return 0, "", false
+}
+
+// selectItems returns the items that are neither in one of the
+// --exclude-namespaces nor opted out of the migration with the opt-out
+// annotation.
+func (m *Migrator) selectItems(log logrus.FieldLogger, items []unstructured.Unstructured) []unstructured.Unstructured {
+	var selected []unstructured.Unstructured
+
+	for i := range items {
+		if m.excludeNamespaces.has(items[i].GetNamespace()) {
+			continue
+		}
+
+		if m.optOutAnnotation != "" && items[i].GetAnnotations()[m.optOutAnnotation] == "true" {
+			log.WithField("id", itemID(items[i].GetNamespace(), items[i].GetName())).Info("Item has opt-out annotation - skipping")
+			continue
+		}
+
+		selected = append(selected, items[i])
+	}
+
+	return selected
+}
+
+// listAllItems returns all items of resource in the old group/version
+// from a single consistent list.
+func (m *Migrator) listAllItems(resource metav1.APIResource) ([]unstructured.Unstructured, error) {
+	var all []unstructured.Unstructured
+
+	err := m.listPages(resource, "", func(items []unstructured.Unstructured, _ string) error {
+		all = append(all, items...)
+		return nil
+	}, func() {
+		all = nil
+	})
+
+	return all, err
+}
+
+// checkNewItems lists resource again with --report-new-items and warns
+// about every item created after newest, the creationTimestamp of the
+// newest item the migration listed, i.e. after the snapshot the migration
+// listed items from. Items created within the same second as newest
+// aren't reported.
+func (m *Migrator) checkNewItems(resource metav1.APIResource, newest metav1.Time) {
+	if !m.reportNewItems {
 		return
 	}
 
-	for _, item := range list.Items {
-		if err := m.migrateOneResourceInstance(log, resource.Name, &item); err != nil {
-			log.WithError(err).Error("Error migrating item")
+	log := m.log.WithField("resource", resource.Name)
+
+	unprocessed := 0
+	err := m.listPages(resource, "", func(items []unstructured.Unstructured, _ string) error {
+		for i := range items {
+			if created := items[i].GetCreationTimestamp(); newest.Before(&created) {
+				log.WithField("id", itemID(items[i].GetNamespace(), items[i].GetName())).Warn("Item was created after the list snapshot and was not migrated, run the migration again to migrate it")
+				unprocessed++
+			}
 		}
+		return nil
+	}, func() {
+		unprocessed = 0
+	})
+	if err != nil {
+		log.WithError(err).Warn("Unable to check for items created during the migration")
+		return
+	}
+
+	if unprocessed > 0 {
+		log.WithField("count", unprocessed).Warn("Items were created during the migration and were not migrated")
 	}
 }
 
-func (m *Migrator) validateNewCRD(log logrus.FieldLogger, resource metav1.APIResource) error {
-	crdName := fmt.Sprintf("%s.%s", resource.Name, m.newGroupVersion.Group)
-	crd, err := m.crdClient.Get(crdName, metav1.GetOptions{})
+// isExpired returns whether err means that a list continue token has
+// expired.
+func isExpired(err error) bool {
+	status, ok := errors.Cause(err).(apierrors.APIStatus)
+	return ok && status.Status().Code == http.StatusGone
+}
+
+// migrateResourceItems migrates all instances of resource in the old
+// group/version, which are passed one page at a time by listPages, which
+// calls onRestart if it restarts the list from the beginning. It returns
+// the creationTimestamp of the newest item it processed and whether all
+// pages were processed.
+func (m *Migrator) migrateResourceItems(resource metav1.APIResource, listPages func(handle pageHandler, onRestart func()) error) (metav1.Time, bool) {
+	log := m.log.WithField("resource", resource.Name)
+
+	log.Info("Starting resource migration")
+	name := m.reportName(resource.Name)
+	m.recorder.startResource(name)
+
+	var (
+		newest metav1.Time
+		// lists return items sorted by ID, so after a restart the items up
+		// to the last one processed before it have already been processed
+		last, restartedAfter string
+	)
+	onRestart := func() {
+		restartedAfter = last
+	}
+
+	subresources, err := m.getSubresources(resource)
 	if err != nil {
-		return errors.WithStack(err)
+		log.WithError(err).Error("Unable to migrate resource")
+		m.recorder.finishResource(name, err)
+		return newest, false
+	}
+
+	err = listPages(func(items []unstructured.Unstructured, next string) error {
+		// items of a page are migrated by a pool of workers, and the whole
+		// page is done before the checkpoint moves past it
+		work := make(chan *unstructured.Unstructured)
+		var wg sync.WaitGroup
+		// with --on-conflict=fail, the first existing item stops the resource
+		var conflicted int32
+		for i := 0; i < m.workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for item := range work {
+					if err := m.migrateItem(log, resource, subresources, item); errors.Cause(err) == errItemExists {
+						atomic.StoreInt32(&conflicted, 1)
+					}
+				}
+			}()
+		}
+
+		interrupted := false
+		for i := range items {
+			if m.stopped() {
+				interrupted = true
+				break
+			}
+			if atomic.LoadInt32(&conflicted) == 1 {
+				break
+			}
+
+			item := &items[i]
+			id := itemID(item.GetNamespace(), item.GetName())
+
+			if id <= restartedAfter {
+				log.WithField("id", id).Debug("Item already processed before the list was restarted - skipping")
+				continue
+			}
+			last = id
+			if created := item.GetCreationTimestamp(); newest.Before(&created) {
+				newest = created
+			}
+
+			if m.checkpoint.isItemCompleted(m.checkpointKey(resource.Name), id) {
+				log.WithField("id", id).Debug("Item already migrated according to checkpoint - skipping")
+				m.recorder.recordItem(name, id, skipped("already migrated according to checkpoint"))
+				continue
+			}
+
+			work <- item
+		}
+
+		close(work)
+		wg.Wait()
+
+		if interrupted {
+			return ErrInterrupted
+		}
+		if atomic.LoadInt32(&conflicted) == 1 {
+			return errItemExists
+		}
+
+		m.checkpoint.completePage(m.checkpointKey(resource.Name), next)
+		return m.saveCheckpoint()
+	}, onRestart)
+
+	switch {
+	case err == ErrInterrupted:
+		if err := m.saveCheckpoint(); err != nil {
+			log.WithError(err).Error("Unable to save checkpoint")
+		}
+		log.Warn("Resource migration interrupted")
+	case err != nil:
+		log.WithError(err).Error("Unable to migrate resource")
+	default:
+		log.Info("Completed resource migration")
 	}
+	m.recorder.finishResource(name, err)
 
-	_, exists, _ := unstructured.NestedMap(crd.Object, "spec", "subresources", "status")
-	if exists {
-		return errors.Errorf("CRD %s has spec.subresources.status", crdName)
+	return newest, err == nil
+}
+
+// migrateItem migrates one item and records the result in the checkpoint.
+// It returns the error, which has already been logged, if the item
+// couldn't be migrated. It is safe to call concurrently.
+func (m *Migrator) migrateItem(log logrus.FieldLogger, resource metav1.APIResource, subresources subresources, item *unstructured.Unstructured) error {
+	// the ID has to be taken before the item is prepared for the new group
+	id := itemID(item.GetNamespace(), item.GetName())
+
+	outcome, err := m.migrateOneResourceInstance(log, resource, subresources, item)
+	if err != nil {
+		log.WithError(err).Error("Error migrating item")
+		m.checkpoint.failItem(m.checkpointKey(resource.Name))
+		m.recorder.failItem(m.reportName(resource.Name), id, err)
+		return err
 	}
 
+	m.checkpoint.completeItem(m.checkpointKey(resource.Name), id)
+	m.recorder.recordItem(m.reportName(resource.Name), id, outcome)
 	return nil
 }
 
-func (m *Migrator) migrateOneResourceInstance(logger logrus.FieldLogger, resourceName string, item *unstructured.Unstructured) error {
-	newGVR := m.newGroupVersion.WithResource(resourceName)
+func (m *Migrator) migrateOneResourceInstance(
+	logger logrus.FieldLogger,
+	resource metav1.APIResource,
+	subresources subresources,
+	item *unstructured.Unstructured,
+) (itemOutcome, error) {
+	newGVR := m.newGroupVersion.WithResource(resource.Name)
+
+	// namespace mappings only apply to namespaced resources
+	if !resource.Namespaced {
+		item.SetNamespace("")
+	}
 	originalNS := item.GetNamespace()
 	targetNS := m.getTargetNamespace(originalNS)
-	newResourceClient := clientForItem(m.dynamicClient.Resource(newGVR), targetNS)
+	newResourceClient := clientForItem(m.destDynamicClient.Resource(newGVR), targetNS)
 
 	// set up the log fields
-	var id string
-	if targetNS != "" {
-		id = targetNS + "/" + item.GetName()
-	} else {
-		id = item.GetName()
-	}
-	log := logger.WithField("id", id)
+	log := logger.WithField("id", itemID(targetNS, item.GetName()))
 	if originalNS != targetNS {
 		log = log.WithField("original-namespace", originalNS)
 	}
 
 	log.Info("Checking if item already exists in new API group")
 	existingItem, err := newResourceClient.Get(item.GetName(), metav1.GetOptions{})
-	if err == nil {
-		log.Warn("Item already exists - skipping")
+	if err != nil && !apierrors.IsNotFound(err) {
+		return itemOutcome{}, errors.WithStack(err)
+	}
 
-		// need to track the item in case it's a parent and we need to update its UID in child ownerRefs
-		m.createdItemsTracker.registerCreatedItem(existingItem)
+	ownerRefs := item.GetOwnerReferences()
+	if err := m.prepareForCreate(log, resource.Name, item); err != nil {
+		return itemOutcome{}, err
+	}
+	onConflict := m.conflictStrategyFor(resource.Name)
+	var content map[string]interface{}
+	if onConflict == conflictMerge {
+		content = recordMigratedContent(item)
+	}
+	rewrites := ownerRefRewrites(itemID(originalNS, item.GetName()), ownerRefs, item.GetOwnerReferences())
 
-		return nil
-	} else if !apierrors.IsNotFound(err) {
-		return errors.WithStack(err)
+	if err == nil {
+		outcome, err := m.resolveConflict(log, newGVR, newResourceClient, subresources, onConflict, item, existingItem)
+		if outcome.result == itemUpdated {
+			outcome.ownerRefRewrites = rewrites
+		}
+		return outcome, err
 	}
 
-	m.prepareForCreate(log, item)
+	created := itemOutcome{result: itemCreated, ownerRefRewrites: rewrites}
+
+	if m.dryRun {
+		return created, m.renderItem(log, item)
+	}
 
 	log.Info("Creating item")
-	createdItem, err := newResourceClient.Create(item, metav1.CreateOptions{})
+	// item is still needed to migrate its subresources, so the client gets
+	// a copy it's free to modify
+	createdItem, err := newResourceClient.Create(item.DeepCopy(), metav1.CreateOptions{})
+	if err != nil {
+		return itemOutcome{}, errors.WithStack(err)
+	}
+
+	if err := m.journal.record(newGVR, createdItem, content); err != nil {
+		return itemOutcome{}, errors.Wrap(err, "error recording created item in run journal")
+	}
+	if content != nil {
+		m.addMergeBase(content)
+	}
+
+	updatedItem, err := m.migrateSubresources(log, newResourceClient, subresources, item, createdItem)
 	if err != nil {
-		return errors.WithStack(err)
+		// delete the incomplete item so that it's migrated again, with all
+		// of its data, when the migration is run again
+		uid := createdItem.GetUID()
+		if deleteErr := newResourceClient.Delete(item.GetName(), &metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &uid}}); deleteErr != nil {
+			log.WithError(deleteErr).Error("Unable to delete incompletely migrated item")
+		}
+		return itemOutcome{}, err
+	}
+
+	m.createdItemsTracker.registerCreatedItem(updatedItem)
+
+	return created, nil
+}
+
+// renderItem prints an item that is ready to be created instead of
+// creating it, and tracks it as if it had been created.
+func (m *Migrator) renderItem(log logrus.FieldLogger, item *unstructured.Unstructured) error {
+	log.Info("Rendering item (dry run)")
+
+	rendered := item.DeepCopy()
+	// these are all set by the API server on create
+	for _, field := range []string{"uid", "selfLink", "creationTimestamp", "generation"} {
+		unstructured.RemoveNestedField(rendered.Object, "metadata", field)
+	}
+
+	if err := m.printer.print(rendered); err != nil {
+		return err
 	}
 
-	m.createdItemsTracker.registerCreatedItem(createdItem)
+	item.SetUID(dryRunUID)
+	m.createdItemsTracker.registerCreatedItem(item)
 
 	return nil
 }
 
-func (m *Migrator) prepareForCreate(log logrus.FieldLogger, item *unstructured.Unstructured) {
+// prepareForCreate changes item, an item of resource in the old
+// group/version, into the item that's created in the new group/version.
+func (m *Migrator) prepareForCreate(log logrus.FieldLogger, resource string, item *unstructured.Unstructured) error {
 	// Change apiVersion to the new one
 	item.SetAPIVersion(m.newGroupVersion.String())
 
@@ -279,7 +1492,9 @@ func (m *Migrator) prepareForCreate(log logrus.FieldLogger, item *unstructured.U
 		item.SetLabels(updateMapKeys(item.GetLabels(), m.labelMappings))
 	}
 
-	m.createdItemsTracker.updateOwnerRefs(item)
+	m.createdItemsTracker.updateOwnerRefs(item, m.separateClusters)
+
+	return m.applyTransforms(log, resource, item)
 }
 
 func updateMapKeys(data, mappings map[string]string) map[string]string {
@@ -295,7 +1510,7 @@ func updateMapKeys(data, mappings map[string]string) map[string]string {
 	return data
 }
 
-func newRestConfigOrDie(kubeconfig, context string) *rest.Config {
+func newRestConfig(kubeconfig, context string) (*rest.Config, error) {
 	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
 	loadingRules.ExplicitPath = kubeconfig
 
@@ -306,20 +1521,30 @@ func newRestConfigOrDie(kubeconfig, context string) *rest.Config {
 	clientcmdClientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, configOverrides)
 
 	config, err := clientcmdClientConfig.ClientConfig()
-	if err != nil {
-		panic(err)
-	}
+	return config, errors.WithStack(err)
+}
 
-	return config
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
 }
 
-func parseGroupVersionOrDie(groupVersion string) schema.GroupVersion {
+func parseGroupVersion(groupVersion string) (schema.GroupVersion, error) {
 	parsed, err := schema.ParseGroupVersion(groupVersion)
-	if err != nil {
-		logrus.WithError(err).Fatalf("Error parsing groupVersion %s", groupVersion)
-	}
+	return parsed, errors.Wrapf(err, "error parsing groupVersion %s", groupVersion)
+}
 
-	return parsed
+// itemID returns the namespace/name of an item, or just the name if it is
+// cluster-scoped.
+func itemID(namespace, name string) string {
+	if namespace != "" {
+		return namespace + "/" + name
+	}
+	return name
 }
 
 func clientForItem(namespaceableClient dynamic.NamespaceableResourceInterface, namespace string) dynamic.ResourceInterface {
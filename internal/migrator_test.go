@@ -4,32 +4,54 @@
 package internal
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	fakediscovery "k8s.io/client-go/discovery/fake"
 	"k8s.io/client-go/dynamic"
 	fakedynamic "k8s.io/client-go/dynamic/fake"
 	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/yaml"
 )
 
 type migratorHarness struct {
 	t               *testing.T
 	migrator        *Migrator
-	discoveryClient *fakediscovery.FakeDiscovery
+	discoveryClient fakeDiscovery
 	dynamicClient   *fakedynamic.FakeDynamicClient
 }
 
+// fakeDiscovery returns a NotFound error for group/versions that aren't
+// served, like the API server, instead of the plain error of FakeDiscovery.
+type fakeDiscovery struct {
+	*fakediscovery.FakeDiscovery
+}
+
+func (d fakeDiscovery) ServerResourcesForGroupVersion(groupVersion string) (*metav1.APIResourceList, error) {
+	for _, resourceList := range d.Resources {
+		if resourceList.GroupVersion == groupVersion {
+			return resourceList, nil
+		}
+	}
+	return nil, apierrors.NewNotFound(schema.GroupResource{}, groupVersion)
+}
+
 func newHarness(
 	t *testing.T,
 	oldGV, newGV schema.GroupVersion,
@@ -38,24 +60,33 @@ func newHarness(
 	logger := logrus.New()
 	logger.Level = logrus.DebugLevel
 
-	discoveryClient := &fakediscovery.FakeDiscovery{Fake: new(k8stesting.Fake)}
+	discoveryClient := fakeDiscovery{&fakediscovery.FakeDiscovery{Fake: new(k8stesting.Fake)}}
 	dynamicClient := fakedynamic.NewSimpleDynamicClient(runtime.NewScheme())
 
-	crdGroupVersionResource := parseGroupVersionOrDie("apiextensions.k8s.io/v1beta1").WithResource("customresourcedefinitions")
-	crdClient := dynamicClient.Resource(crdGroupVersionResource)
+	crdClient := dynamicClient.Resource(crdResourceV1beta1)
 
+	// the source and destination clusters are the same
 	migrator := &Migrator{
 		log:                    logger,
-		discoveryClient:        discoveryClient,
-		dynamicClient:          dynamicClient,
+		sourceDiscoveryClient:  discoveryClient,
+		sourceDynamicClient:    dynamicClient,
+		sourceCRDClient:        crdClient,
+		destDiscoveryClient:    discoveryClient,
+		destDynamicClient:      dynamicClient,
+		destCRDClient:          crdClient,
+		destCRDResource:        crdResourceV1beta1,
+		out:                    ioutil.Discard,
 		oldGroupVersion:        oldGV,
 		newGroupVersion:        newGV,
-		crdClient:              crdClient,
 		createdItemsTracker:    newCreatedItemsTracker(logger, oldGV.String(), newGV.String()),
 		namespaceMappings:      nsMappings,
 		labelMappings:          labelMappings,
 		annotationMappings:     annotationMappings,
 		updateOwnerRefMappings: updateOwnerRefMappings,
+		workers:                1,
+		crdEstablishedTimeout:  time.Second,
+		onConflict:             conflictSkip,
+		reportItems:            true,
 	}
 
 	return &migratorHarness{
@@ -81,12 +112,17 @@ func (h *migratorHarness) RegisterCRD(gvr schema.GroupVersionResource) {
 		h.discoveryClient.Resources = append(h.discoveryClient.Resources, gvList)
 	}
 
-	gvList.APIResources = append(gvList.APIResources, metav1.APIResource{Name: gvr.Resource, Kind: strings.Title(gvr.Resource)})
+	gvList.APIResources = append(gvList.APIResources, metav1.APIResource{
+		Name:       gvr.Resource,
+		Kind:       strings.Title(gvr.Resource),
+		Namespaced: true,
+		Verbs:      []string{"create", "delete", "get", "list", "update"},
+	})
 
 	crd := new(unstructured.Unstructured)
 	crd.SetName(fmt.Sprintf("%s.%s", gvr.Resource, gvr.Group))
 
-	_, err := h.migrator.crdClient.Create(crd, metav1.CreateOptions{})
+	_, err := h.migrator.destCRDClient.Create(crd, metav1.CreateOptions{})
 	require.NoError(h.t, err)
 }
 
@@ -124,6 +160,21 @@ func (b *unstructuredBuilder) Namespace(val string) *unstructuredBuilder {
 	return b
 }
 
+func (b *unstructuredBuilder) UID(val string) *unstructuredBuilder {
+	b.SetUID(types.UID(val))
+	return b
+}
+
+func (b *unstructuredBuilder) ResourceVersion(val string) *unstructuredBuilder {
+	b.SetResourceVersion(val)
+	return b
+}
+
+func (b *unstructuredBuilder) CreationTimestamp(val time.Time) *unstructuredBuilder {
+	b.SetCreationTimestamp(metav1.NewTime(val))
+	return b
+}
+
 func (b *unstructuredBuilder) Labels(val map[string]string) *unstructuredBuilder {
 	b.SetLabels(val)
 	return b
@@ -481,6 +532,271 @@ func TestMigrate(t *testing.T) {
 	}
 }
 
+func TestMigrateDryRun(t *testing.T) {
+	oldGV := schema.GroupVersion{Group: "old", Version: "v1"}
+	newGV := schema.GroupVersion{Group: "new", Version: "v1"}
+
+	h := newHarness(t, oldGV, newGV, map[string]string{"ns-1": "ns-2"}, nil, nil, map[string]string{"bar": "foo"})
+
+	out := new(bytes.Buffer)
+	printer, err := newItemPrinter(out, outputFormatYAML)
+	require.NoError(t, err)
+	h.migrator.dryRun = true
+	h.migrator.printer = printer
+
+	h.RegisterCRD(oldGV.WithResource("bar"))
+	h.AddResources(oldGV.WithResource("bar"), objectBuilder("old/v1", "Bar", "obj-1").Namespace("ns-1").Build())
+	h.RegisterCRD(oldGV.WithResource("foo"))
+	h.AddResources(oldGV.WithResource("foo"), objectBuilder("old/v1", "Foo", "obj-1").Namespace("ns-1").OwnerRef("old/v1", "Bar", "obj-1").Build())
+	h.RegisterCRD(newGV.WithResource("bar"))
+	h.RegisterCRD(newGV.WithResource("foo"))
+
+	h.migrator.MigrateAllResources()
+
+	for _, resource := range []string{"foo", "bar"} {
+		res, err := h.dynamicClient.Resource(newGV.WithResource(resource)).List(metav1.ListOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, res.Items)
+	}
+
+	docs := strings.Split(out.String(), "---\n")
+	require.Len(t, docs, 2)
+
+	var rendered []*unstructured.Unstructured
+	for _, doc := range docs {
+		obj := make(map[string]interface{})
+		require.NoError(t, yaml.Unmarshal([]byte(doc), &obj))
+		rendered = append(rendered, &unstructured.Unstructured{Object: obj})
+	}
+
+	assert.Equal(t, "new/v1", rendered[0].GetAPIVersion())
+	assert.Equal(t, "Bar", rendered[0].GetKind())
+	assert.Equal(t, "ns-2", rendered[0].GetNamespace())
+
+	assert.Equal(t, "new/v1", rendered[1].GetAPIVersion())
+	assert.Equal(t, "Foo", rendered[1].GetKind())
+	assert.Equal(t, "ns-2", rendered[1].GetNamespace())
+	require.Len(t, rendered[1].GetOwnerReferences(), 1)
+	assert.Equal(t, "new/v1", rendered[1].GetOwnerReferences()[0].APIVersion)
+	assert.Equal(t, dryRunUID, rendered[1].GetOwnerReferences()[0].UID)
+}
+
+// pagingDynamicClient serves lists from the wrapped client in pages of
+// at most opts.Limit items, using the offset of the next page as the
+// continue token.
+type pagingDynamicClient struct {
+	dynamic.Interface
+	// expire holds continue tokens that are rejected once as expired
+	expire stringSet
+	// afterLastPage is called once, after the last page of a list
+	afterLastPage func()
+}
+
+func (c *pagingDynamicClient) Resource(gvr schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	resource := c.Interface.Resource(gvr)
+	return &pagingResourceClient{ResourceInterface: resource, resource: resource, client: c}
+}
+
+type pagingResourceClient struct {
+	dynamic.ResourceInterface
+	resource dynamic.NamespaceableResourceInterface
+	client   *pagingDynamicClient
+}
+
+func (c *pagingResourceClient) Namespace(namespace string) dynamic.ResourceInterface {
+	return &pagingResourceClient{ResourceInterface: c.resource.Namespace(namespace), resource: c.resource, client: c.client}
+}
+
+func (c *pagingResourceClient) List(opts metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+	if c.client.expire.has(opts.Continue) {
+		c.client.expire.remove(opts.Continue)
+		return nil, apierrors.NewGone("continue token expired")
+	}
+
+	list, err := c.ResourceInterface.List(metav1.ListOptions{})
+	if err != nil || opts.Limit == 0 {
+		return list, err
+	}
+
+	start := 0
+	if opts.Continue != "" {
+		start, _ = strconv.Atoi(opts.Continue)
+	}
+
+	end := start + int(opts.Limit)
+	if end < len(list.Items) {
+		list.SetContinue(strconv.Itoa(end))
+	} else {
+		end = len(list.Items)
+
+		if afterLastPage := c.client.afterLastPage; afterLastPage != nil {
+			c.client.afterLastPage = nil
+			afterLastPage()
+		}
+	}
+
+	list.Items = list.Items[start:end]
+	return list, nil
+}
+
+func TestMigratePaginated(t *testing.T) {
+	oldGV := schema.GroupVersion{Group: "old", Version: "v1"}
+	newGV := schema.GroupVersion{Group: "new", Version: "v1"}
+
+	h := newHarness(t, oldGV, newGV, nil, nil, nil, nil)
+
+	created := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	h.RegisterCRD(oldGV.WithResource("foo"))
+	for i := 1; i <= 5; i++ {
+		h.AddResources(oldGV.WithResource("foo"), objectBuilder("old/v1", "Foo", fmt.Sprintf("obj-%d", i)).CreationTimestamp(created).Build())
+	}
+	h.RegisterCRD(newGV.WithResource("foo"))
+
+	paging := &pagingDynamicClient{
+		Interface: h.dynamicClient,
+		// the token for the 3rd page expires the first time it's used
+		expire: stringSet{"4": struct{}{}},
+		afterLastPage: func() {
+			h.AddResources(oldGV.WithResource("foo"), objectBuilder("old/v1", "Foo", "obj-6").CreationTimestamp(created.Add(time.Minute)).Build())
+		},
+	}
+	h.migrator.sourceDynamicClient = paging
+	h.migrator.pageSize = 2
+	h.migrator.reportNewItems = true
+
+	logger, hook := logrustest.NewNullLogger()
+	h.migrator.log = logger
+
+	h.migrator.MigrateAllResources()
+
+	res, err := h.dynamicClient.Resource(newGV.WithResource("foo")).List(metav1.ListOptions{})
+	require.NoError(t, err)
+
+	var names []string
+	for _, item := range res.Items {
+		names = append(names, item.GetName())
+	}
+	assert.Equal(t, []string{"obj-1", "obj-2", "obj-3", "obj-4", "obj-5"}, names)
+
+	var unprocessed []interface{}
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Item was created after the list snapshot and was not migrated, run the migration again to migrate it" {
+			unprocessed = append(unprocessed, entry.Data["id"])
+		}
+	}
+	assert.Equal(t, []interface{}{"obj-6"}, unprocessed)
+}
+
+func TestMigrateWithWorkers(t *testing.T) {
+	oldGV := schema.GroupVersion{Group: "old", Version: "v1"}
+	newGV := schema.GroupVersion{Group: "new", Version: "v1"}
+
+	h := newHarness(t, oldGV, newGV, nil, nil, nil, map[string]string{"bar": "foo"})
+	h.migrator.workers = 4
+
+	h.RegisterCRD(oldGV.WithResource("bar"))
+	h.RegisterCRD(oldGV.WithResource("foo"))
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("obj-%d", i)
+		h.AddResources(oldGV.WithResource("bar"), objectBuilder("old/v1", "Bar", name).Namespace("ns-1").Build())
+		h.AddResources(oldGV.WithResource("foo"), objectBuilder("old/v1", "Foo", name).Namespace("ns-1").OwnerRef("old/v1", "Bar", name).Build())
+	}
+	h.RegisterCRD(newGV.WithResource("bar"))
+	h.RegisterCRD(newGV.WithResource("foo"))
+
+	h.migrator.MigrateAllResources()
+
+	bars, err := h.dynamicClient.Resource(newGV.WithResource("bar")).List(metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Len(t, bars.Items, 20)
+
+	foos, err := h.dynamicClient.Resource(newGV.WithResource("foo")).List(metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, foos.Items, 20)
+
+	// every parent was migrated before its children, so every ownerRef was updated
+	for _, foo := range foos.Items {
+		require.Len(t, foo.GetOwnerReferences(), 1)
+		assert.Equal(t, "new/v1", foo.GetOwnerReferences()[0].APIVersion)
+	}
+}
+
+func TestMigrateAcrossClusters(t *testing.T) {
+	oldGV := schema.GroupVersion{Group: "old", Version: "v1"}
+	newGV := schema.GroupVersion{Group: "new", Version: "v1"}
+
+	source := newHarness(t, oldGV, newGV, nil, nil, nil, map[string]string{"bar": "foo"})
+	dest := newHarness(t, oldGV, newGV, nil, nil, nil, nil)
+
+	source.RegisterCRD(oldGV.WithResource("bar"))
+	source.AddResources(oldGV.WithResource("bar"), objectBuilder("old/v1", "Bar", "obj-1").UID("source-uid").Build())
+	source.RegisterCRD(oldGV.WithResource("foo"))
+	source.AddResources(oldGV.WithResource("foo"),
+		objectBuilder("old/v1", "Foo", "obj-1").OwnerRef("old/v1", "Bar", "obj-1").Build(),
+		// the owner of obj-2 isn't migrated, so its UID only exists in the
+		// source cluster
+		objectBuilder("old/v1", "Foo", "obj-2").OwnerRef("apps/v1", "ReplicaSet", "rs-1").Build(),
+	)
+
+	dest.RegisterCRD(newGV.WithResource("bar"))
+	dest.AddResources(newGV.WithResource("bar"), objectBuilder("new/v1", "Bar", "obj-1").UID("dest-uid").Build())
+	dest.RegisterCRD(newGV.WithResource("foo"))
+
+	m := source.migrator
+	m.destDiscoveryClient = dest.discoveryClient
+	m.destDynamicClient = dest.dynamicClient
+	m.destCRDClient = dest.migrator.destCRDClient
+	m.separateClusters = true
+
+	report, err := m.MigrateAllResources()
+	require.NoError(t, err)
+
+	// nothing was created in the source cluster
+	for _, resource := range []string{"foo", "bar"} {
+		res, err := source.dynamicClient.Resource(newGV.WithResource(resource)).List(metav1.ListOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, res.Items)
+	}
+
+	foos, err := dest.dynamicClient.Resource(newGV.WithResource("foo")).List(metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, foos.Items, 2)
+	require.Len(t, foos.Items[0].GetOwnerReferences(), 1)
+	assert.Equal(t, "new/v1", foos.Items[0].GetOwnerReferences()[0].APIVersion)
+	assert.Equal(t, types.UID("dest-uid"), foos.Items[0].GetOwnerReferences()[0].UID)
+	// the garbage collector of the destination cluster would delete obj-2
+	// if it kept its ownerRef
+	assert.Empty(t, foos.Items[1].GetOwnerReferences())
+
+	var dropped []OwnerRefRewrite
+	for _, resource := range report.Resources {
+		for _, rewrite := range resource.OwnerRefRewrites {
+			if rewrite.Dropped {
+				dropped = append(dropped, rewrite)
+			}
+		}
+	}
+	assert.Equal(t, []OwnerRefRewrite{{ID: "obj-2", Kind: "ReplicaSet", Name: "rs-1", OldAPIVersion: "apps/v1", Dropped: true}}, dropped)
+
+	// clients of another cluster have to be marked as such
+	migrator, err := NewMigratorForEnvironment(Options{
+		OldGroupVersion: oldGV.String(),
+		NewGroupVersion: newGV.String(),
+		Workers:         1,
+		OnConflict:      "skip",
+	}, Environment{
+		SourceDynamicClient:   source.dynamicClient,
+		SourceDiscoveryClient: source.discoveryClient,
+		DestDynamicClient:     dest.dynamicClient,
+		DestDiscoveryClient:   dest.discoveryClient,
+		SeparateClusters:      true,
+		Log:                   discardLogger(),
+	})
+	require.NoError(t, err)
+	assert.True(t, migrator.separateClusters)
+}
+
 func TestUpdateMapKeys(t *testing.T) {
 	tests := []struct {
 		name               string
@@ -559,16 +875,17 @@ func TestPrepareForCreate(t *testing.T) {
 	assert.Equal(t, spec, item.Object["spec"])
 
 	m := &Migrator{
-		newGroupVersion:    schema.GroupVersion{Group: "example.io", Version: "v1"},
-		labelMappings:      map[string]string{"my.example.com": "example.io"},
-		annotationMappings: map[string]string{"my.example.com": "example.io"},
-		namespaceMappings:  map[string]string{"example": "other"},
+		newGroupVersion:     schema.GroupVersion{Group: "example.io", Version: "v1"},
+		labelMappings:       map[string]string{"my.example.com": "example.io"},
+		annotationMappings:  map[string]string{"my.example.com": "example.io"},
+		namespaceMappings:   map[string]string{"example": "other"},
+		createdItemsTracker: newCreatedItemsTracker(discardLogger(), "my.example.com/v1", "example.io/v1"),
 	}
 
 	logger := logrus.New()
 	logger.Out = ioutil.Discard
 	log := logrus.NewEntry(logger)
-	m.prepareForCreate(log, item)
+	require.NoError(t, m.prepareForCreate(log, "foos", item))
 
 	assert.Equal(t, "example.io/v1", item.GetAPIVersion())
 	assert.Equal(t, "Foo", item.GetKind())
@@ -588,6 +905,12 @@ func TestPrepareForCreate(t *testing.T) {
 	assert.Equal(t, spec, item.Object["spec"])
 }
 
+func discardLogger() logrus.FieldLogger {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return logger
+}
+
 func unstructuredOrDie(t *testing.T, s string) *unstructured.Unstructured {
 	var u unstructured.Unstructured
 	if err := json.Unmarshal([]byte(s), &u); err != nil {
@@ -632,55 +955,196 @@ func TestGetTargetNamespace(t *testing.T) {
 	assert.Equal(t, "b", m.getTargetNamespace("a"))
 }
 
-func TestParseGroupVersionOrDie(t *testing.T) {
-	originalExitFunc := logrus.StandardLogger().ExitFunc
-	defer func() {
-		logrus.StandardLogger().ExitFunc = originalExitFunc
-	}()
+func TestFilterResources(t *testing.T) {
+	allVerbs := []string{"create", "delete", "get", "list", "patch", "update", "watch"}
+
+	resources, skipped := filterResources([]metav1.APIResource{
+		{Name: "foos", Kind: "Foo", Namespaced: true, Verbs: allVerbs},
+		{Name: "foos/status", Kind: "Foo", Namespaced: true, Verbs: []string{"get", "patch", "update"}},
+		{Name: "foos/scale", Kind: "Scale", Namespaced: true, Verbs: []string{"get", "patch", "update"}},
+		{Name: "bars", Kind: "Bar", Verbs: []string{"get", "watch"}},
+		{Name: "bazs", Kind: "Baz", Verbs: allVerbs},
+	})
+
+	assert.Equal(t, []metav1.APIResource{
+		{Name: "foos", Kind: "Foo", Namespaced: true, Verbs: allVerbs},
+		{Name: "bazs", Kind: "Baz", Verbs: allVerbs},
+	}, resources)
 
-	logrus.StandardLogger().ExitFunc = func(code int) {
-		panic(code)
+	var reasons []string
+	for _, s := range skipped {
+		reasons = append(reasons, s.resource.Name+": "+s.reason)
 	}
+	assert.Equal(t, []string{
+		"foos/status: subresource of foos",
+		"foos/scale: subresource of foos",
+		"bars: doesn't support list, create",
+	}, reasons)
 
-	parseFunc := func(gv string) func() {
-		return func() {
-			parseGroupVersionOrDie(gv)
-		}
+	out := new(bytes.Buffer)
+	m := &Migrator{out: out}
+	require.NoError(t, m.printResourceTable(resources, skipped[2:]))
+	assert.Equal(t, `RESOURCE  KIND  SCOPE       MIGRATE  REASON
+foos      Foo   Namespaced  yes      
+bazs      Baz   Cluster     yes      
+bars      Bar   Cluster     no       doesn't support list, create
+`, out.String())
+}
+
+func TestMigrateSelectedResources(t *testing.T) {
+	oldGV := schema.GroupVersion{Group: "old", Version: "v1"}
+	newGV := schema.GroupVersion{Group: "new", Version: "v1"}
+
+	for _, test := range []struct {
+		name    string
+		migrate func(t *testing.T, m *Migrator)
+	}{
+		{
+			name: "migrate",
+			migrate: func(t *testing.T, m *Migrator) {
+				m.MigrateAllResources()
+			},
+		},
+		{
+			name: "plan and apply",
+			migrate: func(t *testing.T, m *Migrator) {
+				plan, err := m.Plan()
+				require.NoError(t, err)
+				assert.Equal(t, []ParentResource{{Name: "bar", Kind: "Bar", Namespaced: true}}, plan.UnselectedParents)
+				_, err = m.ApplyPlan(plan)
+				require.NoError(t, err)
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			h := newHarness(t, oldGV, newGV, nil, nil, nil, map[string]string{"bar": "foo"})
+			h.migrator.includeResources = []string{"f*", "ba*"}
+			h.migrator.excludeResources = []string{"bar"}
+
+			h.RegisterCRD(oldGV.WithResource("foo"))
+			h.AddResources(oldGV.WithResource("foo"),
+				objectBuilder("old/v1", "Foo", "obj-1").Namespace("ns-1").OwnerRef("old/v1", "Bar", "obj-1").Build(),
+			)
+			h.RegisterCRD(oldGV.WithResource("bar"))
+			h.AddResources(oldGV.WithResource("bar"),
+				objectBuilder("old/v1", "Bar", "obj-1").Namespace("ns-1").Build(),
+			)
+			h.RegisterCRD(oldGV.WithResource("baz"))
+			h.AddResources(oldGV.WithResource("baz"),
+				objectBuilder("old/v1", "Baz", "obj-1").Namespace("ns-1").Build(),
+			)
+			h.RegisterCRD(newGV.WithResource("foo"))
+			h.RegisterCRD(newGV.WithResource("bar"))
+			h.RegisterCRD(newGV.WithResource("baz"))
+			// migrated in an earlier stage
+			h.AddResources(newGV.WithResource("bar"),
+				objectBuilder("new/v1", "Bar", "obj-1").Namespace("ns-1").Build(),
+			)
+
+			resources, skipped, err := h.migrator.discoverResources()
+			require.NoError(t, err)
+			require.Len(t, resources, 2)
+			assert.Equal(t, "foo", resources[0].Name)
+			assert.Equal(t, "baz", resources[1].Name)
+			require.Len(t, skipped, 1)
+			assert.Equal(t, "excluded by --exclude-resources", skipped[0].reason)
+
+			test.migrate(t, h.migrator)
+
+			foo, err := h.dynamicClient.Resource(newGV.WithResource("foo")).Namespace("ns-1").Get("obj-1", metav1.GetOptions{})
+			require.NoError(t, err)
+			require.Len(t, foo.GetOwnerReferences(), 1)
+			assert.Equal(t, "new/v1", foo.GetOwnerReferences()[0].APIVersion)
+
+			bazs, err := h.dynamicClient.Resource(newGV.WithResource("baz")).List(metav1.ListOptions{})
+			require.NoError(t, err)
+			assert.Len(t, bazs.Items, 1)
+
+			h.migrator.includeResources = []string{"qux*"}
+			_, _, err = h.migrator.discoverResources()
+			assert.EqualError(t, err, `unable to find resource matching "qux*" from --resources`)
+		})
 	}
+}
 
-	assert.Panics(t, parseFunc("a/b/c"))
+func TestMigrateSelectedItems(t *testing.T) {
+	oldGV := schema.GroupVersion{Group: "old", Version: "v1"}
+	newGV := schema.GroupVersion{Group: "new", Version: "v1"}
 
-	parsed := parseGroupVersionOrDie("example.com/v1")
+	h := newHarness(t, oldGV, newGV, nil, nil, nil, nil)
+	h.migrator.labelSelector = "tenant=a"
+	h.migrator.namespaces = []string{"ns-1", "ns-2"}
+	h.migrator.excludeNamespaces = stringSet{"ns-2": {}}
+	h.migrator.optOutAnnotation = "skip"
+
+	tenantA := map[string]string{"tenant": "a"}
+	h.RegisterCRD(oldGV.WithResource("foo"))
+	h.AddResources(oldGV.WithResource("foo"),
+		objectBuilder("old/v1", "Foo", "obj-1").Namespace("ns-1").Labels(tenantA).Build(),
+		objectBuilder("old/v1", "Foo", "obj-2").Namespace("ns-1").Labels(tenantA).Annotation("skip", "true").Build(),
+		objectBuilder("old/v1", "Foo", "obj-3").Namespace("ns-1").Labels(map[string]string{"tenant": "b"}).Build(),
+		objectBuilder("old/v1", "Foo", "obj-4").Namespace("ns-2").Labels(tenantA).Build(),
+		objectBuilder("old/v1", "Foo", "obj-5").Namespace("ns-3").Labels(tenantA).Build(),
+	)
+	h.RegisterCRD(newGV.WithResource("foo"))
+
+	h.migrator.MigrateAllResources()
+
+	foos, err := h.dynamicClient.Resource(newGV.WithResource("foo")).List(metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, foos.Items, 1)
+	assert.Equal(t, "obj-1", foos.Items[0].GetName())
+}
+
+func TestContinueTokens(t *testing.T) {
+	namespaces := []string{"ns-1", "ns-2"}
+
+	assert.Equal(t, "ns-1/abc", joinContinueToken(namespaces, 0, "abc"))
+	assert.Equal(t, "ns-2/", joinContinueToken(namespaces, 1, ""))
+	assert.Equal(t, "", joinContinueToken(namespaces, 2, ""))
+	assert.Equal(t, "abc", joinContinueToken([]string{""}, 0, "abc"))
+
+	i, token, ok := splitContinueToken(namespaces, "ns-2/abc")
+	assert.Equal(t, 1, i)
+	assert.Equal(t, "abc", token)
+	assert.True(t, ok)
+
+	i, token, ok = splitContinueToken(namespaces, "ns-3/abc")
+	assert.Equal(t, 0, i)
+	assert.Equal(t, "", token)
+	assert.False(t, ok)
+
+	i, token, ok = splitContinueToken([]string{""}, "abc")
+	assert.Equal(t, 0, i)
+	assert.Equal(t, "abc", token)
+	assert.True(t, ok)
+}
+
+func TestParseGroupVersion(t *testing.T) {
+	_, err := parseGroupVersion("a/b/c")
+	assert.Error(t, err)
+
+	parsed, err := parseGroupVersion("example.com/v1")
+	require.NoError(t, err)
 	assert.Equal(t, "example.com", parsed.Group)
 	assert.Equal(t, "v1", parsed.Version)
 }
 
 func TestParseMappings(t *testing.T) {
-	originalExitFunc := logrus.StandardLogger().ExitFunc
-	defer func() {
-		logrus.StandardLogger().ExitFunc = originalExitFunc
-	}()
-
-	logrus.StandardLogger().ExitFunc = func(code int) {
-		panic(code)
+	for _, invalid := range []string{"asdf", ":asdf", "asdf:"} {
+		_, err := parseMappings("foo", []string{invalid})
+		assert.EqualError(t, err, fmt.Sprintf("invalid foo mapping %q", invalid))
 	}
 
-	assert.Panics(t, func() {
-		parseMappings("foo", []string{"asdf"})
-	})
-	assert.Panics(t, func() {
-		parseMappings("foo", []string{":asdf"})
-	})
-	assert.Panics(t, func() {
-		parseMappings("foo", []string{"asdf:"})
-	})
-
-	mappings := parseMappings("foo", []string{})
+	mappings, err := parseMappings("foo", []string{})
+	require.NoError(t, err)
 	assert.Empty(t, mappings)
 
-	mappings = parseMappings("foo", []string{"a:b"})
+	mappings, err = parseMappings("foo", []string{"a:b"})
+	require.NoError(t, err)
 	assert.Equal(t, map[string]string{"a": "b"}, mappings)
 
-	mappings = parseMappings("foo", []string{"a:b", "c:d"})
+	mappings, err = parseMappings("foo", []string{"a:b", "c:d"})
+	require.NoError(t, err)
 	assert.Equal(t, map[string]string{"a": "b", "c": "d"}, mappings)
 }
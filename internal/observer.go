@@ -0,0 +1,62 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+// EventType is the kind of progress an Event reports.
+type EventType string
+
+const (
+	// ResourceStarted is sent before the items of a resource are migrated.
+	ResourceStarted EventType = "ResourceStarted"
+	// ItemCreated is sent when an item was created in the new
+	// group/version, or rendered in a dry run.
+	ItemCreated EventType = "ItemCreated"
+	// ItemUpdated is sent when an item that already existed in the new
+	// group/version was updated by --on-conflict.
+	ItemUpdated EventType = "ItemUpdated"
+	// ItemSkipped is sent when an item wasn't migrated, with the reason.
+	ItemSkipped EventType = "ItemSkipped"
+	// OwnerRefRewritten is sent after ItemCreated or ItemUpdated for every
+	// ownerRef of the item that was changed to point to a migrated owner,
+	// or dropped.
+	OwnerRefRewritten EventType = "OwnerRefRewritten"
+	// ItemFailed is sent when an item couldn't be migrated, with the error.
+	ItemFailed EventType = "ItemFailed"
+	// ResourceCompleted is sent when a resource is done, with the error
+	// that stopped it if it wasn't completed.
+	ResourceCompleted EventType = "ResourceCompleted"
+)
+
+// Event reports the progress of a migration to an Observer.
+type Event struct {
+	Type EventType
+	// Resource is the name of the resource, e.g. foos.
+	Resource string
+	// ID is the namespace/name of the item in the old group/version, for
+	// item and ownerRef events.
+	ID string
+	// Reason is why an item was skipped.
+	Reason string
+	// Err is why an item failed, or why a resource wasn't completed. It is
+	// ErrInterrupted if the migration was stopped.
+	Err error
+	// OwnerRefRewrite is the changed ownerRef of an OwnerRefRewritten
+	// event.
+	OwnerRefRewrite *OwnerRefRewrite
+}
+
+// Observer receives the events of a migration, e.g. to show progress or
+// to audit changes. Observe is called for one event at a time, while the
+// item it's about waits, so it should return quickly.
+type Observer interface {
+	Observe(event Event)
+}
+
+// ObserverFunc is an Observer that calls itself.
+type ObserverFunc func(event Event)
+
+// Observe calls f(event).
+func (f ObserverFunc) Observe(event Event) {
+	f(event)
+}
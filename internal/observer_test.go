@@ -0,0 +1,69 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestObserver(t *testing.T) {
+	oldGV := schema.GroupVersion{Group: "old", Version: "v1"}
+	newGV := schema.GroupVersion{Group: "new", Version: "v1"}
+
+	h := newHarness(t, oldGV, newGV, nil, nil, nil, map[string]string{"bar": "foo"})
+
+	var events []Event
+	h.migrator.observer = ObserverFunc(func(event Event) {
+		events = append(events, event)
+	})
+
+	h.RegisterCRD(oldGV.WithResource("foo"))
+	h.AddResources(oldGV.WithResource("foo"),
+		objectBuilder("old/v1", "Foo", "obj-1").Namespace("ns-1").OwnerRef("old/v1", "Bar", "obj-1").Build(),
+		objectBuilder("old/v1", "Foo", "obj-2").Namespace("ns-1").Build(),
+		objectBuilder("old/v1", "Foo", "obj-3").Namespace("ns-1").Build(),
+	)
+	h.RegisterCRD(oldGV.WithResource("bar"))
+	h.AddResources(oldGV.WithResource("bar"),
+		objectBuilder("old/v1", "Bar", "obj-1").Namespace("ns-1").Build(),
+	)
+	h.RegisterCRD(newGV.WithResource("foo"))
+	h.RegisterCRD(newGV.WithResource("bar"))
+	h.AddResources(newGV.WithResource("foo"),
+		objectBuilder("new/v1", "Foo", "obj-2").Namespace("ns-1").Build(),
+	)
+
+	createErr := errors.New("quota exceeded")
+	h.dynamicClient.PrependReactor("create", "foo", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.(k8stesting.CreateAction).GetObject().(*unstructured.Unstructured).GetName() == "obj-3" {
+			return true, nil, createErr
+		}
+		return false, nil, nil
+	})
+
+	h.migrator.MigrateAllResources()
+
+	// the fake client assigns no UIDs
+	rewrite := &OwnerRefRewrite{ID: "ns-1/obj-1", Kind: "Bar", Name: "obj-1", OldAPIVersion: "old/v1", NewAPIVersion: "new/v1"}
+
+	if assert.Len(t, events, 9) {
+		assert.Equal(t, Event{Type: ResourceStarted, Resource: "bar"}, events[0])
+		assert.Equal(t, Event{Type: ItemCreated, Resource: "bar", ID: "ns-1/obj-1"}, events[1])
+		assert.Equal(t, Event{Type: ResourceCompleted, Resource: "bar"}, events[2])
+		assert.Equal(t, Event{Type: ResourceStarted, Resource: "foo"}, events[3])
+		assert.Equal(t, Event{Type: ItemCreated, Resource: "foo", ID: "ns-1/obj-1"}, events[4])
+		assert.Equal(t, Event{Type: OwnerRefRewritten, Resource: "foo", ID: "ns-1/obj-1", OwnerRefRewrite: rewrite}, events[5])
+		assert.Equal(t, Event{Type: ItemSkipped, Resource: "foo", ID: "ns-1/obj-2", Reason: "already exists"}, events[6])
+		assert.Equal(t, ItemFailed, events[7].Type)
+		assert.Equal(t, createErr, errors.Cause(events[7].Err))
+		assert.Equal(t, Event{Type: ResourceCompleted, Resource: "foo"}, events[8])
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"io/ioutil"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+// PlanVersion is the version of the plan file format written by
+// this version of the tool.
+const PlanVersion = "v1"
+
+// Plan is a reviewable record of everything a migration will do. It is
+// produced by Migrator.Plan and executed by Migrator.ApplyPlan.
+type Plan struct {
+	Version                string            `json:"version"`
+	OldGroupVersion        string            `json:"oldGroupVersion"`
+	NewGroupVersion        string            `json:"newGroupVersion"`
+	NamespaceMappings      map[string]string `json:"namespaceMappings,omitempty"`
+	LabelMappings          map[string]string `json:"labelMappings,omitempty"`
+	AnnotationMappings     map[string]string `json:"annotationMappings,omitempty"`
+	UpdateOwnerRefMappings map[string]string `json:"updateOwnerRefMappings,omitempty"`
+	// The item selection is recorded so that applying the plan lists the
+	// same items.
+	Selector          string   `json:"selector,omitempty"`
+	FieldSelector     string   `json:"fieldSelector,omitempty"`
+	Namespaces        []string `json:"namespaces,omitempty"`
+	ExcludeNamespaces []string `json:"excludeNamespaces,omitempty"`
+	OptOutAnnotation  string   `json:"optOutAnnotation,omitempty"`
+	// UnselectedParents are the --update-owner-refs parent resources that
+	// aren't selected by --resources and --exclude-resources. Their items
+	// in the new group/version are tracked when applying the plan, so that
+	// ownerRefs pointing to them are still updated.
+	UnselectedParents []ParentResource `json:"unselectedParents,omitempty"`
+	// Resources are listed in the order they will be migrated.
+	Resources []PlannedResource `json:"resources"`
+}
+
+// PlannedResource is a resource in the old group/version and all of the
+// items that will be migrated for it.
+type PlannedResource struct {
+	Name       string        `json:"name"`
+	Kind       string        `json:"kind"`
+	Namespaced bool          `json:"namespaced"`
+	Items      []PlannedItem `json:"items"`
+}
+
+// ParentResource is a parent resource in the old group/version that isn't
+// migrated by a plan.
+type ParentResource struct {
+	Name       string `json:"name"`
+	Kind       string `json:"kind"`
+	Namespaced bool   `json:"namespaced"`
+}
+
+// PlannedItem is a single item that will be migrated, along with the
+// resourceVersion it had when the plan was created.
+type PlannedItem struct {
+	Namespace       string `json:"namespace,omitempty"`
+	Name            string `json:"name"`
+	ResourceVersion string `json:"resourceVersion"`
+	TargetNamespace string `json:"targetNamespace,omitempty"`
+}
+
+// MigratorOptions returns a copy of base with the group versions,
+// mappings and item selection recorded in the plan.
+func (p *Plan) MigratorOptions(base Options) Options {
+	base.OldGroupVersion = p.OldGroupVersion
+	base.NewGroupVersion = p.NewGroupVersion
+	base.NamespaceMappings = formatMappings(p.NamespaceMappings)
+	base.LabelMappings = formatMappings(p.LabelMappings)
+	base.AnnotationMappings = formatMappings(p.AnnotationMappings)
+	base.UpdateOwnerRefMappings = formatMappings(p.UpdateOwnerRefMappings)
+	base.Selector = p.Selector
+	base.FieldSelector = p.FieldSelector
+	base.Namespaces = p.Namespaces
+	base.ExcludeNamespaces = p.ExcludeNamespaces
+	base.OptOutAnnotation = p.OptOutAnnotation
+
+	return base
+}
+
+func formatMappings(mappings map[string]string) []string {
+	var out []string
+	for from, to := range mappings {
+		out = append(out, from+":"+to)
+	}
+	sort.Strings(out)
+
+	return out
+}
+
+// ReadPlan reads a plan file written by WritePlan.
+func ReadPlan(path string) (*Plan, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	plan := new(Plan)
+	if err := yaml.Unmarshal(data, plan); err != nil {
+		return nil, errors.Wrapf(err, "error parsing plan file %s", path)
+	}
+
+	if plan.Version != PlanVersion {
+		return nil, errors.Errorf("unsupported plan version %q in %s, expected %q", plan.Version, path, PlanVersion)
+	}
+
+	return plan, nil
+}
+
+// WritePlan writes a plan to path as YAML.
+func WritePlan(path string, plan *Plan) error {
+	data, err := yaml.Marshal(plan)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(ioutil.WriteFile(path, data, 0644))
+}
+
+// Plan discovers all resources within the old group/version and lists
+// every item of each, without changing anything in the cluster.
+func (m *Migrator) Plan() (*Plan, error) {
+	if err := m.checkDestination(); err != nil {
+		return nil, err
+	}
+
+	resources, skipped, err := m.discoverResources()
+	if err != nil {
+		return nil, err
+	}
+	if err := m.printResourceTable(resources, skipped); err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{
+		Version:                PlanVersion,
+		OldGroupVersion:        m.oldGroupVersion.String(),
+		NewGroupVersion:        m.newGroupVersion.String(),
+		NamespaceMappings:      m.namespaceMappings,
+		LabelMappings:          m.labelMappings,
+		AnnotationMappings:     m.annotationMappings,
+		UpdateOwnerRefMappings: m.updateOwnerRefMappings,
+		Selector:               m.labelSelector,
+		FieldSelector:          m.fieldSelector,
+		Namespaces:             m.namespaces,
+		OptOutAnnotation:       m.optOutAnnotation,
+	}
+	for namespace := range m.excludeNamespaces {
+		plan.ExcludeNamespaces = append(plan.ExcludeNamespaces, namespace)
+	}
+	sort.Strings(plan.ExcludeNamespaces)
+
+	for _, s := range skipped {
+		if s.unselected && m.isOwnerRefParent(s.resource.Name) {
+			plan.UnselectedParents = append(plan.UnselectedParents, ParentResource{
+				Name:       s.resource.Name,
+				Kind:       s.resource.Kind,
+				Namespaced: s.resource.Namespaced,
+			})
+		}
+	}
+
+	for _, resource := range resources {
+		m.log.WithField("resource", resource.Name).Info("Planning resource migration")
+
+		items, err := m.listAllItems(resource)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error listing %s", resource.Name)
+		}
+
+		planned := PlannedResource{
+			Name:       resource.Name,
+			Kind:       resource.Kind,
+			Namespaced: resource.Namespaced,
+			Items:      []PlannedItem{},
+		}
+
+		for _, item := range items {
+			planned.Items = append(planned.Items, PlannedItem{
+				Namespace:       item.GetNamespace(),
+				Name:            item.GetName(),
+				ResourceVersion: item.GetResourceVersion(),
+				TargetNamespace: m.getTargetNamespace(item.GetNamespace()),
+			})
+		}
+
+		plan.Resources = append(plan.Resources, planned)
+	}
+
+	return plan, nil
+}
+
+// ApplyPlan migrates exactly the items recorded in plan. It refuses to
+// migrate anything if any source item was created, changed or deleted
+// since the plan was created. Errors and the report of the run are
+// returned like MigrateAllResources does.
+func (m *Migrator) ApplyPlan(plan *Plan) (*RunReport, error) {
+	return m.run(func() error {
+		return m.applyPlan(plan)
+	})
+}
+
+func (m *Migrator) applyPlan(plan *Plan) error {
+	if plan.OldGroupVersion != m.oldGroupVersion.String() || plan.NewGroupVersion != m.newGroupVersion.String() {
+		return preflightErrorf("plan is for %s -> %s, but migrator is configured for %s -> %s",
+			plan.OldGroupVersion, plan.NewGroupVersion, m.oldGroupVersion, m.newGroupVersion)
+	}
+
+	if err := m.checkDestination(); err != nil {
+		return preflightError(err)
+	}
+
+	itemsByResource, err := m.checkPlan(plan)
+	if err != nil {
+		return preflightError(err)
+	}
+
+	var unselected []skippedResource
+	for _, parent := range plan.UnselectedParents {
+		unselected = append(unselected, skippedResource{
+			resource: metav1.APIResource{
+				Name:       parent.Name,
+				Kind:       parent.Kind,
+				Namespaced: parent.Namespaced,
+			},
+			unselected: true,
+		})
+	}
+	if err := m.trackUnselectedParents(unselected); err != nil {
+		return preflightError(errors.Wrap(err, "error tracking unselected parent resources"))
+	}
+
+	for _, planned := range plan.Resources {
+		if m.stopped() {
+			break
+		}
+
+		resource := metav1.APIResource{
+			Name:       planned.Name,
+			Kind:       planned.Kind,
+			Namespaced: planned.Namespaced,
+		}
+		items := itemsByResource[planned.Name]
+
+		m.registerIfParent(resource)
+		newest, completed := m.migrateResourceItems(resource, func(handle pageHandler, _ func()) error {
+			return handle(items, "")
+		})
+		if completed {
+			m.checkNewItems(resource, newest)
+		}
+	}
+
+	return m.runError()
+}
+
+// checkPlan lists the current items of every planned resource and
+// compares them to the plan. It returns the current items in plan order,
+// keyed by resource name, or an error if they differ from the plan.
+func (m *Migrator) checkPlan(plan *Plan) (map[string][]unstructured.Unstructured, error) {
+	itemsByResource := make(map[string][]unstructured.Unstructured)
+	changes := 0
+
+	for _, planned := range plan.Resources {
+		log := m.log.WithField("resource", planned.Name)
+		log.Info("Checking source items against plan")
+
+		list, err := m.listAllItems(metav1.APIResource{Name: planned.Name, Namespaced: planned.Namespaced})
+		if err != nil {
+			return nil, errors.Wrapf(err, "error listing %s", planned.Name)
+		}
+
+		current := make(map[string]*unstructured.Unstructured)
+		for i := range list {
+			current[itemID(list[i].GetNamespace(), list[i].GetName())] = &list[i]
+		}
+
+		var items []unstructured.Unstructured
+		for _, plannedItem := range planned.Items {
+			id := itemID(plannedItem.Namespace, plannedItem.Name)
+			item, found := current[id]
+			delete(current, id)
+
+			switch {
+			case !found:
+				log.WithField("id", id).Error("Item was deleted since the plan was created")
+				changes++
+			case item.GetResourceVersion() != plannedItem.ResourceVersion:
+				log.WithFields(logrus.Fields{
+					"id":                      id,
+					"planned-resourceVersion": plannedItem.ResourceVersion,
+					"current-resourceVersion": item.GetResourceVersion(),
+				}).Error("Item was changed since the plan was created")
+				changes++
+			default:
+				items = append(items, *item)
+			}
+		}
+
+		var added []string
+		for id := range current {
+			added = append(added, id)
+		}
+		sort.Strings(added)
+
+		for _, id := range added {
+			log.WithField("id", id).Error("Item was created since the plan was created")
+			changes++
+		}
+
+		itemsByResource[planned.Name] = items
+	}
+
+	if changes > 0 {
+		return nil, errors.Errorf("%d source item(s) changed since the plan was created, create a new plan", changes)
+	}
+
+	return itemsByResource, nil
+}
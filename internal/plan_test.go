@@ -0,0 +1,147 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestPlanAndApply(t *testing.T) {
+	oldGV := schema.GroupVersion{Group: "old", Version: "v1"}
+	newGV := schema.GroupVersion{Group: "new", Version: "v1"}
+
+	newPlanHarness := func(t *testing.T) *migratorHarness {
+		h := newHarness(t, oldGV, newGV, map[string]string{"ns-1": "ns-2"}, nil, nil, map[string]string{"bar": "foo"})
+
+		h.RegisterCRD(oldGV.WithResource("foo"))
+		h.AddResources(oldGV.WithResource("foo"),
+			objectBuilder("old/v1", "Foo", "obj-1").Namespace("ns-1").ResourceVersion("1").OwnerRef("old/v1", "Bar", "obj-1").Build(),
+		)
+		h.RegisterCRD(oldGV.WithResource("bar"))
+		h.AddResources(oldGV.WithResource("bar"),
+			objectBuilder("old/v1", "Bar", "obj-1").Namespace("ns-1").ResourceVersion("2").Build(),
+		)
+		h.RegisterCRD(newGV.WithResource("foo"))
+		h.RegisterCRD(newGV.WithResource("bar"))
+
+		return h
+	}
+
+	t.Run("plan lists items in migration order", func(t *testing.T) {
+		h := newPlanHarness(t)
+
+		plan, err := h.migrator.Plan()
+		require.NoError(t, err)
+
+		assert.Equal(t, PlanVersion, plan.Version)
+		assert.Equal(t, "old/v1", plan.OldGroupVersion)
+		assert.Equal(t, "new/v1", plan.NewGroupVersion)
+		assert.Equal(t, []PlannedResource{
+			{
+				Name:       "bar",
+				Kind:       "Bar",
+				Namespaced: true,
+				Items: []PlannedItem{
+					{Namespace: "ns-1", Name: "obj-1", ResourceVersion: "2", TargetNamespace: "ns-2"},
+				},
+			},
+			{
+				Name:       "foo",
+				Kind:       "Foo",
+				Namespaced: true,
+				Items: []PlannedItem{
+					{Namespace: "ns-1", Name: "obj-1", ResourceVersion: "1", TargetNamespace: "ns-2"},
+				},
+			},
+		}, plan.Resources)
+
+		// nothing was created
+		res, err := h.dynamicClient.Resource(newGV.WithResource("foo")).List(metav1.ListOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, res.Items)
+	})
+
+	t.Run("plan round-trips through a file", func(t *testing.T) {
+		h := newPlanHarness(t)
+		h.migrator.namespaces = []string{"ns-1"}
+		h.migrator.excludeNamespaces = stringSet{"ns-3": {}}
+
+		plan, err := h.migrator.Plan()
+		require.NoError(t, err)
+
+		dir, err := ioutil.TempDir("", "plan")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "plan.yaml")
+		require.NoError(t, WritePlan(path, plan))
+
+		read, err := ReadPlan(path)
+		require.NoError(t, err)
+		assert.Equal(t, plan, read)
+
+		options := read.MigratorOptions(Options{Kubeconfig: "kubeconfig"})
+		assert.Equal(t, "kubeconfig", options.Kubeconfig)
+		assert.Equal(t, []string{"ns-1:ns-2"}, options.NamespaceMappings)
+		assert.Equal(t, []string{"bar:foo"}, options.UpdateOwnerRefMappings)
+		assert.Equal(t, []string{"ns-1"}, options.Namespaces)
+		assert.Equal(t, []string{"ns-3"}, options.ExcludeNamespaces)
+	})
+
+	t.Run("apply migrates planned items", func(t *testing.T) {
+		h := newPlanHarness(t)
+
+		plan, err := h.migrator.Plan()
+		require.NoError(t, err)
+
+		report, err := h.migrator.ApplyPlan(plan)
+		require.NoError(t, err)
+
+		for _, resource := range []string{"foo", "bar"} {
+			res, err := h.dynamicClient.Resource(newGV.WithResource(resource)).List(metav1.ListOptions{})
+			require.NoError(t, err)
+			require.Len(t, res.Items, 1)
+			assert.Equal(t, "ns-2", res.Items[0].GetNamespace())
+		}
+
+		require.Len(t, report.Resources, 2)
+		for _, resource := range report.Resources {
+			assert.True(t, resource.Completed)
+			assert.Len(t, resource.Created, 1)
+		}
+	})
+
+	t.Run("apply refuses to run when source items changed", func(t *testing.T) {
+		h := newPlanHarness(t)
+
+		plan, err := h.migrator.Plan()
+		require.NoError(t, err)
+
+		client := h.dynamicClient.Resource(oldGV.WithResource("foo")).Namespace("ns-1")
+		item, err := client.Get("obj-1", metav1.GetOptions{})
+		require.NoError(t, err)
+		item.SetResourceVersion("3")
+		_, err = client.Update(item, metav1.UpdateOptions{})
+		require.NoError(t, err)
+
+		h.AddResources(oldGV.WithResource("bar"), objectBuilder("old/v1", "Bar", "obj-2").Namespace("ns-1").Build())
+
+		_, err = h.migrator.ApplyPlan(plan)
+		assert.EqualError(t, err, "2 source item(s) changed since the plan was created, create a new plan")
+
+		for _, resource := range []string{"foo", "bar"} {
+			res, err := h.dynamicClient.Resource(newGV.WithResource(resource)).List(metav1.ListOptions{})
+			require.NoError(t, err)
+			assert.Empty(t, res.Items)
+		}
+	})
+}
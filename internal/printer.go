@@ -0,0 +1,75 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	outputFormatYAML = "yaml"
+	outputFormatJSON = "json"
+)
+
+// itemPrinter writes items to an output stream as a sequence of
+// YAML documents or JSON objects. It is safe for concurrent use.
+type itemPrinter struct {
+	mu      sync.Mutex
+	out     io.Writer
+	format  string
+	printed int
+}
+
+func newItemPrinter(out io.Writer, format string) (*itemPrinter, error) {
+	switch format {
+	case outputFormatYAML, outputFormatJSON:
+	default:
+		return nil, errors.Errorf("invalid output format %q, must be one of: %s, %s", format, outputFormatYAML, outputFormatJSON)
+	}
+
+	return &itemPrinter{
+		out:    out,
+		format: format,
+	}, nil
+}
+
+func (p *itemPrinter) print(item *unstructured.Unstructured) error {
+	var (
+		data []byte
+		err  error
+	)
+
+	switch p.format {
+	case outputFormatYAML:
+		data, err = yaml.Marshal(item.Object)
+	case outputFormatJSON:
+		data, err = json.MarshalIndent(item.Object, "", "    ")
+		if err == nil {
+			data = append(data, '\n')
+		}
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error encoding item as %s", p.format)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.printed > 0 && p.format == outputFormatYAML {
+		data = append([]byte("---\n"), data...)
+	}
+
+	if _, err := p.out.Write(data); err != nil {
+		return errors.WithStack(err)
+	}
+
+	p.printed++
+	return nil
+}
@@ -0,0 +1,502 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	reportFormatJSON  = "json"
+	reportFormatYAML  = "yaml"
+	reportFormatJUnit = "junit"
+)
+
+// RunReport is a machine-readable record of a migration run, written to
+// --report-file at the end of the run.
+type RunReport struct {
+	// OldGroupVersion and NewGroupVersion are comma-separated lists in a
+	// run of several group/versions, whose resources are named
+	// resource.group.
+	OldGroupVersion string  `json:"oldGroupVersion"`
+	NewGroupVersion string  `json:"newGroupVersion"`
+	RunID           string  `json:"runID,omitempty"`
+	DryRun          bool    `json:"dryRun,omitempty"`
+	Interrupted     bool    `json:"interrupted,omitempty"`
+	StartTime       string  `json:"startTime"`
+	EndTime         string  `json:"endTime"`
+	Duration        float64 `json:"durationSeconds"`
+	// Resources are listed in migration order.
+	Resources []*ResourceReport `json:"resources"`
+}
+
+// ResourceReport records what happened to the items of a resource. Items
+// are identified by their namespace and name in the old group/version.
+type ResourceReport struct {
+	Name      string     `json:"name"`
+	Completed bool       `json:"completed"`
+	Error     string     `json:"error,omitempty"`
+	StartTime string     `json:"startTime"`
+	EndTime   string     `json:"endTime"`
+	Duration  float64    `json:"durationSeconds"`
+	Counts    ItemCounts `json:"counts"`
+
+	// The items and ownerRef rewrites are only listed in the report of a
+	// run with a --report-file, so that a run doesn't keep the ID of every
+	// item in memory otherwise.
+	Created          []ItemReport      `json:"created"`
+	Updated          []ItemReport      `json:"updated"`
+	Skipped          []ItemReport      `json:"skipped"`
+	Failed           []ItemReport      `json:"failed"`
+	OwnerRefRewrites []OwnerRefRewrite `json:"ownerRefRewrites"`
+
+	start time.Time
+}
+
+// ItemCounts are the numbers of items of a resource by what happened to
+// them.
+type ItemCounts struct {
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Skipped int `json:"skipped"`
+	Failed  int `json:"failed"`
+}
+
+// ItemReport is an item and, for skipped and failed items, why.
+type ItemReport struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// OwnerRefRewrite is an ownerRef of a migrated item that was changed to
+// point to the migrated owner, or dropped.
+type OwnerRefRewrite struct {
+	ID            string    `json:"id"`
+	Kind          string    `json:"kind"`
+	Name          string    `json:"name"`
+	OldAPIVersion string    `json:"oldAPIVersion"`
+	NewAPIVersion string    `json:"newAPIVersion"`
+	OldUID        types.UID `json:"oldUID,omitempty"`
+	NewUID        types.UID `json:"newUID,omitempty"`
+	// Dropped is set if the item was created in another cluster than its
+	// source, and the owner wasn't migrated there.
+	Dropped bool `json:"dropped,omitempty"`
+}
+
+// itemResult is what migrating an item did.
+type itemResult int
+
+const (
+	itemCreated itemResult = iota
+	itemUpdated
+	itemSkipped
+)
+
+// itemOutcome is the result of migrating an item that didn't fail.
+type itemOutcome struct {
+	result itemResult
+	// reason is why a skipped item was skipped
+	reason string
+	// ownerRefRewrites are the ownerRefs of a created or updated item that
+	// were changed to point to the migrated owners
+	ownerRefRewrites []OwnerRefRewrite
+}
+
+func skipped(reason string) itemOutcome {
+	return itemOutcome{result: itemSkipped, reason: reason}
+}
+
+// ownerRefRewrites compares the ownerRefs of item id before and after
+// they were updated by the createdItemsTracker, which keeps their order
+// but may drop some of them.
+func ownerRefRewrites(id string, before, after []metav1.OwnerReference) []OwnerRefRewrite {
+	var rewrites []OwnerRefRewrite
+	for _, ownerRef := range before {
+		rewrite := OwnerRefRewrite{
+			ID:            id,
+			Kind:          ownerRef.Kind,
+			Name:          ownerRef.Name,
+			OldAPIVersion: ownerRef.APIVersion,
+			OldUID:        ownerRef.UID,
+		}
+
+		if len(after) == 0 || after[0].Kind != ownerRef.Kind || after[0].Name != ownerRef.Name {
+			rewrite.Dropped = true
+			rewrites = append(rewrites, rewrite)
+			continue
+		}
+
+		updated := after[0]
+		after = after[1:]
+		if updated.APIVersion != ownerRef.APIVersion || updated.UID != ownerRef.UID {
+			rewrite.NewAPIVersion = updated.APIVersion
+			rewrite.NewUID = updated.UID
+			rewrites = append(rewrites, rewrite)
+		}
+	}
+	return rewrites
+}
+
+// runRecorder builds the report of a run, and sends what it records to
+// the observer, if any. A nil *runRecorder records nothing. It is safe for
+// concurrent use.
+type runRecorder struct {
+	mu       sync.Mutex
+	report   *RunReport
+	start    time.Time
+	observer Observer
+	// items is set if the items are listed in the report, not just counted
+	items bool
+	// errs are the errors of failed items and resources
+	errs []error
+}
+
+func newRunRecorder(m *Migrator) *runRecorder {
+	start := time.Now()
+
+	report := &RunReport{
+		OldGroupVersion: m.oldGroupVersion.String(),
+		NewGroupVersion: m.newGroupVersion.String(),
+		DryRun:          m.dryRun,
+		StartTime:       formatTime(start),
+		Resources:       []*ResourceReport{},
+	}
+	if m.journal != nil {
+		report.RunID = m.journal.runID
+	}
+	// a run of several group/versions lists them all
+	if len(m.groups) > 0 {
+		var oldGroupVersions, newGroupVersions []string
+		for _, g := range m.groups {
+			oldGroupVersions = append(oldGroupVersions, g.oldGroupVersion.String())
+			newGroupVersions = append(newGroupVersions, g.newGroupVersion.String())
+		}
+		report.OldGroupVersion = strings.Join(oldGroupVersions, ",")
+		report.NewGroupVersion = strings.Join(newGroupVersions, ",")
+	}
+
+	return &runRecorder{report: report, start: start, observer: m.observer, items: m.reportItems}
+}
+
+// observe sends event to the observer. The caller must hold r.mu, so that
+// events are observed one at a time and in the order they're recorded.
+func (r *runRecorder) observe(event Event) {
+	if r.observer != nil {
+		r.observer.Observe(event)
+	}
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// resource returns the report of the named resource, starting it if
+// needed. The caller must hold r.mu.
+func (r *runRecorder) resource(name string) *ResourceReport {
+	for _, resource := range r.report.Resources {
+		if resource.Name == name {
+			return resource
+		}
+	}
+
+	start := time.Now()
+	resource := &ResourceReport{
+		Name:             name,
+		StartTime:        formatTime(start),
+		Created:          []ItemReport{},
+		Updated:          []ItemReport{},
+		Skipped:          []ItemReport{},
+		Failed:           []ItemReport{},
+		OwnerRefRewrites: []OwnerRefRewrite{},
+		start:            start,
+	}
+	r.report.Resources = append(r.report.Resources, resource)
+	return resource
+}
+
+func (r *runRecorder) startResource(name string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.resource(name)
+	r.observe(Event{Type: ResourceStarted, Resource: name})
+}
+
+// finishResource records the end of the migration of a resource, which
+// is completed unless err is set.
+func (r *runRecorder) finishResource(name string, err error) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	resource := r.resource(name)
+	end := time.Now()
+	resource.EndTime = formatTime(end)
+	resource.Duration = end.Sub(resource.start).Seconds()
+	resource.Completed = err == nil
+	if err != nil && err != ErrInterrupted {
+		resource.Error = err.Error()
+		// the existing item that stopped the resource has been recorded
+		// as failed already
+		if errors.Cause(err) != errItemExists {
+			r.errs = append(r.errs, errors.Wrap(err, name))
+		}
+	}
+	r.observe(Event{Type: ResourceCompleted, Resource: name, Err: err})
+}
+
+// recordItem records the outcome of migrating item id of a resource.
+func (r *runRecorder) recordItem(name, id string, outcome itemOutcome) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	resource := r.resource(name)
+	switch outcome.result {
+	case itemCreated:
+		resource.Counts.Created++
+		if r.items {
+			resource.Created = append(resource.Created, ItemReport{ID: id})
+		}
+		r.observe(Event{Type: ItemCreated, Resource: name, ID: id})
+	case itemUpdated:
+		resource.Counts.Updated++
+		if r.items {
+			resource.Updated = append(resource.Updated, ItemReport{ID: id})
+		}
+		r.observe(Event{Type: ItemUpdated, Resource: name, ID: id})
+	case itemSkipped:
+		resource.Counts.Skipped++
+		if r.items {
+			resource.Skipped = append(resource.Skipped, ItemReport{ID: id, Reason: outcome.reason})
+		}
+		r.observe(Event{Type: ItemSkipped, Resource: name, ID: id, Reason: outcome.reason})
+		return
+	}
+
+	if r.items {
+		resource.OwnerRefRewrites = append(resource.OwnerRefRewrites, outcome.ownerRefRewrites...)
+	}
+	for i := range outcome.ownerRefRewrites {
+		r.observe(Event{Type: OwnerRefRewritten, Resource: name, ID: id, OwnerRefRewrite: &outcome.ownerRefRewrites[i]})
+	}
+}
+
+func (r *runRecorder) failItem(name, id string, err error) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	resource := r.resource(name)
+	resource.Counts.Failed++
+	if r.items {
+		resource.Failed = append(resource.Failed, ItemReport{ID: id, Reason: err.Error()})
+	}
+	r.errs = append(r.errs, errors.Wrapf(err, "%s %s", name, id))
+	r.observe(Event{Type: ItemFailed, Resource: name, ID: id, Err: err})
+}
+
+// err returns a *PartialFailureError with the errors of all failed items
+// and resources, or nil if there are none.
+func (r *runRecorder) err() error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.errs) == 0 {
+		return nil
+	}
+	return &PartialFailureError{Errors: append([]error(nil), r.errs...)}
+}
+
+// finish returns the report of the run. Items are sorted by ID, since
+// workers migrate them in no particular order.
+func (r *runRecorder) finish(interrupted bool) *RunReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	end := time.Now()
+	r.report.EndTime = formatTime(end)
+	r.report.Duration = end.Sub(r.start).Seconds()
+	r.report.Interrupted = interrupted
+
+	for _, resource := range r.report.Resources {
+		for _, items := range [][]ItemReport{resource.Created, resource.Updated, resource.Skipped, resource.Failed} {
+			sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+		}
+		rewrites := resource.OwnerRefRewrites
+		sort.SliceStable(rewrites, func(i, j int) bool { return rewrites[i].ID < rewrites[j].ID })
+	}
+
+	return r.report
+}
+
+// reportFormatForPath returns format, or if it's empty, the format of a
+// report file by its extension.
+func reportFormatForPath(path, format string) (string, error) {
+	if format == "" {
+		switch filepath.Ext(path) {
+		case ".json":
+			format = reportFormatJSON
+		case ".yaml", ".yml":
+			format = reportFormatYAML
+		case ".xml":
+			format = reportFormatJUnit
+		}
+	}
+
+	switch format {
+	case reportFormatJSON, reportFormatYAML, reportFormatJUnit:
+		return format, nil
+	case "":
+		return "", errors.Errorf("unable to tell the format of report file %s by its extension, use --report-format", path)
+	default:
+		return "", errors.Errorf("invalid report format %q, must be one of: %s, %s, %s", format, reportFormatJSON, reportFormatYAML, reportFormatJUnit)
+	}
+}
+
+// WriteRunReport writes report to path in format, which is one of json,
+// yaml or junit.
+func WriteRunReport(path, format string, report *RunReport) error {
+	var (
+		data []byte
+		err  error
+	)
+
+	switch format {
+	case reportFormatJSON:
+		data, err = json.MarshalIndent(report, "", "  ")
+	case reportFormatYAML:
+		data, err = yaml.Marshal(report)
+	case reportFormatJUnit:
+		data, err = junitXML(report)
+	default:
+		return errors.Errorf("invalid report format %q", format)
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(ioutil.WriteFile(path, data, 0644))
+}
+
+type junitTestSuites struct {
+	XMLName    xml.Name         `xml:"testsuites"`
+	Name       string           `xml:"name,attr"`
+	Tests      int              `xml:"tests,attr"`
+	Failures   int              `xml:"failures,attr"`
+	Skipped    int              `xml:"skipped,attr"`
+	Time       string           `xml:"time,attr"`
+	TestSuites []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+}
+
+// junitXML renders report as JUnit XML, with a test suite per resource
+// and a test case per item. A resource that wasn't completed is reported
+// as a failed test case of its own.
+func junitXML(report *RunReport) ([]byte, error) {
+	suites := junitTestSuites{
+		Name: fmt.Sprintf("%s -> %s", report.OldGroupVersion, report.NewGroupVersion),
+		Time: fmt.Sprintf("%.3f", report.Duration),
+	}
+
+	for _, resource := range report.Resources {
+		suite := junitTestSuite{
+			Name:      resource.Name,
+			Time:      fmt.Sprintf("%.3f", resource.Duration),
+			Timestamp: resource.StartTime,
+		}
+
+		addCase := func(id string, failure, skipped *junitMessage) {
+			suite.TestCases = append(suite.TestCases, junitTestCase{Name: id, ClassName: resource.Name, Failure: failure, Skipped: skipped})
+			suite.Tests++
+			if failure != nil {
+				suite.Failures++
+			}
+			if skipped != nil {
+				suite.Skipped++
+			}
+		}
+
+		for _, item := range resource.Created {
+			addCase(item.ID, nil, nil)
+		}
+		for _, item := range resource.Updated {
+			addCase(item.ID, nil, nil)
+		}
+		for _, item := range resource.Skipped {
+			addCase(item.ID, nil, &junitMessage{Message: item.Reason})
+		}
+		for _, item := range resource.Failed {
+			addCase(item.ID, &junitMessage{Message: item.Reason}, nil)
+		}
+		if !resource.Completed {
+			message := resource.Error
+			if message == "" {
+				message = "migration of resource was not completed"
+			}
+			addCase(resource.Name, &junitMessage{Message: message}, nil)
+		}
+
+		suites.Tests += suite.Tests
+		suites.Failures += suite.Failures
+		suites.Skipped += suite.Skipped
+		suites.TestSuites = append(suites.TestSuites, suite)
+	}
+
+	data, err := xml.MarshalIndent(suites, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(data, '\n')...), nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestRunReport(t *testing.T) {
+	oldGV := schema.GroupVersion{Group: "old", Version: "v1"}
+	newGV := schema.GroupVersion{Group: "new", Version: "v1"}
+
+	dir, err := ioutil.TempDir("", "report")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	h := newHarness(t, oldGV, newGV, nil, nil, nil, map[string]string{"bar": "foo"})
+	h.migrator.reportFile = filepath.Join(dir, "report.json")
+	h.migrator.reportFormat = reportFormatJSON
+
+	h.RegisterCRD(oldGV.WithResource("foo"))
+	h.AddResources(oldGV.WithResource("foo"),
+		objectBuilder("old/v1", "Foo", "obj-1").Namespace("ns-1").OwnerRef("old/v1", "Bar", "obj-1").Build(),
+		objectBuilder("old/v1", "Foo", "obj-2").Namespace("ns-1").Build(),
+	)
+	h.RegisterCRD(oldGV.WithResource("bar"))
+	h.AddResources(oldGV.WithResource("bar"),
+		objectBuilder("old/v1", "Bar", "obj-1").Namespace("ns-1").Build(),
+	)
+	h.RegisterCRD(newGV.WithResource("foo"))
+	h.RegisterCRD(newGV.WithResource("bar"))
+	h.AddResources(newGV.WithResource("foo"),
+		objectBuilder("new/v1", "Foo", "obj-2").Namespace("ns-1").Build(),
+	)
+
+	h.migrator.MigrateAllResources()
+
+	data, err := ioutil.ReadFile(h.migrator.reportFile)
+	require.NoError(t, err)
+
+	var report RunReport
+	require.NoError(t, json.Unmarshal(data, &report))
+
+	assert.Equal(t, "old/v1", report.OldGroupVersion)
+	assert.Equal(t, "new/v1", report.NewGroupVersion)
+	assert.False(t, report.Interrupted)
+	require.Len(t, report.Resources, 2)
+
+	bar := report.Resources[0]
+	assert.Equal(t, "bar", bar.Name)
+	assert.True(t, bar.Completed)
+	assert.Equal(t, []ItemReport{{ID: "ns-1/obj-1"}}, bar.Created)
+
+	foo := report.Resources[1]
+	assert.Equal(t, "foo", foo.Name)
+	assert.True(t, foo.Completed)
+	assert.Equal(t, []ItemReport{{ID: "ns-1/obj-1"}}, foo.Created)
+	assert.Equal(t, []ItemReport{{ID: "ns-1/obj-2", Reason: "already exists"}}, foo.Skipped)
+	assert.Empty(t, foo.Failed)
+	assert.Equal(t, ItemCounts{Created: 1, Skipped: 1}, foo.Counts)
+	assert.Equal(t, []OwnerRefRewrite{
+		{ID: "ns-1/obj-1", Kind: "Bar", Name: "obj-1", OldAPIVersion: "old/v1", NewAPIVersion: "new/v1"},
+	}, foo.OwnerRefRewrites)
+}
+
+func TestJUnitXML(t *testing.T) {
+	report := &RunReport{
+		OldGroupVersion: "old/v1",
+		NewGroupVersion: "new/v1",
+		Duration:        1.5,
+		Resources: []*ResourceReport{
+			{
+				Name:      "foos",
+				Completed: true,
+				StartTime: "2019-03-01T12:00:00Z",
+				Duration:  1,
+				Created:   []ItemReport{{ID: "ns-1/obj-1"}},
+				Skipped:   []ItemReport{{ID: "ns-1/obj-2", Reason: "already exists"}},
+				Failed:    []ItemReport{{ID: "ns-1/obj-3", Reason: "error updating status"}},
+			},
+		},
+	}
+
+	data, err := junitXML(report)
+	require.NoError(t, err)
+	assert.Equal(t, `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites name="old/v1 -&gt; new/v1" tests="3" failures="1" skipped="1" time="1.500">
+  <testsuite name="foos" tests="3" failures="1" skipped="1" time="1.000" timestamp="2019-03-01T12:00:00Z">
+    <testcase name="ns-1/obj-1" classname="foos"></testcase>
+    <testcase name="ns-1/obj-2" classname="foos">
+      <skipped message="already exists"></skipped>
+    </testcase>
+    <testcase name="ns-1/obj-3" classname="foos">
+      <failure message="error updating status"></failure>
+    </testcase>
+  </testsuite>
+</testsuites>
+`, string(data))
+}
+
+func TestReportFormatForPath(t *testing.T) {
+	format, err := reportFormatForPath("report.xml", "")
+	require.NoError(t, err)
+	assert.Equal(t, reportFormatJUnit, format)
+
+	format, err = reportFormatForPath("report.xml", reportFormatYAML)
+	require.NoError(t, err)
+	assert.Equal(t, reportFormatYAML, format)
+
+	_, err = reportFormatForPath("report.txt", "")
+	assert.EqualError(t, err, "unable to tell the format of report file report.txt by its extension, use --report-format")
+}
@@ -0,0 +1,462 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+// SnapshotVersion is the version of the snapshot archive format written
+// by this version of the tool.
+const SnapshotVersion = "v1"
+
+const snapshotManifestFile = "manifest.yaml"
+
+// SnapshotManifest describes the contents of a snapshot archive.
+type SnapshotManifest struct {
+	Version      string             `json:"version"`
+	GroupVersion string             `json:"groupVersion"`
+	CreatedAt    time.Time          `json:"createdAt"`
+	Resources    []SnapshotResource `json:"resources"`
+	CRDs         []SnapshotCRD      `json:"crds"`
+}
+
+// SnapshotResource is a resource in a snapshot archive. All of its items
+// are stored as YAML documents in File.
+type SnapshotResource struct {
+	Name       string         `json:"name"`
+	Kind       string         `json:"kind"`
+	Namespaced bool           `json:"namespaced"`
+	File       string         `json:"file"`
+	SHA256     string         `json:"sha256"`
+	Count      int            `json:"count"`
+	Items      []SnapshotItem `json:"items"`
+}
+
+// SnapshotItem is an item in a snapshot archive, along with the
+// resourceVersion it had when the snapshot was taken.
+type SnapshotItem struct {
+	Namespace       string `json:"namespace,omitempty"`
+	Name            string `json:"name"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+// SnapshotCRD is a CustomResourceDefinition in a snapshot archive.
+type SnapshotCRD struct {
+	Name   string `json:"name"`
+	File   string `json:"file"`
+	SHA256 string `json:"sha256"`
+}
+
+// Snapshot writes every item of every resource within the old
+// group/version, along with the resources' CRDs, to a gzip-compressed tar
+// archive at path. A snapshot is a backup, so the selection of resources
+// and items, including the opt-out annotation, doesn't apply.
+func (m *Migrator) Snapshot(path string) error {
+	resources, _, err := m.discoverAllResources()
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file so that an incomplete archive is never
+	// mistaken for a complete one
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(tmpPath)
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	manifest := &SnapshotManifest{
+		Version:      SnapshotVersion,
+		GroupVersion: m.oldGroupVersion.String(),
+		CreatedAt:    time.Now().UTC(),
+		Resources:    []SnapshotResource{},
+		CRDs:         []SnapshotCRD{},
+	}
+
+	for _, resource := range resources {
+		if m.stopped() {
+			return ErrInterrupted
+		}
+
+		snapshotResource, err := m.snapshotResource(tw, resource)
+		if err != nil {
+			return err
+		}
+		manifest.Resources = append(manifest.Resources, snapshotResource)
+
+		snapshotCRD, err := m.snapshotCRD(tw, resource)
+		if err != nil {
+			return err
+		}
+		manifest.CRDs = append(manifest.CRDs, snapshotCRD)
+	}
+
+	data, err := yaml.Marshal(manifest)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := writeTarFile(tw, snapshotManifestFile, data); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := gz.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := f.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	m.log.WithField("archive", path).Info("Snapshot complete")
+
+	return errors.WithStack(os.Rename(tmpPath, path))
+}
+
+func (m *Migrator) snapshotResource(tw *tar.Writer, resource metav1.APIResource) (SnapshotResource, error) {
+	log := m.log.WithField("resource", resource.Name)
+	log.Info("Saving items")
+
+	snapshotResource := SnapshotResource{
+		Name:       resource.Name,
+		Kind:       resource.Kind,
+		Namespaced: resource.Namespaced,
+		File:       "resources/" + resource.Name + ".yaml",
+		Items:      []SnapshotItem{},
+	}
+
+	// the size of a tar entry has to be known before it's written, so items
+	// are spooled to a temporary file first
+	spool, err := ioutil.TempFile("", "crd-migrator-snapshot")
+	if err != nil {
+		return snapshotResource, errors.WithStack(err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	digest := sha256.New()
+	printer, err := newItemPrinter(io.MultiWriter(spool, digest), outputFormatYAML)
+	if err != nil {
+		return snapshotResource, err
+	}
+
+	restarted := false
+	err = m.listItemPages(resource, "", true, func(items []unstructured.Unstructured, _ string) error {
+		if restarted {
+			// start over with the items from the new list
+			restarted = false
+			snapshotResource.Items = []SnapshotItem{}
+			digest.Reset()
+			if _, err := spool.Seek(0, io.SeekStart); err != nil {
+				return errors.WithStack(err)
+			}
+			if err := spool.Truncate(0); err != nil {
+				return errors.WithStack(err)
+			}
+			if printer, err = newItemPrinter(io.MultiWriter(spool, digest), outputFormatYAML); err != nil {
+				return err
+			}
+		}
+
+		for i := range items {
+			if err := printer.print(&items[i]); err != nil {
+				return err
+			}
+			snapshotResource.Items = append(snapshotResource.Items, SnapshotItem{
+				Namespace:       items[i].GetNamespace(),
+				Name:            items[i].GetName(),
+				ResourceVersion: items[i].GetResourceVersion(),
+			})
+		}
+		return nil
+	}, func() {
+		restarted = true
+	})
+	if err != nil {
+		return snapshotResource, err
+	}
+
+	snapshotResource.Count = len(snapshotResource.Items)
+	snapshotResource.SHA256 = hex.EncodeToString(digest.Sum(nil))
+
+	size, err := spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return snapshotResource, errors.WithStack(err)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return snapshotResource, errors.WithStack(err)
+	}
+	if err := writeTarEntry(tw, snapshotResource.File, size, spool); err != nil {
+		return snapshotResource, err
+	}
+
+	log.WithField("count", snapshotResource.Count).Info("Saved items")
+
+	return snapshotResource, nil
+}
+
+func (m *Migrator) snapshotCRD(tw *tar.Writer, resource metav1.APIResource) (SnapshotCRD, error) {
+	crdName := fmt.Sprintf("%s.%s", resource.Name, m.oldGroupVersion.Group)
+	crd, err := m.sourceCRDClient.Get(crdName, metav1.GetOptions{})
+	if err != nil {
+		return SnapshotCRD{}, errors.Wrapf(err, "error getting CRD %s", crdName)
+	}
+
+	data, err := yaml.Marshal(crd.Object)
+	if err != nil {
+		return SnapshotCRD{}, errors.WithStack(err)
+	}
+
+	snapshotCRD := SnapshotCRD{
+		Name:   crdName,
+		File:   "crds/" + crdName + ".yaml",
+		SHA256: sha256Hex(data),
+	}
+
+	return snapshotCRD, writeTarFile(tw, snapshotCRD.File, data)
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	return writeTarEntry(tw, name, int64(len(data)), bytes.NewReader(data))
+}
+
+func writeTarEntry(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err := io.Copy(tw, r)
+	return errors.WithStack(err)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Snapshot is a snapshot archive that has been extracted to a temporary
+// directory. Close removes the directory.
+type Snapshot struct {
+	Manifest SnapshotManifest
+	dir      string
+}
+
+// OpenSnapshot extracts the snapshot archive at path and verifies the
+// checksums of all files in it.
+func OpenSnapshot(path string) (*Snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading snapshot archive %s", path)
+	}
+
+	dir, err := ioutil.TempDir("", "crd-migrator-snapshot")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	s := &Snapshot{dir: dir}
+	if err := s.open(tar.NewReader(gz)); err != nil {
+		s.Close()
+		return nil, errors.Wrapf(err, "error reading snapshot archive %s", path)
+	}
+
+	return s, nil
+}
+
+func (s *Snapshot) open(tr *tar.Reader) error {
+	if err := s.extract(tr); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(s.path(snapshotManifestFile))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := yaml.Unmarshal(data, &s.Manifest); err != nil {
+		return errors.Wrap(err, "error parsing manifest")
+	}
+	if s.Manifest.Version != SnapshotVersion {
+		return errors.Errorf("unsupported snapshot version %q, expected %q", s.Manifest.Version, SnapshotVersion)
+	}
+
+	for _, resource := range s.Manifest.Resources {
+		if err := s.verify(resource.File, resource.SHA256); err != nil {
+			return err
+		}
+	}
+	for _, crd := range s.Manifest.CRDs {
+		if err := s.verify(crd.File, crd.SHA256); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Snapshot) extract(tr *tar.Reader) error {
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if !header.FileInfo().Mode().IsRegular() {
+			continue
+		}
+
+		target := s.path(header.Name)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return errors.WithStack(err)
+		}
+
+		out, err := os.Create(target)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+}
+
+func (s *Snapshot) verify(name, expectedSHA256 string) error {
+	data, err := ioutil.ReadFile(s.path(name))
+	if err != nil {
+		return errors.Wrapf(err, "error reading %s", name)
+	}
+
+	if actual := sha256Hex(data); actual != expectedSHA256 {
+		return errors.Errorf("checksum mismatch for %s: expected %s, got %s", name, expectedSHA256, actual)
+	}
+
+	return nil
+}
+
+// path returns the extracted location of a file in the archive. Names
+// are cleaned so that they can't point outside the directory.
+func (s *Snapshot) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// Close removes the extracted files.
+func (s *Snapshot) Close() error {
+	return errors.WithStack(os.RemoveAll(s.dir))
+}
+
+// readPages decodes the items of a resource and passes them to handle in
+// pages of up to pageSize items, or all at once if pageSize is 0.
+func (s *Snapshot) readPages(resourceName string, pageSize int64, handle pageHandler) error {
+	var file string
+	for _, resource := range s.Manifest.Resources {
+		if resource.Name == resourceName {
+			file = resource.File
+		}
+	}
+	if file == "" {
+		return errors.Errorf("resource %q not found in snapshot", resourceName)
+	}
+
+	f, err := os.Open(s.path(file))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	var page []unstructured.Unstructured
+	err = decodeDocuments(f, func(obj *unstructured.Unstructured) error {
+		page = append(page, *obj)
+		if pageSize > 0 && int64(len(page)) >= pageSize {
+			err := handle(page, "")
+			page = nil
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return handle(page, "")
+}
+
+// RestoreSnapshot creates all items in snapshot in the new group/version,
+// applying any relevant mappings, just like MigrateAllResources does for
+// the items in the old group/version, and returns errors the same way.
+func (m *Migrator) RestoreSnapshot(snapshot *Snapshot) error {
+	if snapshot.Manifest.GroupVersion != m.oldGroupVersion.String() {
+		return preflightErrorf("snapshot is of %s, but migrator is configured for %s", snapshot.Manifest.GroupVersion, m.oldGroupVersion)
+	}
+
+	if err := m.checkDestination(); err != nil {
+		return preflightError(err)
+	}
+
+	var snapshotResources []metav1.APIResource
+	for _, resource := range snapshot.Manifest.Resources {
+		snapshotResources = append(snapshotResources, metav1.APIResource{
+			Name:       resource.Name,
+			Kind:       resource.Kind,
+			Namespaced: resource.Namespaced,
+		})
+	}
+
+	resources, err := m.orderResources(snapshotResources)
+	if err != nil {
+		return preflightError(err)
+	}
+
+	m.recorder = newRunRecorder(m)
+
+	for _, resource := range resources {
+		if m.stopped() {
+			break
+		}
+
+		m.registerIfParent(resource)
+		m.migrateResourceItems(resource, func(handle pageHandler, _ func()) error {
+			return snapshot.readPages(resource.Name, m.pageSize, handle)
+		})
+	}
+
+	return m.runError()
+}
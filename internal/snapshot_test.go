@@ -0,0 +1,176 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/yaml"
+)
+
+func TestSnapshotAndRestore(t *testing.T) {
+	oldGV := schema.GroupVersion{Group: "old", Version: "v1"}
+	newGV := schema.GroupVersion{Group: "new", Version: "v2"}
+
+	source := newHarness(t, oldGV, schema.GroupVersion{}, nil, nil, nil, nil)
+	source.RegisterCRD(oldGV.WithResource("foo"))
+	source.AddResources(oldGV.WithResource("foo"),
+		objectBuilder("old/v1", "Foo", "obj-1").Namespace("ns-1").ResourceVersion("1").OwnerRef("old/v1", "Bar", "obj-1").Build(),
+		objectBuilder("old/v1", "Foo", "obj-2").Namespace("ns-1").ResourceVersion("2").Build(),
+	)
+	source.RegisterCRD(oldGV.WithResource("bar"))
+	source.AddResources(oldGV.WithResource("bar"),
+		objectBuilder("old/v1", "Bar", "obj-1").Namespace("ns-1").ResourceVersion("3").Build(),
+	)
+
+	dir, err := ioutil.TempDir("", "snapshot")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	archive := filepath.Join(dir, "snapshot.tar.gz")
+	require.NoError(t, source.migrator.Snapshot(archive))
+
+	snapshot, err := OpenSnapshot(archive)
+	require.NoError(t, err)
+	defer snapshot.Close()
+
+	assert.Equal(t, SnapshotVersion, snapshot.Manifest.Version)
+	assert.Equal(t, "old/v1", snapshot.Manifest.GroupVersion)
+	require.Len(t, snapshot.Manifest.Resources, 2)
+	assert.Equal(t, "bar", snapshot.Manifest.Resources[0].Name)
+	assert.Equal(t, 1, snapshot.Manifest.Resources[0].Count)
+	assert.Equal(t, "foo", snapshot.Manifest.Resources[1].Name)
+	assert.Equal(t, 2, snapshot.Manifest.Resources[1].Count)
+	assert.Equal(t, []SnapshotItem{
+		{Namespace: "ns-1", Name: "obj-1", ResourceVersion: "1"},
+		{Namespace: "ns-1", Name: "obj-2", ResourceVersion: "2"},
+	}, snapshot.Manifest.Resources[1].Items)
+	require.Len(t, snapshot.Manifest.CRDs, 2)
+	assert.Equal(t, "bar.old", snapshot.Manifest.CRDs[0].Name)
+	assert.Equal(t, "foo.old", snapshot.Manifest.CRDs[1].Name)
+
+	// restore into another cluster and group/version
+	dest := newHarness(t, oldGV, newGV, map[string]string{"ns-1": "ns-2"}, nil, nil, map[string]string{"bar": "foo"})
+	dest.RegisterCRD(newGV.WithResource("foo"))
+	dest.RegisterCRD(newGV.WithResource("bar"))
+	dest.migrator.pageSize = 1
+
+	require.NoError(t, dest.migrator.RestoreSnapshot(snapshot))
+
+	foos, err := dest.dynamicClient.Resource(newGV.WithResource("foo")).Namespace("ns-2").List(metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, foos.Items, 2)
+	for _, foo := range foos.Items {
+		assert.Equal(t, "new/v2", foo.GetAPIVersion())
+	}
+
+	foo, err := dest.dynamicClient.Resource(newGV.WithResource("foo")).Namespace("ns-2").Get("obj-1", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Len(t, foo.GetOwnerReferences(), 1)
+	assert.Equal(t, "new/v2", foo.GetOwnerReferences()[0].APIVersion)
+}
+
+func TestSnapshotIgnoresSelection(t *testing.T) {
+	oldGV := schema.GroupVersion{Group: "old", Version: "v1"}
+
+	h := newHarness(t, oldGV, schema.GroupVersion{}, nil, nil, nil, nil)
+	h.RegisterCRD(oldGV.WithResource("foo"))
+	h.AddResources(oldGV.WithResource("foo"),
+		objectBuilder("old/v1", "Foo", "obj-1").Namespace("ns-1").Labels(map[string]string{"app": "foo"}).Build(),
+		objectBuilder("old/v1", "Foo", "obj-2").Namespace("ns-1").Annotation("crd-migrator.vmware.com/skip", "true").Build(),
+		objectBuilder("old/v1", "Foo", "obj-3").Namespace("ns-2").Build(),
+	)
+	h.RegisterCRD(oldGV.WithResource("bar"))
+	h.AddResources(oldGV.WithResource("bar"), objectBuilder("old/v1", "Bar", "obj-1").Namespace("ns-1").Build())
+
+	h.migrator.optOutAnnotation = "crd-migrator.vmware.com/skip"
+	h.migrator.includeResources = []string{"foo"}
+	h.migrator.labelSelector = "app=foo"
+	h.migrator.namespaces = []string{"ns-1"}
+
+	dir, err := ioutil.TempDir("", "snapshot")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	archive := filepath.Join(dir, "snapshot.tar.gz")
+	require.NoError(t, h.migrator.Snapshot(archive))
+
+	snapshot, err := OpenSnapshot(archive)
+	require.NoError(t, err)
+	defer snapshot.Close()
+
+	// every resource and item is saved, including the opted-out obj-2
+	require.Len(t, snapshot.Manifest.Resources, 2)
+	assert.Equal(t, "bar", snapshot.Manifest.Resources[0].Name)
+	assert.Equal(t, 1, snapshot.Manifest.Resources[0].Count)
+	assert.Equal(t, "foo", snapshot.Manifest.Resources[1].Name)
+	assert.Equal(t, []SnapshotItem{
+		{Namespace: "ns-1", Name: "obj-1"},
+		{Namespace: "ns-1", Name: "obj-2"},
+		{Namespace: "ns-2", Name: "obj-3"},
+	}, snapshot.Manifest.Resources[1].Items)
+}
+
+func TestRestoreDoesNotDiscoverSource(t *testing.T) {
+	dest := newHarness(t, schema.GroupVersion{}, schema.GroupVersion{}, nil, nil, nil, nil)
+	// the old group has been deleted from the source cluster
+	source := &fakediscovery.FakeDiscovery{Fake: new(k8stesting.Fake)}
+
+	options := Options{OldGroupVersion: "old/v1", NewGroupVersion: "new/v2", Workers: 1, OnConflict: "skip", Restore: true}
+	env := Environment{
+		SourceDynamicClient:   dest.dynamicClient,
+		SourceDiscoveryClient: source,
+		DestDynamicClient:     dest.dynamicClient,
+		DestDiscoveryClient:   dest.discoveryClient,
+		Log:                   discardLogger(),
+	}
+	_, err := NewMigratorForEnvironment(options, env)
+	require.NoError(t, err)
+	assert.Empty(t, source.Actions())
+
+	options.NewGroupVersion = "new"
+	_, err = NewMigratorForEnvironment(options, env)
+	assert.EqualError(t, err, "a snapshot can only be restored into a groupVersion, not group new")
+}
+
+func TestOpenSnapshotChecksumMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	manifest, err := yaml.Marshal(SnapshotManifest{
+		Version:      SnapshotVersion,
+		GroupVersion: "old/v1",
+		Resources: []SnapshotResource{
+			{Name: "foo", Kind: "Foo", File: "resources/foo.yaml", SHA256: sha256Hex([]byte("original")), Count: 1},
+		},
+	})
+	require.NoError(t, err)
+
+	archive := filepath.Join(dir, "snapshot.tar.gz")
+	f, err := os.Create(archive)
+	require.NoError(t, err)
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	require.NoError(t, writeTarFile(tw, "resources/foo.yaml", []byte("modified")))
+	require.NoError(t, writeTarFile(tw, snapshotManifestFile, manifest))
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	require.NoError(t, f.Close())
+
+	_, err = OpenSnapshot(archive)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "checksum mismatch for resources/foo.yaml")
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+)
+
+// subresources are the subresources enabled on a CRD in the new
+// group/version. When the status subresource is enabled, the API server
+// ignores status on create, so it has to be written with a separate
+// request. The scale subresource needs none: it reads and writes the
+// replicas at its specReplicasPath and statusReplicasPath, which are
+// created with the rest of the item and written with its status.
+type subresources struct {
+	status bool
+}
+
+// getSubresources reads the subresources enabled on the new CRD of
+// resource.
+func (m *Migrator) getSubresources(resource metav1.APIResource) (subresources, error) {
+	crdName := fmt.Sprintf("%s.%s", resource.Name, m.newGroupVersion.Group)
+	crd, err := m.destCRDClient.Get(crdName, metav1.GetOptions{})
+	if err != nil {
+		return subresources{}, errors.WithStack(err)
+	}
+
+	// apiextensions.k8s.io/v1 only has per-version subresources, v1beta1
+	// has either per-version or top-level subresources
+	crdSubresources, _, _ := unstructured.NestedMap(crd.Object, "spec", "subresources")
+	versions, _, _ := unstructured.NestedSlice(crd.Object, "spec", "versions")
+	for _, v := range versions {
+		version, ok := v.(map[string]interface{})
+		if ok && version["name"] == m.newGroupVersion.Version {
+			if versionSubresources, found, _ := unstructured.NestedMap(version, "subresources"); found {
+				crdSubresources = versionSubresources
+			}
+		}
+	}
+
+	var result subresources
+
+	if _, exists, _ := unstructured.NestedMap(crdSubresources, "status"); exists {
+		result.status = true
+	}
+
+	return result, nil
+}
+
+// migrateSubresources writes the fields of item that are covered by the
+// enabled subresources to createdItem, which was created from item, and
+// returns the updated item.
+func (m *Migrator) migrateSubresources(
+	log logrus.FieldLogger,
+	client dynamic.ResourceInterface,
+	subresources subresources,
+	item, createdItem *unstructured.Unstructured,
+) (*unstructured.Unstructured, error) {
+	if status, hasStatus := item.Object["status"]; subresources.status && hasStatus {
+		log.Info("Updating item status")
+
+		createdItem = createdItem.DeepCopy()
+		createdItem.Object["status"] = status
+
+		updated, err := client.UpdateStatus(createdItem, metav1.UpdateOptions{})
+		if err != nil {
+			return nil, errors.Wrap(err, "error updating status")
+		}
+		createdItem = updated
+	}
+
+	return createdItem, nil
+}
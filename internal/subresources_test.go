@@ -0,0 +1,103 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestMigrateStatusSubresource(t *testing.T) {
+	oldGV := schema.GroupVersion{Group: "old", Version: "v1"}
+	newGV := schema.GroupVersion{Group: "new", Version: "v1"}
+
+	h := newHarness(t, oldGV, newGV, nil, nil, nil, nil)
+
+	item := objectBuilder("old/v1", "Foo", "obj-1").Build()
+	require.NoError(t, unstructured.SetNestedField(item.Object, int64(3), "spec", "replicas"))
+	require.NoError(t, unstructured.SetNestedField(item.Object, "Ready", "status", "phase"))
+
+	h.RegisterCRD(oldGV.WithResource("foo"))
+	h.AddResources(oldGV.WithResource("foo"), item)
+	h.RegisterCRD(newGV.WithResource("foo"))
+
+	crd, err := h.migrator.destCRDClient.Get("foo.new", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.NoError(t, unstructured.SetNestedMap(crd.Object, map[string]interface{}{}, "spec", "subresources", "status"))
+	require.NoError(t, unstructured.SetNestedMap(crd.Object, map[string]interface{}{
+		"specReplicasPath":   ".spec.replicas",
+		"statusReplicasPath": ".status.replicas",
+	}, "spec", "subresources", "scale"))
+	_, err = h.migrator.destCRDClient.Update(crd, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	// like the API server, ignore status on create
+	var statusUpdates int
+	h.dynamicClient.PrependReactor("create", "foo", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		unstructured.RemoveNestedField(action.(k8stesting.CreateAction).GetObject().(*unstructured.Unstructured).Object, "status")
+		return false, nil, nil
+	})
+	h.dynamicClient.PrependReactor("update", "foo", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() == "status" {
+			statusUpdates++
+		}
+		return false, nil, nil
+	})
+
+	h.migrator.MigrateAllResources()
+
+	assert.Equal(t, 1, statusUpdates)
+
+	migrated, err := h.dynamicClient.Resource(newGV.WithResource("foo")).Get("obj-1", metav1.GetOptions{})
+	require.NoError(t, err)
+
+	phase, _, _ := unstructured.NestedString(migrated.Object, "status", "phase")
+	assert.Equal(t, "Ready", phase)
+	replicas, _, _ := unstructured.NestedInt64(migrated.Object, "spec", "replicas")
+	assert.Equal(t, int64(3), replicas)
+}
+
+func TestMigrateScaleSubresource(t *testing.T) {
+	oldGV := schema.GroupVersion{Group: "old", Version: "v1"}
+	newGV := schema.GroupVersion{Group: "new", Version: "v1"}
+
+	h := newHarness(t, oldGV, newGV, nil, nil, nil, nil)
+
+	item := objectBuilder("old/v1", "Foo", "obj-1").Build()
+	require.NoError(t, unstructured.SetNestedField(item.Object, int64(3), "spec", "replicas"))
+
+	h.RegisterCRD(oldGV.WithResource("foo"))
+	h.AddResources(oldGV.WithResource("foo"), item)
+	h.RegisterCRD(newGV.WithResource("foo"))
+
+	crd, err := h.migrator.destCRDClient.Get("foo.new", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.NoError(t, unstructured.SetNestedMap(crd.Object, map[string]interface{}{
+		"specReplicasPath":   ".spec.replicas",
+		"statusReplicasPath": ".status.replicas",
+	}, "spec", "subresources", "scale"))
+	_, err = h.migrator.destCRDClient.Update(crd, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	_, err = h.migrator.MigrateAllResources()
+	require.NoError(t, err)
+
+	// the replicas are created with the item, so the scale subresource
+	// reports them without a request of its own
+	for _, action := range h.dynamicClient.Actions() {
+		assert.NotEqual(t, "scale", action.GetSubresource(), "%s of %s", action.GetVerb(), action.GetResource())
+	}
+
+	migrated, err := h.dynamicClient.Resource(newGV.WithResource("foo")).Get("obj-1", metav1.GetOptions{})
+	require.NoError(t, err)
+	replicas, _, _ := unstructured.NestedInt64(migrated.Object, "spec", "replicas")
+	assert.Equal(t, int64(3), replicas)
+}
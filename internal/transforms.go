@@ -0,0 +1,95 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"encoding/json"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// transform is a Transform that has been validated.
+type transform struct {
+	pattern string
+	patch   jsonpatch.Patch
+}
+
+// parseTransforms validates transforms and decodes their patches.
+func parseTransforms(transforms []Transform) ([]transform, error) {
+	var parsed []transform
+	for i, t := range transforms {
+		if err := validatePatterns("transform", []string{t.Resources}); err != nil {
+			return nil, err
+		}
+		if errs := validateTransformPatch(field.NewPath("transforms").Index(i).Child("patch"), t.Patch); len(errs) > 0 {
+			return nil, errs.ToAggregate()
+		}
+
+		patch, err := jsonpatch.DecodePatch(t.Patch)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid patch of transform of resources %q", t.Resources)
+		}
+		parsed = append(parsed, transform{pattern: t.Resources, patch: patch})
+	}
+	return parsed, nil
+}
+
+// validateTransformPatch checks that patch is a list of JSON patch
+// operations, which are only applied to items once they're migrated.
+func validateTransformPatch(fldPath *field.Path, patch []byte) field.ErrorList {
+	var operations []map[string]interface{}
+	if err := json.Unmarshal(patch, &operations); err != nil || len(operations) == 0 {
+		return field.ErrorList{field.Invalid(fldPath, string(patch), "must be a list of JSON patch operations")}
+	}
+
+	var errs field.ErrorList
+	for i, operation := range operations {
+		switch op := operation["op"]; op {
+		case "add", "remove", "replace", "move", "copy", "test":
+		default:
+			errs = append(errs, field.NotSupported(fldPath.Index(i).Child("op"), op, []string{"add", "remove", "replace", "move", "copy", "test"}))
+		}
+		if path, ok := operation["path"].(string); !ok || !strings.HasPrefix(path, "/") {
+			errs = append(errs, field.Invalid(fldPath.Index(i).Child("path"), operation["path"], "must be a JSON pointer, e.g. /spec/replicas"))
+		}
+	}
+	return errs
+}
+
+// applyTransforms applies the transforms of resource, in order, to item,
+// which has been prepared for create. Transforms can't change the name or
+// namespace of an item, which identify it in the new group/version.
+func (m *Migrator) applyTransforms(log logrus.FieldLogger, resource string, item *unstructured.Unstructured) error {
+	namespace, name := item.GetNamespace(), item.GetName()
+
+	for i, t := range m.transforms {
+		if !matchesAny([]string{t.pattern}, resource) {
+			continue
+		}
+
+		log.WithField("transform", i).Debug("Transforming item")
+		data, err := item.MarshalJSON()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		patched, err := t.patch.Apply(data)
+		if err != nil {
+			return errors.Wrapf(err, "error applying transform %d", i)
+		}
+		if err := item.UnmarshalJSON(patched); err != nil {
+			return errors.Wrapf(err, "error decoding item transformed by transform %d", i)
+		}
+
+		if item.GetNamespace() != namespace || item.GetName() != name {
+			return errors.Errorf("transform %d changed the name or namespace of the item", i)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestMigrateTransforms(t *testing.T) {
+	oldGV := schema.GroupVersion{Group: "old", Version: "v1"}
+	newGV := schema.GroupVersion{Group: "new", Version: "v1"}
+
+	h := newHarness(t, oldGV, newGV, nil, nil, nil, nil)
+	transforms, err := parseTransforms([]Transform{
+		{Resources: "foo*", Patch: []byte(`[{"op":"remove","path":"/spec/legacy"},{"op":"add","path":"/spec/replicas","value":3}]`)},
+		{Resources: "bar", Patch: []byte(`[{"op":"replace","path":"/metadata/name","value":"renamed"}]`)},
+	})
+	require.NoError(t, err)
+	h.migrator.transforms = transforms
+
+	foo := objectBuilder("old/v1", "Foo", "obj-1").Namespace("ns-1").Build()
+	require.NoError(t, unstructured.SetNestedField(foo.Object, "yes", "spec", "legacy"))
+	h.RegisterCRD(oldGV.WithResource("foo"))
+	h.AddResources(oldGV.WithResource("foo"), foo)
+	h.RegisterCRD(oldGV.WithResource("bar"))
+	h.AddResources(oldGV.WithResource("bar"), objectBuilder("old/v1", "Bar", "obj-1").Namespace("ns-1").Build())
+	h.RegisterCRD(newGV.WithResource("foo"))
+	h.RegisterCRD(newGV.WithResource("bar"))
+
+	report, err := h.migrator.MigrateAllResources()
+	require.Error(t, err)
+
+	item, err := h.dynamicClient.Resource(newGV.WithResource("foo")).Namespace("ns-1").Get("obj-1", metav1.GetOptions{})
+	require.NoError(t, err)
+	spec, _, _ := unstructured.NestedMap(item.Object, "spec")
+	assert.Equal(t, map[string]interface{}{"replicas": int64(3)}, spec)
+
+	// transforms can't rename items
+	require.Len(t, report.Resources, 2)
+	require.Len(t, report.Resources[0].Failed, 1)
+	assert.Equal(t, "transform 1 changed the name or namespace of the item", report.Resources[0].Failed[0].Reason)
+
+	// the transformed item is what verify expects
+	h.migrator.transforms = transforms[:1]
+	verifyReport, err := h.migrator.Verify()
+	require.NoError(t, err)
+	for _, resource := range verifyReport.Resources {
+		if resource.Name == "foo" {
+			assert.Equal(t, []string{"ns-1/obj-1"}, resource.Matching)
+		}
+	}
+}
+
+func TestParseTransforms(t *testing.T) {
+	_, err := parseTransforms([]Transform{{Resources: "foo[", Patch: []byte(`[]`)}})
+	assert.EqualError(t, err, `invalid transform pattern "foo["`)
+
+	_, err = parseTransforms([]Transform{{Resources: "foo", Patch: []byte(`{"op":"remove","path":"/spec"}`)}})
+	assert.EqualError(t, err, `transforms[0].patch: Invalid value: "{\"op\":\"remove\",\"path\":\"/spec\"}": must be a list of JSON patch operations`)
+}
@@ -0,0 +1,280 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// VerifyReport is the result of comparing every item in the old
+// group/version with its counterpart in the new group/version. It is
+// produced by Migrator.Verify.
+type VerifyReport struct {
+	// Resources are listed in migration order.
+	Resources []*VerifyResource
+}
+
+// VerifyResource sorts the items of a resource by how they compare to
+// their counterparts.
+type VerifyResource struct {
+	Name string
+	// Matching are the items whose counterpart is what migrating them
+	// would create.
+	Matching []string
+	// Missing are the items that have no counterpart.
+	Missing []string
+	// Different are the items whose counterpart differs from what migrating
+	// them would create.
+	Different []string
+	// Extra are the items in the new group/version that no item was
+	// migrated to.
+	Extra []string
+}
+
+// MismatchCount returns the number of items that are missing, different
+// or extra.
+func (r *VerifyReport) MismatchCount() int {
+	count := 0
+	for _, resource := range r.Resources {
+		count += len(resource.Missing) + len(resource.Different) + len(resource.Extra)
+	}
+	return count
+}
+
+// PrintSummary writes a table of the item counts per resource to out.
+func (r *VerifyReport) PrintSummary(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "RESOURCE\tMATCHING\tMISSING\tDIFFERENT\tEXTRA")
+	for _, resource := range r.Resources {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n",
+			resource.Name, len(resource.Matching), len(resource.Missing), len(resource.Different), len(resource.Extra))
+	}
+	return errors.WithStack(w.Flush())
+}
+
+// Verify computes the item that migrating each item in the old
+// group/version would create, with the same mappings, and compares its
+// data, status, labels, annotations and ownerRefs with its counterpart in
+// the new group/version. Nothing is changed in the cluster.
+func (m *Migrator) Verify() (*VerifyReport, error) {
+	if err := m.checkDestination(); err != nil {
+		return nil, err
+	}
+
+	resources, _, err := m.discoverResources()
+	if err != nil {
+		return nil, err
+	}
+
+	// with a label or field selector, the items in the new group/version
+	// can't be told apart from those of unselected items
+	checkExtra := m.labelSelector == "" && m.fieldSelector == ""
+	if !checkExtra {
+		m.log.Info("Not checking for extra items because items are selected with --selector or --field-selector")
+	}
+
+	report := new(VerifyReport)
+
+	// parents are verified first, so that the expected ownerRefs of their
+	// children point to their counterparts
+	for _, resource := range resources {
+		log := m.log.WithField("resource", resource.Name)
+		log.Info("Verifying items against new API group")
+
+		compared, err := m.compareItems(log, resource)
+		if err != nil {
+			return nil, err
+		}
+
+		verified := &VerifyResource{
+			Name:      resource.Name,
+			Missing:   compared.missing,
+			Different: compared.different,
+		}
+		for i := range compared.matching {
+			verified.Matching = append(verified.Matching, itemID(compared.matching[i].GetNamespace(), compared.matching[i].GetName()))
+		}
+
+		if checkExtra {
+			for id, counterpart := range compared.uncompared {
+				if m.isSelectedTargetNamespace(resource, counterpart.GetNamespace()) {
+					log.WithField("id", id).Warn("Item in new API group wasn't migrated from the old API group")
+					verified.Extra = append(verified.Extra, id)
+				}
+			}
+			sort.Strings(verified.Extra)
+		}
+
+		report.Resources = append(report.Resources, verified)
+	}
+
+	return report, nil
+}
+
+// comparedItems sorts the items of a resource in the old group/version by
+// how they compare to their counterparts in the new group/version.
+type comparedItems struct {
+	// matching are the items whose counterpart is what migrating them
+	// would create.
+	matching []unstructured.Unstructured
+	// missing and different are the IDs of the items without a counterpart
+	// and of those whose counterpart differs.
+	missing, different []string
+	// uncompared are the items in the new group/version that no item was
+	// migrated to, keyed by ID.
+	uncompared map[string]*unstructured.Unstructured
+}
+
+// compareItems computes the item that migrating each item of resource in
+// the old group/version would create, and compares it with differentFields
+// to its counterpart in the new group/version. The items of the parents
+// of resource have to be compared first, so that the expected ownerRefs
+// point to their counterparts.
+func (m *Migrator) compareItems(log logrus.FieldLogger, resource metav1.APIResource) (*comparedItems, error) {
+	items, err := m.listAllItems(resource)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing %s", resource.Name)
+	}
+
+	newItems, err := m.listNewItems(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	m.registerIfParent(resource)
+	compared := &comparedItems{uncompared: make(map[string]*unstructured.Unstructured)}
+	for i := range newItems {
+		m.createdItemsTracker.registerCreatedItem(&newItems[i])
+		compared.uncompared[itemID(newItems[i].GetNamespace(), newItems[i].GetName())] = &newItems[i]
+	}
+
+	for i := range items {
+		id := itemID(items[i].GetNamespace(), items[i].GetName())
+
+		expected := items[i].DeepCopy()
+		if !resource.Namespaced {
+			expected.SetNamespace("")
+		}
+		// transforms, the only part that can fail, keep the name and
+		// namespace, so the counterpart is found either way
+		err := m.prepareForCreate(log.WithField("id", id), resource.Name, expected)
+
+		targetID := itemID(expected.GetNamespace(), expected.GetName())
+		counterpart, found := compared.uncompared[targetID]
+		delete(compared.uncompared, targetID)
+
+		if err != nil {
+			log.WithField("id", id).WithError(err).Warn("Unable to compute the migrated item")
+			compared.different = append(compared.different, id)
+			continue
+		}
+
+		if !found {
+			log.WithField("id", id).Warn("Item has no counterpart in new API group")
+			compared.missing = append(compared.missing, id)
+			continue
+		}
+
+		if fields := differentFields(expected, counterpart); len(fields) > 0 {
+			log.WithField("id", id).WithField("fields", strings.Join(fields, ",")).Warn("Item differs from its counterpart in new API group")
+			compared.different = append(compared.different, id)
+			continue
+		}
+
+		compared.matching = append(compared.matching, items[i])
+	}
+
+	return compared, nil
+}
+
+// isSelectedTargetNamespace returns whether namespace is the target
+// namespace of a namespace selected by --namespaces and
+// --exclude-namespaces.
+func (m *Migrator) isSelectedTargetNamespace(resource metav1.APIResource, namespace string) bool {
+	if !resource.Namespaced {
+		return true
+	}
+
+	for excluded := range m.excludeNamespaces {
+		if m.getTargetNamespace(excluded) == namespace {
+			return false
+		}
+	}
+
+	if len(m.namespaces) == 0 {
+		return true
+	}
+	for _, selected := range m.namespaces {
+		if m.getTargetNamespace(selected) == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// differentFields returns the names of the fields in which actual differs
+// from expected, ignoring the metadata that is set by the API server.
+func differentFields(expected, actual *unstructured.Unstructured) []string {
+	var fields []string
+
+	topLevel := make(stringSet)
+	for field := range expected.Object {
+		topLevel.add(field)
+	}
+	for field := range actual.Object {
+		topLevel.add(field)
+	}
+	for field := range topLevel {
+		switch field {
+		case "apiVersion", "kind", "metadata":
+		default:
+			if !reflect.DeepEqual(expected.Object[field], actual.Object[field]) {
+				fields = append(fields, field)
+			}
+		}
+	}
+
+	if !sameStringMaps(expected.GetLabels(), actual.GetLabels()) {
+		fields = append(fields, "labels")
+	}
+
+	// the migrated content depends on how the item was migrated
+	expectedAnnotations, actualAnnotations := expected.GetAnnotations(), actual.GetAnnotations()
+	delete(expectedAnnotations, migratedContentAnnotation)
+	delete(actualAnnotations, migratedContentAnnotation)
+	if !sameStringMaps(expectedAnnotations, actualAnnotations) {
+		fields = append(fields, "annotations")
+	}
+
+	expectedOwnerRefs, actualOwnerRefs := expected.GetOwnerReferences(), actual.GetOwnerReferences()
+	if (len(expectedOwnerRefs) > 0 || len(actualOwnerRefs) > 0) && !reflect.DeepEqual(expectedOwnerRefs, actualOwnerRefs) {
+		fields = append(fields, "ownerReferences")
+	}
+
+	sort.Strings(fields)
+	return fields
+}
+
+// sameStringMaps compares two maps, treating nil and empty maps as equal.
+func sameStringMaps(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, found := b[key]; !found || other != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestVerify(t *testing.T) {
+	oldGV := schema.GroupVersion{Group: "old", Version: "v1"}
+	newGV := schema.GroupVersion{Group: "new", Version: "v1"}
+
+	h := newHarness(t, oldGV, newGV, map[string]string{"ns-1": "ns-2"}, map[string]string{"old": "new"}, nil, map[string]string{"bar": "foo"})
+
+	h.RegisterCRD(oldGV.WithResource("foo"))
+	h.AddResources(oldGV.WithResource("foo"),
+		objectBuilder("old/v1", "Foo", "obj-1").Namespace("ns-1").Labels(map[string]string{"old/app": "foo"}).OwnerRef("old/v1", "Bar", "obj-1").Build(),
+		objectBuilder("old/v1", "Foo", "obj-2").Namespace("ns-1").Build(),
+		objectBuilder("old/v1", "Foo", "obj-3").Namespace("ns-1").Build(),
+	)
+	h.RegisterCRD(oldGV.WithResource("bar"))
+	h.AddResources(oldGV.WithResource("bar"),
+		objectBuilder("old/v1", "Bar", "obj-1").Namespace("ns-1").Build(),
+	)
+	h.RegisterCRD(newGV.WithResource("foo"))
+	h.RegisterCRD(newGV.WithResource("bar"))
+
+	h.migrator.MigrateAllResources()
+
+	// obj-2 is changed, obj-3 is deleted and obj-4 was never in the old
+	// API group
+	changed := objectBuilder("new/v1", "Foo", "obj-2").Namespace("ns-2").Build()
+	require.NoError(t, unstructured.SetNestedField(changed.Object, "changed", "spec", "field"))
+	require.NoError(t, h.dynamicClient.Resource(newGV.WithResource("foo")).Namespace("ns-2").Delete("obj-2", nil))
+	require.NoError(t, h.dynamicClient.Resource(newGV.WithResource("foo")).Namespace("ns-2").Delete("obj-3", nil))
+	h.AddResources(newGV.WithResource("foo"),
+		changed,
+		objectBuilder("new/v1", "Foo", "obj-4").Namespace("ns-2").Build(),
+	)
+
+	report, err := h.migrator.Verify()
+	require.NoError(t, err)
+
+	assert.Equal(t, []*VerifyResource{
+		{Name: "bar", Matching: []string{"ns-1/obj-1"}},
+		{
+			Name:      "foo",
+			Matching:  []string{"ns-1/obj-1"},
+			Missing:   []string{"ns-1/obj-3"},
+			Different: []string{"ns-1/obj-2"},
+			Extra:     []string{"ns-2/obj-4"},
+		},
+	}, report.Resources)
+	assert.Equal(t, 3, report.MismatchCount())
+
+	out := new(bytes.Buffer)
+	require.NoError(t, report.PrintSummary(out))
+	assert.Equal(t, `RESOURCE  MATCHING  MISSING  DIFFERENT  EXTRA
+bar       1         0        0          0
+foo       1         1        1          1
+`, out.String())
+}
+
+func TestDifferentFields(t *testing.T) {
+	expected := objectBuilder("new/v1", "Foo", "obj-1").Labels(map[string]string{"app": "foo"}).Build()
+	require.NoError(t, unstructured.SetNestedField(expected.Object, "a", "spec", "field"))
+
+	actual := expected.DeepCopy()
+	actual.SetResourceVersion("42")
+	actual.SetAnnotations(map[string]string{migratedContentAnnotation: "abc"})
+	assert.Empty(t, differentFields(expected, actual))
+
+	require.NoError(t, unstructured.SetNestedField(actual.Object, "b", "spec", "field"))
+	require.NoError(t, unstructured.SetNestedField(actual.Object, "Ready", "status", "phase"))
+	actual.SetLabels(nil)
+	assert.Equal(t, []string{"labels", "spec", "status"}, differentFields(expected, actual))
+}
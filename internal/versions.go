@@ -0,0 +1,262 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+)
+
+// When --from and --to are groups without a version, the resources of the
+// old group are read at a version they serve: the storage version of
+// their CRD, or if it doesn't say, the group's preferred version. Each is
+// written at the version of the new group its version maps to with
+// --version-mappings. All versions of a resource serve the same items, so
+// reading every resource at one version migrates each item once.
+//
+// The resources read at the same version are migrated by one migrator of
+// a run of several group/versions, see groups.go. Commands other than
+// migrate, which work with one group/version, set Options.OneVersion to
+// read every resource at one version instead: the preferred version of the
+// group, or if some resources aren't served there, the first version that
+// serves all of them.
+
+// isGroup returns whether a --from or --to value is a group without a
+// version.
+func isGroup(value string) bool {
+	return value != "" && !strings.Contains(value, "/")
+}
+
+// splitGroupVersionMapping splits an old:new mapping of --group-versions.
+func splitGroupVersionMapping(mapping string) (string, string, error) {
+	parts := strings.Split(mapping, ":")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.Errorf("invalid group-version mapping %q", mapping)
+	}
+	return parts[0], parts[1], nil
+}
+
+// resolveVersions returns options with the pairs of groups in --from,
+// --to and --group-versions replaced by pairs of the group/versions their
+// resources are read and written at. It also returns the resources that
+// are read at each old group/version it added.
+func resolveVersions(options Options, discoveryClient discovery.ServerResourcesInterface, crdClient dynamic.ResourceInterface) (Options, map[string]stringSet, error) {
+	pairs := [][2]string{{options.OldGroupVersion, options.NewGroupVersion}}
+	for _, mapping := range options.GroupVersionMappings {
+		from, to, err := splitGroupVersionMapping(mapping)
+		if err != nil {
+			return options, nil, err
+		}
+		pairs = append(pairs, [2]string{from, to})
+	}
+
+	versionMappings, err := parseMappings("version", options.VersionMappings)
+	if err != nil {
+		return options, nil, err
+	}
+
+	var (
+		resolved    [][2]string
+		onlyReadAt  = make(map[string]stringSet)
+		oldGroups   = make(stringSet)
+		oldVersions = make(stringSet)
+	)
+
+	for _, pair := range pairs {
+		from, to := pair[0], pair[1]
+
+		// every version serves the same items, so a group can only be
+		// migrated once
+		group := strings.SplitN(from, "/", 2)[0]
+		if oldGroups.has(group) {
+			return options, nil, errors.Errorf("group %s is migrated more than once", group)
+		}
+		oldGroups.add(group)
+
+		if !isGroup(from) && !isGroup(to) {
+			resolved = append(resolved, pair)
+			continue
+		}
+		// a snapshot only has --from
+		if !isGroup(from) || !isGroup(to) && to != "" {
+			return options, nil, errors.Errorf("%s and %s must both be groups or both be groupVersions", from, to)
+		}
+
+		versions, readAt, served, err := readVersions(discoveryClient, crdClient, from)
+		if err != nil {
+			return options, nil, errors.Wrapf(err, "error discovering versions of group %s", from)
+		}
+
+		if options.OneVersion {
+			version, ok := commonVersion(versions, served)
+			if !ok {
+				return options, nil, errors.Errorf("no version of group %s serves all of its resources, give --from and --to with a version", from)
+			}
+			for resource := range readAt {
+				readAt[resource] = version
+			}
+		}
+
+		for _, version := range versions {
+			oldVersions.add(version)
+
+			resources := make(stringSet)
+			for resource, readVersion := range readAt {
+				if readVersion == version {
+					resources.add(resource)
+				}
+			}
+			if len(resources) == 0 {
+				continue
+			}
+
+			newVersion := version
+			if mapped, ok := versionMappings[version]; ok {
+				newVersion = mapped
+			}
+
+			oldGroupVersion := schema.GroupVersion{Group: from, Version: version}
+			var newGroupVersion string
+			if to != "" {
+				newGroupVersion = schema.GroupVersion{Group: to, Version: newVersion}.String()
+			}
+			resolved = append(resolved, [2]string{oldGroupVersion.String(), newGroupVersion})
+			onlyReadAt[oldGroupVersion.String()] = resources
+		}
+	}
+
+	if len(onlyReadAt) == 0 && len(versionMappings) > 0 {
+		return options, nil, errors.New("--version-mappings requires groups without versions in --from and --to")
+	}
+	for version := range versionMappings {
+		if !oldVersions.has(version) {
+			return options, nil, errors.Errorf("version %s from --version-mappings isn't served by the old groups", version)
+		}
+	}
+	if len(resolved) == 0 {
+		return options, nil, errors.Errorf("group %s doesn't have any resources", pairs[0][0])
+	}
+
+	options.OldGroupVersion, options.NewGroupVersion = resolved[0][0], resolved[0][1]
+	options.GroupVersionMappings = nil
+	for _, pair := range resolved[1:] {
+		options.GroupVersionMappings = append(options.GroupVersionMappings, pair[0]+":"+pair[1])
+	}
+
+	return options, onlyReadAt, nil
+}
+
+// readVersions returns the versions served for group, preferred first,
+// the version each of its resources is read at and the versions each is
+// served at.
+func readVersions(discoveryClient discovery.ServerResourcesInterface, crdClient dynamic.ResourceInterface, group string) ([]string, map[string]string, map[string][]string, error) {
+	lists, err := discoveryClient.ServerResources()
+	// other groups that can't be discovered don't matter
+	if err != nil && !discovery.IsGroupDiscoveryFailedError(err) {
+		return nil, nil, nil, errors.WithStack(err)
+	}
+
+	var versions []string
+	served := make(map[string][]string)
+	for _, list := range lists {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil || gv.Group != group {
+			continue
+		}
+
+		versions = append(versions, gv.Version)
+		for _, resource := range list.APIResources {
+			if !strings.Contains(resource.Name, "/") {
+				served[resource.Name] = append(served[resource.Name], gv.Version)
+			}
+		}
+	}
+	if len(versions) == 0 {
+		return nil, nil, nil, errors.Errorf("group %s is not served by the source cluster", group)
+	}
+
+	readAt := make(map[string]string)
+	for resource, resourceVersions := range served {
+		storage, err := storageVersion(crdClient, resource+"."+group)
+		if err != nil {
+			return nil, nil, nil, errors.Wrapf(err, "error reading CRD of %s", resource)
+		}
+
+		readAt[resource] = resourceVersions[0]
+		for _, version := range resourceVersions {
+			if version == storage {
+				readAt[resource] = storage
+			}
+		}
+	}
+
+	return versions, readAt, served, nil
+}
+
+// commonVersion returns the first of versions that serves every
+// resource in served.
+func commonVersion(versions []string, served map[string][]string) (string, bool) {
+	resources := make(map[string]int)
+	for _, resourceVersions := range served {
+		for _, version := range resourceVersions {
+			resources[version]++
+		}
+	}
+
+	for _, version := range versions {
+		if resources[version] == len(served) {
+			return version, true
+		}
+	}
+	return "", false
+}
+
+// storageVersion returns the version the CRD called name stores its items
+// at, or "" if there is no such CRD, e.g. because the resource is served
+// by an aggregated API server.
+func storageVersion(crdClient dynamic.ResourceInterface, name string) (string, error) {
+	crd, err := crdClient.Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	versions, _, _ := unstructured.NestedSlice(crd.Object, "spec", "versions")
+	for _, v := range versions {
+		if version, ok := v.(map[string]interface{}); ok && version["storage"] == true {
+			name, _ := version["name"].(string)
+			return name, nil
+		}
+	}
+
+	// v1beta1 CRDs with one version may only set spec.version
+	version, _, _ := unstructured.NestedString(crd.Object, "spec", "version")
+	return version, nil
+}
+
+// resourcesReadHere returns the resources, and their subresources, that m
+// reads at its old version. In a run of groups without versions, the
+// other resources are read at another version by another migrator.
+func (m *Migrator) resourcesReadHere(resources []metav1.APIResource) []metav1.APIResource {
+	if m.onlyResources == nil {
+		return resources
+	}
+
+	var here []metav1.APIResource
+	for _, resource := range resources {
+		if m.onlyResources.has(strings.SplitN(resource.Name, "/", 2)[0]) {
+			here = append(here, resource)
+		}
+	}
+	return here
+}
@@ -0,0 +1,200 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// newVersionsHarness returns a harness whose old group my.example.com
+// serves foo and bar at v1beta1 and v1alpha1. foo is stored at v1beta1 and
+// bar at v1alpha1.
+func newVersionsHarness(t *testing.T) *migratorHarness {
+	v1beta1 := schema.GroupVersion{Group: "my.example.com", Version: "v1beta1"}
+	v1alpha1 := schema.GroupVersion{Group: "my.example.com", Version: "v1alpha1"}
+	newGV := schema.GroupVersion{Group: "someapp.io", Version: "v1"}
+
+	h := newHarness(t, v1beta1, newGV, nil, nil, nil, nil)
+	h.RegisterCRD(v1beta1.WithResource("foo"))
+	h.RegisterCRD(v1beta1.WithResource("bar"))
+	h.RegisterCRD(newGV.WithResource("foo"))
+	h.RegisterCRD(newGV.WithResource("bar"))
+
+	// the CRDs of the old group are already registered, so v1alpha1 is
+	// only added to discovery
+	h.discoveryClient.Resources = append(h.discoveryClient.Resources, &metav1.APIResourceList{
+		GroupVersion: v1alpha1.String(),
+		APIResources: h.discoveryClient.Resources[0].APIResources,
+	})
+
+	for name, storage := range map[string]string{"foo.my.example.com": "v1beta1", "bar.my.example.com": "v1alpha1"} {
+		crd, err := h.migrator.sourceCRDClient.Get(name, metav1.GetOptions{})
+		require.NoError(t, err)
+
+		require.NoError(t, unstructured.SetNestedSlice(crd.Object, []interface{}{
+			map[string]interface{}{"name": "v1beta1", "served": true, "storage": storage == "v1beta1"},
+			map[string]interface{}{"name": "v1alpha1", "served": true, "storage": storage == "v1alpha1"},
+		}, "spec", "versions"))
+
+		_, err = h.migrator.sourceCRDClient.Update(crd, metav1.UpdateOptions{})
+		require.NoError(t, err)
+	}
+
+	return h
+}
+
+func TestResolveVersions(t *testing.T) {
+	h := newVersionsHarness(t)
+
+	options, onlyReadAt, err := resolveVersions(Options{
+		OldGroupVersion: "my.example.com",
+		NewGroupVersion: "someapp.io",
+		VersionMappings: []string{"v1alpha1:v1", "v1beta1:v1"},
+	}, h.discoveryClient, h.migrator.sourceCRDClient)
+	require.NoError(t, err)
+
+	assert.Equal(t, "my.example.com/v1beta1", options.OldGroupVersion)
+	assert.Equal(t, "someapp.io/v1", options.NewGroupVersion)
+	assert.Equal(t, []string{"my.example.com/v1alpha1:someapp.io/v1"}, options.GroupVersionMappings)
+	assert.Equal(t, map[string]stringSet{
+		"my.example.com/v1beta1":  {"foo": {}},
+		"my.example.com/v1alpha1": {"bar": {}},
+	}, onlyReadAt)
+
+	// with OneVersion, every resource is read at the preferred version,
+	// and a snapshot doesn't have a new group
+	options, onlyReadAt, err = resolveVersions(Options{
+		OldGroupVersion: "my.example.com",
+		OneVersion:      true,
+	}, h.discoveryClient, h.migrator.sourceCRDClient)
+	require.NoError(t, err)
+	assert.Equal(t, "my.example.com/v1beta1", options.OldGroupVersion)
+	assert.Empty(t, options.NewGroupVersion)
+	assert.Nil(t, options.GroupVersionMappings)
+	assert.Equal(t, map[string]stringSet{"my.example.com/v1beta1": {"foo": {}, "bar": {}}}, onlyReadAt)
+
+	// group/versions are kept as they are
+	options, onlyReadAt, err = resolveVersions(Options{
+		OldGroupVersion: "my.example.com/v1alpha1",
+		NewGroupVersion: "someapp.io/v1",
+	}, h.discoveryClient, h.migrator.sourceCRDClient)
+	require.NoError(t, err)
+	assert.Equal(t, "my.example.com/v1alpha1", options.OldGroupVersion)
+	assert.Nil(t, options.GroupVersionMappings)
+	assert.Empty(t, onlyReadAt)
+
+	for _, test := range []struct {
+		name    string
+		options Options
+		err     string
+	}{
+		{
+			name:    "group and groupVersion",
+			options: Options{OldGroupVersion: "my.example.com", NewGroupVersion: "someapp.io/v1"},
+			err:     "my.example.com and someapp.io/v1 must both be groups or both be groupVersions",
+		},
+		{
+			name:    "version mappings without groups",
+			options: Options{OldGroupVersion: "my.example.com/v1beta1", NewGroupVersion: "someapp.io/v1", VersionMappings: []string{"v1beta1:v1"}},
+			err:     "--version-mappings requires groups without versions in --from and --to",
+		},
+		{
+			name:    "unknown version",
+			options: Options{OldGroupVersion: "my.example.com", NewGroupVersion: "someapp.io", VersionMappings: []string{"v2:v1"}},
+			err:     "version v2 from --version-mappings isn't served by the old groups",
+		},
+		{
+			name:    "unknown group",
+			options: Options{OldGroupVersion: "other.example.com", NewGroupVersion: "someapp.io"},
+			err:     "error discovering versions of group other.example.com: group other.example.com is not served by the source cluster",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := resolveVersions(test.options, h.discoveryClient, h.migrator.sourceCRDClient)
+			assert.EqualError(t, err, test.err)
+		})
+	}
+}
+
+func TestMigrateAllVersions(t *testing.T) {
+	h := newVersionsHarness(t)
+	newGV := schema.GroupVersion{Group: "someapp.io", Version: "v1"}
+
+	// every item is visible through both versions
+	for _, version := range []string{"v1beta1", "v1alpha1"} {
+		oldGV := schema.GroupVersion{Group: "my.example.com", Version: version}
+		h.AddResources(oldGV.WithResource("bar"), objectBuilder(oldGV.String(), "Bar", "obj-1").UID("bar-uid").Build())
+		// the ownerRef uses v1beta1, not the version bars are read at
+		h.AddResources(oldGV.WithResource("foo"), objectBuilder(oldGV.String(), "Foo", "obj-1").OwnerRef("my.example.com/v1beta1", "Bar", "obj-1").Build())
+	}
+
+	m, err := NewMigratorForEnvironment(Options{
+		OldGroupVersion: "my.example.com",
+		NewGroupVersion: "someapp.io",
+		VersionMappings: []string{"v1alpha1:v1", "v1beta1:v1"},
+		// with one old group, resources don't need to be qualified
+		UpdateOwnerRefMappings: []string{"bar:foo"},
+		Workers:                1,
+		OnConflict:             "fail",
+	}, Environment{
+		SourceDynamicClient:   h.dynamicClient,
+		SourceDiscoveryClient: h.discoveryClient,
+		Log:                   discardLogger(),
+	})
+	require.NoError(t, err)
+
+	report, err := m.MigrateAllResources()
+	require.NoError(t, err)
+
+	var names []string
+	for _, resource := range report.Resources {
+		names = append(names, resource.Name)
+	}
+	assert.Equal(t, []string{"bar.my.example.com", "foo.my.example.com"}, names)
+
+	bars, err := h.dynamicClient.Resource(newGV.WithResource("bar")).List(metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Len(t, bars.Items, 1)
+
+	foos, err := h.dynamicClient.Resource(newGV.WithResource("foo")).List(metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, foos.Items, 1)
+	assert.Equal(t, []metav1.OwnerReference{{APIVersion: newGV.String(), Kind: "Bar", Name: "obj-1", UID: types.UID("bar-uid")}}, foos.Items[0].GetOwnerReferences())
+
+	// other commands only handle one group/version
+	_, err = m.Plan()
+	assert.True(t, IsPreflightError(err))
+
+	// and read the group at one version
+	m, err = NewMigratorForEnvironment(Options{
+		OldGroupVersion:        "my.example.com",
+		NewGroupVersion:        "someapp.io",
+		VersionMappings:        []string{"v1alpha1:v1", "v1beta1:v1"},
+		UpdateOwnerRefMappings: []string{"bar:foo"},
+		OneVersion:             true,
+		Workers:                1,
+		OnConflict:             "skip",
+	}, Environment{
+		SourceDynamicClient:   h.dynamicClient,
+		SourceDiscoveryClient: h.discoveryClient,
+		Log:                   discardLogger(),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "my.example.com/v1beta1", m.oldGroupVersion.String())
+
+	verifyReport, err := m.Verify()
+	require.NoError(t, err)
+	require.Len(t, verifyReport.Resources, 2)
+	assert.Zero(t, verifyReport.MismatchCount())
+	for _, resource := range verifyReport.Resources {
+		assert.Equal(t, []string{"obj-1"}, resource.Matching, resource.Name)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Package migrator copies the instances of custom resources from one API
+// group/version to another, like the crd-migrator command, for programs
+// such as operators that migrate their own resources during upgrades.
+package migrator
+
+import (
+	"context"
+
+	"github.com/vmware/crd-migration-tool/internal"
+)
+
+// Options configure a migration, with the same meaning as the flags of the
+// crd-migrator command. The kubeconfig, context, QPS and burst options are
+// ignored, since the clients are part of the Environment.
+type Options = internal.Options
+
+// ResourceSettings override Options for the resources matching a glob
+// pattern, like the settings of a config file.
+type ResourceSettings = internal.ResourceSettings
+
+// Environment holds the clients of the source and destination clusters,
+// and where the migration logs and writes its output.
+type Environment = internal.Environment
+
+// Result is the report of a migration: how many items of every resource
+// were created, updated, skipped or failed. The items themselves are only
+// listed if Options.ReportFile is set; an Observer gets every item as
+// it's migrated.
+type Result = internal.RunReport
+
+// ResourceResult is the part of a Result about one resource.
+type ResourceResult = internal.ResourceReport
+
+// ItemCounts are the numbers of items in a ResourceResult by what happened
+// to them.
+type ItemCounts = internal.ItemCounts
+
+// ItemResult identifies an item in a ResourceResult, with the reason it
+// was skipped or failed.
+type ItemResult = internal.ItemReport
+
+// OwnerRefRewrite is an ownerRef that was changed to point to a migrated
+// owner, or dropped.
+type OwnerRefRewrite = internal.OwnerRefRewrite
+
+// Observer receives the events of a migration, if it's set in the
+// Environment. Observe is called for one event at a time, while the item
+// it's about waits, so it should return quickly.
+type Observer = internal.Observer
+
+// ObserverFunc is an Observer that calls itself.
+type ObserverFunc = internal.ObserverFunc
+
+// Event reports the progress of a migration to an Observer.
+type Event = internal.Event
+
+// EventType is the kind of progress an Event reports.
+type EventType = internal.EventType
+
+// The types of events, in the order they're sent for a resource.
+const (
+	ResourceStarted   = internal.ResourceStarted
+	ItemCreated       = internal.ItemCreated
+	ItemUpdated       = internal.ItemUpdated
+	ItemSkipped       = internal.ItemSkipped
+	OwnerRefRewritten = internal.OwnerRefRewritten
+	ItemFailed        = internal.ItemFailed
+	ResourceCompleted = internal.ResourceCompleted
+)
+
+// PartialFailureError is returned by Migrate when some items or resources
+// couldn't be migrated. The others were migrated.
+type PartialFailureError = internal.PartialFailureError
+
+// IsPreflightError returns whether err means that nothing was migrated,
+// because of the options or the state of the clusters.
+func IsPreflightError(err error) bool {
+	return internal.IsPreflightError(err)
+}
+
+// Migrator migrates the items of one API group/version to another.
+type Migrator struct {
+	migrator *internal.Migrator
+}
+
+// New returns a Migrator for options that works with the clients of env.
+// LogLevel defaults to "info", Workers to 1 and OnConflict to "skip". No
+// items are read or changed until Migrate is called.
+func New(options Options, env Environment) (*Migrator, error) {
+	if options.LogLevel == "" {
+		options.LogLevel = "info"
+	}
+	if options.Workers == 0 {
+		options.Workers = 1
+	}
+	if options.OnConflict == "" {
+		options.OnConflict = "skip"
+	}
+
+	m, err := internal.NewMigratorForEnvironment(options, env)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{migrator: m}, nil
+}
+
+// Migrate copies all items of the old group/version to the new one and
+// returns the result. Items that fail don't stop the migration; their
+// errors are returned in a *PartialFailureError.
+//
+// When ctx is done, the items being migrated are completed and Migrate
+// returns the result so far with ctx.Err(). A Migrator can't be used
+// again once its migration has been cancelled.
+func (m *Migrator) Migrate(ctx context.Context) (*Result, error) {
+	// the watcher below might not run before the first resource starts
+	if ctx.Err() != nil {
+		m.migrator.Stop()
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			m.migrator.Stop()
+		case <-done:
+		}
+	}()
+
+	result, err := m.migrator.MigrateAllResources()
+	if err == internal.ErrInterrupted && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+
+	return result, err
+}
@@ -0,0 +1,145 @@
+// Copyright 2019 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package migrator
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var (
+	oldFoos = schema.GroupVersionResource{Group: "old.example.com", Version: "v1", Resource: "foos"}
+	newFoos = schema.GroupVersionResource{Group: "new.example.com", Version: "v1", Resource: "foos"}
+	crds    = schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}
+)
+
+// newEnvironment returns an environment with one cluster serving v1 CRDs
+// and foos in the old and new group, and count foos in the old group.
+func newEnvironment(t *testing.T, count int) Environment {
+	discoveryClient := &fakediscovery.FakeDiscovery{Fake: new(k8stesting.Fake)}
+	dynamicClient := fakedynamic.NewSimpleDynamicClient(runtime.NewScheme())
+
+	discoveryClient.Resources = append(discoveryClient.Resources, &metav1.APIResourceList{
+		GroupVersion: crds.GroupVersion().String(),
+		APIResources: []metav1.APIResource{{Name: crds.Resource, Kind: "CustomResourceDefinition"}},
+	})
+
+	for _, gvr := range []schema.GroupVersionResource{oldFoos, newFoos} {
+		discoveryClient.Resources = append(discoveryClient.Resources, &metav1.APIResourceList{
+			GroupVersion: gvr.GroupVersion().String(),
+			APIResources: []metav1.APIResource{
+				{Name: gvr.Resource, Kind: "Foo", Namespaced: true, Verbs: []string{"create", "get", "list"}},
+			},
+		})
+
+		crd := new(unstructured.Unstructured)
+		crd.SetName(gvr.Resource + "." + gvr.Group)
+		_, err := dynamicClient.Resource(crds).Create(crd, metav1.CreateOptions{})
+		require.NoError(t, err)
+	}
+
+	for i := 0; i < count; i++ {
+		foo := new(unstructured.Unstructured)
+		foo.SetAPIVersion(oldFoos.GroupVersion().String())
+		foo.SetKind("Foo")
+		foo.SetNamespace("default")
+		foo.SetName(string(rune('a' + i)))
+		_, err := dynamicClient.Resource(oldFoos).Namespace("default").Create(foo, metav1.CreateOptions{})
+		require.NoError(t, err)
+	}
+
+	return Environment{
+		SourceDynamicClient:   dynamicClient,
+		SourceDiscoveryClient: discoveryClient,
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	env := newEnvironment(t, 2)
+
+	m, err := New(Options{OldGroupVersion: "old.example.com/v1", NewGroupVersion: "new.example.com/v1"}, env)
+	require.NoError(t, err)
+
+	result, err := m.Migrate(context.Background())
+	require.NoError(t, err)
+	require.Len(t, result.Resources, 1)
+	// without a report file, the items are counted but not listed
+	assert.Equal(t, ItemCounts{Created: 2}, result.Resources[0].Counts)
+	assert.Empty(t, result.Resources[0].Created)
+
+	list, err := env.SourceDynamicClient.Resource(newFoos).Namespace("default").List(metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Len(t, list.Items, 2)
+}
+
+func TestMigrateResourceSettings(t *testing.T) {
+	env := newEnvironment(t, 1)
+
+	existing := new(unstructured.Unstructured)
+	existing.SetAPIVersion(newFoos.GroupVersion().String())
+	existing.SetKind("Foo")
+	existing.SetNamespace("default")
+	existing.SetName("a")
+	_, err := env.SourceDynamicClient.Resource(newFoos).Namespace("default").Create(existing, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	m, err := New(Options{
+		OldGroupVersion:  "old.example.com/v1",
+		NewGroupVersion:  "new.example.com/v1",
+		OnConflict:       "skip",
+		ResourceSettings: []ResourceSettings{{Resources: "foo*", OnConflict: "overwrite"}},
+	}, env)
+	require.NoError(t, err)
+
+	result, err := m.Migrate(context.Background())
+	require.NoError(t, err)
+	require.Len(t, result.Resources, 1)
+	assert.Equal(t, ItemCounts{Updated: 1}, result.Resources[0].Counts)
+}
+
+func TestMigrateObserver(t *testing.T) {
+	env := newEnvironment(t, 1)
+
+	var types []EventType
+	env.Observer = ObserverFunc(func(event Event) {
+		types = append(types, event.Type)
+	})
+
+	m, err := New(Options{OldGroupVersion: "old.example.com/v1", NewGroupVersion: "new.example.com/v1"}, env)
+	require.NoError(t, err)
+
+	_, err = m.Migrate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []EventType{ResourceStarted, ItemCreated, ResourceCompleted}, types)
+}
+
+func TestMigrateCancelled(t *testing.T) {
+	m, err := New(Options{OldGroupVersion: "old.example.com/v1", NewGroupVersion: "new.example.com/v1"}, newEnvironment(t, 2))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	result, err := m.Migrate(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, result.Interrupted)
+}
+
+func TestNewInvalidOptions(t *testing.T) {
+	_, err := New(Options{OldGroupVersion: "old.example.com/v1", NewGroupVersion: "new.example.com/v1", OnConflict: "replace"}, newEnvironment(t, 0))
+	assert.True(t, IsPreflightError(err))
+
+	_, err = New(Options{OldGroupVersion: "old.example.com/v1", NewGroupVersion: "new.example.com/v1"}, Environment{})
+	assert.EqualError(t, err, "the source dynamic and discovery clients are required")
+}